@@ -13,19 +13,66 @@ type acornMemory struct {
 	activeRom       uint8
 	memLog          bool
 
+	// Memory mapped devices on Fred, Jim and Sheila
+	ioDevices [ioEnd - ioStart + 1]ioDevice
+
+	// Tube mode, data is the second processor memory
+	tube   bool
+	ioData []uint8 // I/O processor memory
+
+	// Master shadow RAM, replaces the main memory from &3000 to &7FFF
+	shadow         []uint8
+	shadowSelected bool // CPU access to the shadow RAM, OSBYTE &6C
+	shadowVdu      bool // VDU drivers use the shadow RAM, OSBYTE &70
+	shadowDisplay  bool // The display shows the shadow RAM, OSBYTE &71
+
+	// Screen memory, the writes are shown by the VDU
+	screenStart   uint16
+	screenChanged func(address uint16)
+
+	// Watchpoints of the debugger, nil if there are none
+	watch func(address uint16, value uint8, write bool)
+
 	// Some (probably unneeded) optimisations
 	pActiveRom   *[]uint8
 	activeRomEnd uint16
 }
 
+// A device mapped on Fred, Jim or Sheila
+type ioDevice interface {
+	peek(address uint16) uint8
+	poke(address uint16, value uint8)
+}
+
 func newAcornMemory(memLog bool) *acornMemory {
 	var a acornMemory
 	a.memLog = memLog
+	a.screenStart = romStartAddress
 	a.selectRom(0xf)
 	return &a
 }
 
 func (m *acornMemory) Poke(address uint16, value uint8) {
+	if m.watch != nil {
+		m.watch(address, value, true)
+	}
+
+	if m.tube {
+		// All RAM, but the client code
+		if address < tubeClientStart {
+			m.data[address] = value
+		}
+		return
+	}
+
+	if m.shadowSelected && address >= shadowStart && address < romStartAddress {
+		m.shadow[address-shadowStart] = value
+		if m.shadowDisplay {
+			m.notifyScreen(address)
+		}
+		return
+	}
+
 	if m.memLog {
 		area := memoryArea(address)
 		if area != "" {
@@ -43,12 +90,59 @@ func (m *acornMemory) Poke(address uint16, value uint8) {
 		if address == sheilaRomLatch {
 			m.selectRom(value & 0xf)
 		}
+
+		if address >= ioStart && address <= ioEnd {
+			device := m.ioDevices[address-ioStart]
+			if device != nil {
+				device.poke(address, value)
+				return
+			}
+		}
 	}
 	m.data[address] = value
+	if !m.shadowDisplay {
+		m.notifyScreen(address)
+	}
+}
+
+func (m *acornMemory) notifyScreen(address uint16) {
+	if address >= m.screenStart && address < romStartAddress && m.screenChanged != nil {
+		m.screenChanged(address)
+	}
+}
+
+// Read the screen memory on the bank being displayed
+func (m *acornMemory) peekScreen(address uint16) uint8 {
+	if m.shadowDisplay && address >= shadowStart && address < romStartAddress {
+		return m.shadow[address-shadowStart]
+	}
+	return m.data[address]
 }
 
 func (m *acornMemory) Peek(address uint16) uint8 {
+	value := m.peek(address)
+	if m.watch != nil {
+		m.watch(address, value, false)
+	}
+	return value
+}
+
+func (m *acornMemory) peek(address uint16) uint8 {
 	value := m.data[address]
+	if m.tube {
+		return value
+	}
+
+	if m.shadowSelected && address >= shadowStart && address < romStartAddress {
+		return m.shadow[address-shadowStart]
+	}
+
+	if address >= ioStart && address <= ioEnd {
+		device := m.ioDevices[address-ioStart]
+		if device != nil {
+			value = device.peek(address)
+		}
+	}
 
 	if m.memLog {
 		area := memoryArea(address)
@@ -64,8 +158,48 @@ func (m *acornMemory) Peek(address uint16) uint8 {
 	return value
 }
 
+/*
+Access to the I/O processor memory. It is the same as the main memory
+unless running on Tube mode. On Tube mode the MOS state on pages 2 and 3 is
+shared.
+*/
+func (m *acornMemory) peekIO(address uint16) uint8 {
+	if !m.tube || (address >= tubeSharedStart && address <= tubeSharedEnd) {
+		return m.Peek(address)
+	}
+	return m.ioData[address]
+}
+
+func (m *acornMemory) pokeIO(address uint16, value uint8) {
+	if !m.tube || (address >= tubeSharedStart && address <= tubeSharedEnd) {
+		m.Poke(address, value)
+		return
+	}
+	m.ioData[address] = value
+}
+
+// Switch the CPU access to &3000-&7FFF between the main and the shadow RAM
+func (m *acornMemory) selectShadow(selected bool) {
+	m.allocShadow()
+	m.shadowSelected = selected
+}
+
+func (m *acornMemory) allocShadow() {
+	if m.shadow == nil {
+		m.shadow = make([]uint8, romStartAddress-shadowStart)
+	}
+}
+
+// Map a device on the addresses from start to end, both included
+func (m *acornMemory) registerIO(start uint16, end uint16, device ioDevice) {
+	for address := start; address <= end; address++ {
+		m.ioDevices[address-ioStart] = device
+	}
+}
+
+// Instruction fetches, they don't trigger the watchpoints
 func (m *acornMemory) PeekCode(address uint16) uint8 {
-	return m.Peek(address)
+	return m.peek(address)
 }
 
 func (m *acornMemory) selectRom(slot uint8) {
@@ -221,3 +355,8 @@ func (m *acornMemory) pokeBCD(address uint16, value uint8) {
 	bcd := value/10*16 + value%10
 	m.Poke(address, bcd)
 }
+
+func (m *acornMemory) peekBCD(address uint16) uint8 {
+	bcd := m.Peek(address)
+	return (bcd>>4)*10 + bcd&0xf
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+/*
+	Analogue to digital converter, the uPD7002 used for the joysticks and the
+	analogue port.
+
+	The channel values come from a host source with one sample per line. Each
+	line has the four channel values, 0 to 65535 as returned by ADVAL, and
+	optionally the fire buttons as a bitmask:
+		32768 32768 0 65535 1
+	The fields can be separated by spaces or commas and the lines starting
+	with # are ignored.
+
+	The source can be a file, a named pipe or a script if it starts with "|".
+	A new line is read when the program reads again a channel already read
+	from the current line. That way a data logging loop gets one sample per
+	iteration. When the source ends, the last values are kept.
+
+	The fire buttons can also be mapped to keys, the button is pressed when
+	the key is read and released after the buttons are read with ADVAL(0).
+
+	See:
+		https://beebwiki.mdfs.net/ADVAL
+		https://beebwiki.mdfs.net/OSBYTE_%2680
+*/
+
+const (
+	adcChannels = 4
+)
+
+type adcSystem struct {
+	values      [adcChannels]uint16
+	buttons     uint8
+	keyButtons  uint8
+	lastChannel uint8 // 0 if no conversion has been completed
+
+	source  *bufio.Scanner
+	closer  io.Closer
+	cmd     *exec.Cmd
+	read    [adcChannels]bool
+	started bool
+
+	buttonKeys string // The keys for fire buttons 0 and 1
+}
+
+func newAdcSystem() *adcSystem {
+	return &adcSystem{}
+}
+
+func (a *adcSystem) openSource(spec string) error {
+	var reader io.ReadCloser
+	if strings.HasPrefix(spec, "|") {
+		a.cmd = exec.Command("sh", "-c", spec[1:])
+		a.cmd.Stderr = os.Stderr
+		stdout, err := a.cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		err = a.cmd.Start()
+		if err != nil {
+			return err
+		}
+		reader = stdout
+	} else {
+		file, err := os.Open(spec)
+		if err != nil {
+			return err
+		}
+		reader = file
+	}
+
+	a.source = bufio.NewScanner(reader)
+	a.closer = reader
+	return nil
+}
+
+func (a *adcSystem) setButtonKeys(keys string) error {
+	if len(keys) > 2 {
+		return errors.New("only two fire buttons are available")
+	}
+	a.buttonKeys = keys
+	return nil
+}
+
+func (a *adcSystem) close() {
+	if a.closer != nil {
+		a.closer.Close()
+		a.closer = nil
+	}
+	if a.cmd != nil {
+		if a.cmd.Process != nil {
+			a.cmd.Process.Kill()
+		}
+		a.cmd.Wait()
+		a.cmd = nil
+	}
+	a.source = nil
+}
+
+func (a *adcSystem) nextSample() {
+	for a.source != nil && a.source.Scan() {
+		line := strings.TrimSpace(a.source.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == ','
+		})
+		a.buttons = 0
+		for i, field := range fields {
+			value, err := strconv.ParseUint(field, 10, 16)
+			if err != nil {
+				continue
+			}
+			if i < adcChannels {
+				a.values[i] = uint16(value)
+			} else if i == adcChannels {
+				a.buttons = uint8(value) & 0x3
+			}
+		}
+		return
+	}
+	// Source exhausted, the last values are kept
+	a.close()
+}
+
+// Convert a channel 1 to 4 and return the value with the resolution of the conversion type
+func (a *adcSystem) convert(channel uint8, bits uint8) uint16 {
+	index := (channel - 1) % adcChannels
+	if !a.started || a.read[index] {
+		a.started = true
+		a.read = [adcChannels]bool{}
+		a.nextSample()
+	}
+	a.read[index] = true
+	a.lastChannel = channel
+	return a.value(channel, bits)
+}
+
+// Last value converted for a channel 1 to 4
+func (a *adcSystem) value(channel uint8, bits uint8) uint16 {
+	value := a.values[(channel-1)%adcChannels]
+	if bits == 8 {
+		return value & 0xff00
+	}
+	return value & 0xfff0
+}
+
+// The fire buttons on bits 0 and 1
+func (a *adcSystem) fireButtons() uint8 {
+	buttons := a.buttons | a.keyButtons
+	a.keyButtons = 0
+	return buttons
+}
+
+func (a *adcSystem) keyPressed(ch uint8) {
+	i := strings.IndexByte(a.buttonKeys, ch)
+	if i >= 0 {
+		a.keyButtons |= 1 << i
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func integrationTestAdc(t *testing.T, samples string, lines []string) string {
+	filename := filepath.Join(t.TempDir(), "samples.txt")
+	err := os.WriteFile(filename, []byte(samples), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var env *environment
+	out := integrationTestBasicWithSetup(lines, func(e *environment) {
+		env = e
+		err := env.adc.openSource(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	env.adc.close()
+	return out
+}
+
+func TestAdcSamples(t *testing.T) {
+	out := integrationTestAdc(t,
+		"# Recorded samples\n1000 2000 3000 4000 1\n5000,6000,7000,8000\n",
+		[]string{
+			"FOR I%=1 TO 3:PRINT ADVAL(1),ADVAL(2),ADVAL(0) AND 3:NEXT",
+		})
+
+	if !strings.Contains(out, "       992      2000         1\n") {
+		t.Error("The first sample is wrong")
+	}
+	if !strings.Contains(out, "      4992      6000         0\n\r      4992      6000         0\n") {
+		t.Error("The last sample should be kept")
+	}
+}
+
+func TestAdcConversionType(t *testing.T) {
+	out := integrationTestAdc(t,
+		"1000 2000 3000 4000\n",
+		[]string{
+			"*FX190,8",
+			"PRINT ADVAL(4)",
+			"*FX16,1",
+			"PRINT ADVAL(0) DIV 256",
+		})
+
+	if !strings.Contains(out, "PRINT ADVAL(4)\n      3840\n") {
+		t.Error("The 8 bits conversion is wrong")
+	}
+	if !strings.Contains(out, "PRINT ADVAL(0) DIV 256\n         4\n") {
+		t.Error("The last channel converted should be 4")
+	}
+}
@@ -48,9 +48,10 @@ IND1V:          .addr epIND1
 IND2V:          .addr epIND2
 IND3V:          .addr epIND3
 
-; support code
-                .res $f000 - *
-                .org $f000
+; support code, on the client code area of the Tube to keep it
+; available when a language is relocated up to $f7ff, as Hi-BASIC
+                .res $f800 - *
+                .org $f800
 
 ; Send cli command to ROMS and check the result
 ; See https://github.com/raybellis/mos120/blob/2e2ff80708e79553643e4b77c947b0652117731b/mos120.s#L10701
@@ -15,13 +15,58 @@ import (
 
 func RunMOS(env *environment) {
 
-	env.initUpperLanguage()
+	if !env.restored {
+		if env.z80 != nil {
+			env.z80.reset()
+		} else {
+			env.initUpperLanguage()
+		}
+	}
+	env.speed.pause()
 
 	// Execute
 	for !env.stop {
-		env.cpu.ExecuteInstruction()
-
 		pc, sp := env.cpu.GetPCAndSP()
+		if env.debugger.mustStop(pc) {
+			env.debugger.monitor()
+			if env.stop {
+				break
+			}
+			pc, _ = env.cpu.GetPCAndSP() // Can be changed on the monitor
+			env.speed.pause()
+		}
+		if env.gdb != nil && env.gdb.mustStop(pc) {
+			env.gdb.stopped()
+			if env.stop {
+				break
+			}
+			pc, _ = env.cpu.GetPCAndSP()
+			env.speed.pause()
+		}
+		if env.z80 != nil && env.z80.host(pc) {
+			// The 6502 waits while the Z80 second processor runs
+			env.speed.throttle()
+			continue
+		}
+		if env.coverage != nil {
+			env.coverage.executedAt(pc)
+		}
+
+		if env.cpu.GetTrace() {
+			if name, ok := env.symbols.name(pc); ok {
+				fmt.Printf("%s:\n", name)
+			}
+		}
+		if env.profiler != nil {
+			env.profiler.before()
+		}
+		env.executeInstruction()
+		if env.profiler != nil {
+			env.profiler.after()
+		}
+		env.speed.throttle()
+
+		pc, sp = env.cpu.GetPCAndSP()
 		if env.apiLog {
 			switch pc {
 			case romStartAddress:
@@ -39,9 +84,24 @@ func RunMOS(env *environment) {
 				pc < extentedVectorTableEnd {
 
 				// See http://beebwiki.mdfs.net/index.php/Paged_ROM
-				panic(fmt.Sprintf("Extender vectors not implemented, %04x was called", pc))
+				env.fatalError(fmt.Sprintf("Extender vectors not implemented, %04x was called", pc))
 
 			} else if pc <= epEntryPointsLast {
+				env.debugger.mosCall(pc)
+				if env.stop {
+					break
+				}
+				if newPC, _ := env.cpu.GetPCAndSP(); newPC != pc {
+					// Changed on the monitor, the call is not serviced
+					continue
+				}
+				if env.mosTrace != nil {
+					env.mosTrace.begin(pc)
+				}
+				if env.profiler != nil {
+					env.profiler.mosBegin(pc)
+				}
+				env.speed.mosBegin()
 				a, x, y, p := env.cpu.GetAXYP()
 
 				// Intercept MOS API calls.
@@ -123,8 +183,9 @@ func RunMOS(env *environment) {
 					*/
 					ch, stop := env.readChar()
 					if stop {
+						// The loop ends after the MOS call is closed
 						env.stop = true
-						return
+						break
 					}
 
 					pOut := p &^ 1 // Clear carry
@@ -155,13 +216,22 @@ func RunMOS(env *environment) {
 
 				case epBRK: // BRKV
 					// The selected ROM has not defined a custom BRKV
-					panic("Unhandled BRK")
+					env.fatalError("Unhandled BRK")
 
 				case epRDRM: // OSRDRM
 					currentRom := env.mem.Peek(sheilaRomLatch)
 					address := env.mem.peekWord(zpAddress)
-					env.mem.Poke(sheilaRomLatch, y)
-					value := env.mem.Peek(address)
+					var value uint8
+					if env.isTube() {
+						// The ROMs are on the I/O processor
+						rom := env.mem.sideRom[y&0xf]
+						if address >= romStartAddress && int(address-romStartAddress) < len(rom) {
+							value = rom[address-romStartAddress]
+						}
+					} else {
+						env.mem.Poke(sheilaRomLatch, y)
+						value = env.mem.Peek(address)
+					}
 
 					env.cpu.SetAXYP(value, currentRom, 0, p)
 					env.mem.Poke(sheilaRomLatch, currentRom)
@@ -217,16 +287,25 @@ func RunMOS(env *environment) {
 
 					// TODO: multiple ROMS: service call 6 before the jump to vectorBRK
 
-					env.log(fmt.Sprintf("BREAK(ERR=%02x, '%s')", faultNumber, faultString))
+					env.log(fmt.Sprintf("BREAK(ERR=%02x, '%s', BRK=%s)", faultNumber, faultString,
+						env.symbols.location(address-1)))
 
 					if env.panicOnErr && faultNumber == 0 && faultString == "" {
 						// The code is probably running on zeroed memory
-						panic("Running on zeroed memory")
+						env.fatalError("Running on zeroed memory")
 					}
 
 				default:
 					env.notImplemented(fmt.Sprintf("MOS(EP=0x%04x,A=0x%02x,X=0x%02x,y=0x%02x)", pc, a, x, y))
 				}
+
+				if env.mosTrace != nil {
+					env.mosTrace.end()
+				}
+				if env.profiler != nil {
+					env.profiler.mosEnd()
+				}
+				env.speed.mosEnd(pc)
 			}
 		}
 	}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+	Breakpoints and watchpoints for the debugger. They are set with the
+	-break and -tracepoint options, with *BREAK and with the b command of the
+	monitor. A breakpoint stops on the monitor, a tracepoint shows the state
+	and continues.
+
+	Specs, the numbers are hex or symbols, see symbols.go:
+		1900             PC
+		main             PC on a symbol
+		c:8000           PC with the ROM on slot c selected
+		OSWORD           call to a MOS entry point
+		OSBYTE=81        call to a MOS entry point with A=&81
+		r:3000-3fff      read of a memory range
+		w:70             write of a memory location
+		rw:70-7f         read or write of a memory range
+
+	The memory accesses of the MOS calls serviced by bbz are also watched.
+	The instruction fetches and the accesses of the monitor and of the gdb
+	client are not.
+*/
+
+const (
+	bpPC = iota
+	bpMOS
+	bpWatch
+)
+
+type breakpoint struct {
+	kind  int
+	start uint16
+	end   uint16
+	rom   int // Slot for PC breakpoints, -1 for any
+	a     int // A for MOS breakpoints, -1 for any
+	read  bool
+	write bool
+	trace bool // Show the state and continue
+	spec  string
+}
+
+func (d *debugger) parseBreakpoint(spec string, trace bool) (*breakpoint, error) {
+	bp := breakpoint{rom: -1, a: -1, trace: trace, spec: spec}
+	upper := strings.ToUpper(spec)
+
+	name, aText, hasA := strings.Cut(upper, "=")
+	if entry, ok := mosEntryPoint(name); ok {
+		bp.kind = bpMOS
+		bp.start = entry
+		bp.end = entry
+		if hasA {
+			a, ok := parseHex(aText)
+			if !ok || a > 0xff {
+				return nil, errors.New("bad value for A")
+			}
+			bp.a = int(a)
+		}
+		return &bp, nil
+	}
+
+	prefix, rest, hasPrefix := strings.Cut(spec, ":")
+	prefix = strings.ToUpper(prefix)
+	if hasPrefix && (prefix == "R" || prefix == "W" || prefix == "RW") {
+		bp.kind = bpWatch
+		bp.read = strings.Contains(prefix, "R")
+		bp.write = strings.Contains(prefix, "W")
+		startText, endText, isRange := strings.Cut(rest, "-")
+		var ok bool
+		bp.start, ok = d.parseAddress(startText)
+		if !ok {
+			return nil, errors.New("bad address")
+		}
+		bp.end = bp.start
+		if isRange {
+			bp.end, ok = d.parseAddress(endText)
+			if !ok || bp.end < bp.start {
+				return nil, errors.New("bad range")
+			}
+		}
+		return &bp, nil
+	}
+
+	bp.kind = bpPC
+	addressText := spec
+	if hasPrefix {
+		slot, ok := parseHex(prefix)
+		if !ok || slot > 0xf {
+			return nil, errors.New("bad ROM slot")
+		}
+		bp.rom = int(slot)
+		addressText = rest
+	}
+	var ok bool
+	bp.start, ok = d.parseAddress(addressText)
+	if !ok {
+		return nil, errors.New("bad breakpoint")
+	}
+	bp.end = bp.start
+	return &bp, nil
+}
+
+// Add breakpoints separated by commas, as given on the command line
+func (d *debugger) addBreakpoints(specs string, trace bool) error {
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		bp, err := d.parseBreakpoint(spec, trace)
+		if err != nil {
+			return fmt.Errorf("%s: %w", spec, err)
+		}
+		d.addBreakpoint(bp)
+	}
+	return nil
+}
+
+func (d *debugger) addBreakpoint(bp *breakpoint) {
+	d.breakpoints = append(d.breakpoints, bp)
+	d.updateWatch()
+}
+
+func (d *debugger) clearBreakpoints() {
+	d.breakpoints = nil
+	d.updateWatch()
+}
+
+// The memory hook is only installed if there are watchpoints
+func (d *debugger) updateWatch() {
+	d.env.mem.watch = nil
+	for _, bp := range d.breakpoints {
+		if bp.kind == bpWatch {
+			d.env.mem.watch = d.watchHit
+			return
+		}
+	}
+}
+
+/*
+Breakpoint commands for *BREAK and the monitor:
+
+	(none)          list the breakpoints
+	<spec> [TRACE]  add a breakpoint or a tracepoint
+	CLEAR           remove all
+*/
+func (d *debugger) breakCommand(args []string) error {
+	env := d.env
+	if len(args) == 0 {
+		if len(d.breakpoints) == 0 {
+			env.con.write("No breakpoints\n")
+		}
+		for i, bp := range d.breakpoints {
+			kind := "break"
+			if bp.trace {
+				kind = "trace"
+			}
+			env.con.write(fmt.Sprintf("%2v %s %s\n", i+1, kind, bp.spec))
+		}
+		return nil
+	}
+
+	if strings.ToUpper(args[0]) == "CLEAR" {
+		d.clearBreakpoints()
+		return nil
+	}
+
+	trace := len(args) > 1 && strings.ToUpper(args[1]) == "TRACE"
+	bp, err := d.parseBreakpoint(args[0], trace)
+	if err != nil {
+		return err
+	}
+	d.addBreakpoint(bp)
+	return nil
+}
+
+// Check the PC breakpoints, true to stop
+func (d *debugger) checkPC(pc uint16) bool {
+	for _, bp := range d.breakpoints {
+		if bp.kind == bpPC && bp.start == pc &&
+			(bp.rom < 0 || uint8(bp.rom) == d.env.mem.activeRom) {
+			if d.hit(bp, fmt.Sprintf("Breakpoint %s", bp.spec)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Called before a MOS call serviced by bbz
+func (d *debugger) mosCall(pc uint16) {
+	if len(d.breakpoints) == 0 {
+		return
+	}
+	a, _, _, _ := d.env.cpu.GetAXYP()
+	for _, bp := range d.breakpoints {
+		if bp.kind == bpMOS && bp.start == pc && (bp.a < 0 || uint8(bp.a) == a) {
+			if d.hit(bp, fmt.Sprintf("Breakpoint %s", bp.spec)) {
+				d.monitor()
+				return
+			}
+		}
+	}
+}
+
+func (d *debugger) watchHit(address uint16, value uint8, write bool) {
+	if d.inMonitor {
+		return
+	}
+	for _, bp := range d.breakpoints {
+		if bp.kind == bpWatch && address >= bp.start && address <= bp.end &&
+			(write && bp.write || !write && bp.read) {
+			access := "Read"
+			if write {
+				access = "Write"
+			}
+			reason := fmt.Sprintf("%s &%04X=&%02X at PC=&%04X", access, address, value, d.pc)
+			if d.hit(bp, reason) {
+				d.request(reason)
+			}
+		}
+	}
+}
+
+// Show the state for tracepoints, true to stop on the monitor
+func (d *debugger) hit(bp *breakpoint, reason string) bool {
+	if !bp.trace {
+		d.reason = reason
+		return true
+	}
+	d.inMonitor = true
+	d.env.con.write(reason + "\n")
+	d.showRegisters()
+	d.inMonitor = false
+	return false
+}
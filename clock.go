@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+)
+
+/*
+	Clock of the machine, used by the system clock, the interval timer and
+	the real time clock. It is the host clock unless the deterministic mode
+	is enabled with -deterministic. Then the time advances with the cycles
+	executed, as on the 2MHz 6502 of the BBC Micro, including the cost of
+	the MOS calls serviced by bbz, see speed.go. The real time clock
+	starts on a fixed date and the time limits of INKEY advance the clock
+	instead of sleeping. The runs don't depend on the host speed and the
+	random numbers seeded with TIME, as RND(-TIME), are reproducible.
+
+	The real time clock can be set at start with -rtc on both modes.
+*/
+
+const (
+	cpuFrequency      = 2_000_000 // Hz
+	clockDateFormat   = "2006-01-02 15:04:05"
+	deterministicDate = "2000-01-01 00:00:00"
+)
+
+type virtualClock struct {
+	start time.Time // Time at cycle 0
+}
+
+func (env *environment) now() time.Time {
+	c := env.virtualClock
+	if c == nil {
+		return time.Now()
+	}
+	return c.start.Add(env.emulatedTime())
+}
+
+// Time of the machine, the cycles executed at 2MHz and the waits
+func (env *environment) emulatedTime() time.Duration {
+	cycles := env.cycles()
+	return time.Duration(cycles/cpuFrequency)*time.Second +
+		time.Duration(cycles%cpuFrequency)*time.Second/cpuFrequency +
+		env.waited
+}
+
+// Wait, without sleeping on deterministic mode
+func (env *environment) sleep(d time.Duration) {
+	env.waited += d
+	if env.virtualClock == nil {
+		time.Sleep(d)
+	}
+}
+
+func (env *environment) setDeterministic() {
+	start, _ := time.ParseInLocation(clockDateFormat, deterministicDate, time.Local)
+	env.virtualClock = &virtualClock{start: start}
+	start = env.now()
+	env.referenceTime = start
+	env.lastTimerUpdate = start
+	env.rtcOffset = 0
+}
+
+// Set the real time clock to a date as "2024-01-31 12:00:00"
+func (env *environment) setRtc(date string) error {
+	t, err := time.ParseInLocation(clockDateFormat, date, time.Local)
+	if err != nil {
+		return err
+	}
+	env.rtcOffset = t.Sub(env.now())
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func deterministicRun(rtc string, lines []string) string {
+	return integrationTestBasicWithSetup(lines, func(env *environment) {
+		env.setDeterministic()
+		if rtc != "" {
+			env.setRtc(rtc)
+		}
+	})
+}
+
+func TestDeterministicMode(t *testing.T) {
+	lines := []string{
+		"DIM B% 25:?B%=0:A%=14:X%=B%:Y%=B% DIV 256:CALL &FFF1:PRINT $B%",
+		"T%=TIME:A=INKEY(300):PRINT \"WAITED \";(TIME-T%) DIV 100",
+		"X=RND(-TIME):PRINT \"RND \";RND(100000)",
+	}
+	start := time.Now()
+	out := deterministicRun("", lines)
+	if time.Since(start) > 2*time.Second {
+		t.Error("INKEY shouldn't sleep on deterministic mode")
+	}
+
+	if !strings.Contains(out, "Sat,01 Jan 2000.00:00:0") {
+		t.Log(out)
+		t.Error("The real time clock should start on 2000-01-01")
+	}
+	if !strings.Contains(out, "WAITED 3\n") {
+		t.Log(out)
+		t.Error("INKEY should advance the clock")
+	}
+	if !strings.Contains(out, "RND ") {
+		t.Log(out)
+		t.Error("RND failed")
+	}
+	if again := deterministicRun("", lines); again != out {
+		t.Log(out)
+		t.Log(again)
+		t.Error("The runs should be equal")
+	}
+}
+
+func TestRtcDate(t *testing.T) {
+	out := deterministicRun("2024-01-31 12:00:00", []string{
+		"DIM B% 25:?B%=0:A%=14:X%=B%:Y%=B% DIV 256:CALL &FFF1:PRINT $B%",
+	})
+
+	if !strings.Contains(out, "Wed,31 Jan 2024.12:00:0") {
+		t.Log(out)
+		t.Error("The real time clock should start on the date given")
+	}
+}
@@ -26,15 +26,59 @@ const (
 	zpAccumulator  uint16 = 0x00fc
 	zpErrorPointer uint16 = 0x00fd
 	zpEscapeFlag   uint16 = 0x00ff
+	zpVduStatus    uint16 = 0x00d0
 
 	vectorBRK           uint16 = 0x0202
 	mosVariablesStart   uint16 = 0x0236
 	mosRomTypeTable     uint16 = 0x023a
+	mosAdcChannel       uint16 = 0x024c
+	mosAdcMaxChannel    uint16 = 0x024d
+	mosAdcConversion    uint16 = 0x024e
 	mosSpoolFileHandle  uint16 = 0x0257
+	mosSoundSuppression uint16 = 0x0262
+	mosBellChannel      uint16 = 0x0263
+	mosBellInfo         uint16 = 0x0264
+	mosBellPitch        uint16 = 0x0265
+	mosBellDuration     uint16 = 0x0266
+	mosPagedLineCount   uint16 = 0x0269
+	mosTubePresence     uint16 = 0x027a
 	mosCharDestinations uint16 = 0x027c
+	mosShadowState      uint16 = 0x027f
 	mosCurrentLanguage  uint16 = 0x028c
 	mosVariablesEnd     uint16 = 0x028f
 
+	// VDU variables, see vduVariables.go
+	vduGraphicsWindow        uint16 = 0x0300
+	vduTextWindow            uint16 = 0x0308
+	vduGraphicsOrigin        uint16 = 0x030c
+	vduGraphicsCursor        uint16 = 0x0310
+	vduOldGraphicsCursor     uint16 = 0x0314
+	vduTextCursorX           uint16 = 0x0318
+	vduTextCursorY           uint16 = 0x0319
+	vduCursorAddress         uint16 = 0x034a
+	vduTextWindowWidth       uint16 = 0x034c
+	vduScreenBottomHigh      uint16 = 0x034e
+	vduBytesPerChar          uint16 = 0x034f
+	vduScreenTopLeft         uint16 = 0x0350
+	vduBytesPerRow           uint16 = 0x0352
+	vduScreenSizeHigh        uint16 = 0x0354
+	vduMode                  uint16 = 0x0355
+	vduMemoryMapType         uint16 = 0x0356
+	vduTextColour            uint16 = 0x0357
+	vduTextBackground        uint16 = 0x0358
+	vduGraphicsColour        uint16 = 0x0359
+	vduGraphicsBackground    uint16 = 0x035a
+	vduGraphicsPlotMode      uint16 = 0x035b
+	vduGraphicsBackPlotMode  uint16 = 0x035c
+	vduCursorStartRegister   uint16 = 0x035f
+	vduColoursMinusOne       uint16 = 0x0360
+	vduPixelsPerByteMinusOne uint16 = 0x0361
+	vduInputCursorX          uint16 = 0x0364
+	vduInputCursorY          uint16 = 0x0365
+	vduPalette               uint16 = 0x036f
+
+	mosSoftFont uint16 = 0x0c00 // Definitions of chars 224 to 255
+
 	// ROM header https://tobylobster.github.io/mos/mos/S-s2.html#SP26
 	userMemBottom             uint16 = 0x0e00
 	romStartAddress           uint16 = 0x8000
@@ -45,11 +89,27 @@ const (
 	romVersion                uint16 = 0x8008
 	romTitleString            uint16 = 0x8009
 
+	// Second processor memory map
+	tubeMemBottom   uint16 = 0x0800
+	tubeClientStart uint16 = 0xf800
+	tubeSharedStart uint16 = 0x0200 // MOS state shared with the I/O processor
+	tubeSharedEnd   uint16 = 0x03ff
+
+	// I/O processor with the Z80 second processor, the Tube host code is on pages 4 to 7
+	tubeHostIdle   uint16 = 0x0400 // The 6502 waits here while the Z80 runs
+	tubeHostError  uint16 = 0x0403 // BRKV, the errors are sent to the Z80
+	tubeHostBlock  uint16 = 0x0128 // Control blocks of the Z80 requests
+	tubeHostString uint16 = 0x0700 // Strings of the Z80 requests
+	z80RomSize     int    = 0x1000
+
+	// Master shadow RAM
+	shadowStart uint16 = 0x3000
+
 	// Support code on the firmware. Check firmware.lst when changing firmware.s
-	procServiceRoms uint16 = 0xf000
-	procOSBYTE_143  uint16 = 0xf015
-	procGSINIT      uint16 = 0xf03b
-	procGSREAD      uint16 = 0xf057
+	procServiceRoms uint16 = 0xf800
+	procOSBYTE_143  uint16 = 0xf815
+	procGSINIT      uint16 = 0xf83b
+	procGSREAD      uint16 = 0xf857
 
 	// See http://beebwiki.mdfs.net/Service_calls
 	//serviceNoOperation uint8 = 0
@@ -102,10 +162,22 @@ const (
 	// Fred, Jim and Sheila
 	sheilaStart    uint16 = 0xf000
 	sheilaRomLatch uint16 = 0xfe30
+	sheilaUserVia  uint16 = 0xfe60
+	ioStart        uint16 = 0xfc00
+	ioEnd          uint16 = 0xfeff
 
 	extentedVectorTableStart uint16 = 0xff00
 	extentedVectorTableEnd   uint16 = 0xff51
 
+	// Buffer numbers
+	bufferKeyboard    uint8 = 0
+	bufferRS423Input  uint8 = 1
+	bufferRS423Output uint8 = 2
+	bufferPrinter     uint8 = 3
+	bufferSound0      uint8 = 4
+	bufferSound3      uint8 = 7
+	bufferSpeech      uint8 = 8
+
 	maxFiles          uint8 = 100
 	maxFilenameLength int   = 255
 
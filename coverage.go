@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+	Code coverage of the 6502 program, enabled with -coverage. The addresses
+	executed are recorded, with the sideways ROM bank for the addresses from
+	&8000 to &BFFF. At exit the report is written with a summary and the
+	listings given with -coverage-listing annotated:
+		+  instruction executed
+		-  instruction not executed
+		   not an instruction
+
+	The listings can be ca65 listings, as asm/firmware.lst, or BeebAsm -v
+	listings, used as source map. A listing of a sideways ROM is matched
+	against any bank, or against the bank given as prefix, as in c:rom.lst.
+	The relocatable lines of ca65, without .org, are ignored.
+
+	See:
+		https://cc65.github.io/doc/ca65.html#ss2.2
+		https://github.com/stardot/beebasm
+*/
+
+var (
+	ca65LineRegexp    = regexp.MustCompile(`^([0-9A-Fa-f]{6})  \d+  ((?:[0-9A-Fa-f]{2} )+)\s*(.*)$`)
+	beebasmLineRegexp = regexp.MustCompile(`^\s+([0-9A-Fa-f]{4})\s+((?:[0-9A-Fa-f]{2} )+)\s*(.*)$`)
+	sourceLabelRegexp = regexp.MustCompile(`^\s*\.?[A-Za-z_@][A-Za-z0-9_@.]*:?\s+`)
+)
+
+type coverageListing struct {
+	filename string
+	bank     int // -1 for any
+}
+
+type coverage struct {
+	env      *environment
+	filename string
+	listings []coverageListing
+
+	executed     [0x10000]bool
+	bankExecuted [16][]bool // &8000 to &BFFF, allocated on use
+}
+
+func newCoverage(env *environment, filename string, listings string) (*coverage, error) {
+	var c coverage
+	c.env = env
+	c.filename = filename
+	for _, spec := range strings.Split(listings, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		listing := coverageListing{spec, -1}
+		if len(spec) > 2 && spec[1] == ':' {
+			bank, err := strconv.ParseUint(spec[:1], 16, 8)
+			if err == nil {
+				listing = coverageListing{spec[2:], int(bank)}
+			}
+		}
+		_, err := os.Stat(listing.filename)
+		if err != nil {
+			return nil, err
+		}
+		c.listings = append(c.listings, listing)
+	}
+	return &c, nil
+}
+
+// Called before each instruction with the PC
+func (c *coverage) executedAt(pc uint16) {
+	bank := c.env.codeBank(pc)
+	if bank < 0 {
+		c.executed[pc] = true
+		return
+	}
+	if c.bankExecuted[bank] == nil {
+		c.bankExecuted[bank] = make([]bool, romEndAddress-romStartAddress+1)
+	}
+	c.bankExecuted[bank][pc-romStartAddress] = true
+}
+
+func (c *coverage) isExecuted(address uint16, bank int) bool {
+	if address < romStartAddress || address > romEndAddress {
+		return c.executed[address]
+	}
+	offset := address - romStartAddress
+	if bank >= 0 {
+		return c.bankExecuted[bank] != nil && c.bankExecuted[bank][offset]
+	}
+	for _, executed := range c.bankExecuted {
+		if executed != nil && executed[offset] {
+			return true
+		}
+	}
+	// On the Tube the ROM area is RAM
+	return c.executed[address]
+}
+
+/*
+Address of the line of a listing and if it is an instruction. The source
+is an instruction if it starts with a mnemonic, after the label.
+*/
+func parseListingLine(line string) (uint16, bool, bool) {
+	m := ca65LineRegexp.FindStringSubmatch(line)
+	if m == nil {
+		m = beebasmLineRegexp.FindStringSubmatch(line)
+	}
+	if m == nil {
+		return 0, false, false
+	}
+	address, err := strconv.ParseUint(m[1], 16, 32)
+	if err != nil || address > 0xffff {
+		return 0, false, false
+	}
+
+	source := m[3]
+	if loc := sourceLabelRegexp.FindStringIndex(source); loc != nil && !isMnemonic(firstWord(source)) {
+		source = source[loc[1]:]
+	}
+	return uint16(address), true, isMnemonic(firstWord(source))
+}
+
+func firstWord(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
+
+func isMnemonic(word string) bool {
+	if word == "" || word == "???" {
+		return false
+	}
+	for _, op := range opcodes65C02 {
+		if op.name == word {
+			return true
+		}
+	}
+	for _, op := range nmosUndocumented {
+		if op.name == word {
+			return true
+		}
+	}
+	return false
+}
+
+type coverageCount struct {
+	instructions int
+	executed     int
+}
+
+func (count coverageCount) String() string {
+	return fmt.Sprintf("%v of %v instructions, %.2f%%",
+		count.executed, count.instructions, percentage(uint64(count.executed), uint64(count.instructions)))
+}
+
+// Annotate a listing, returns the lines and the counts
+func (c *coverage) annotate(listing coverageListing) ([]string, coverageCount, error) {
+	data, err := os.ReadFile(listing.filename)
+	if err != nil {
+		return nil, coverageCount{}, err
+	}
+
+	var lines []string
+	var count coverageCount
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		marker := " "
+		address, ok, isInstruction := parseListingLine(line)
+		if ok && isInstruction {
+			count.instructions++
+			marker = "-"
+			if c.isExecuted(address, listing.bank) {
+				count.executed++
+				marker = "+"
+			}
+		}
+		lines = append(lines, marker+" "+line)
+	}
+	return lines, count, nil
+}
+
+func (c *coverage) close() error {
+	file, err := os.Create(c.filename)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(file)
+	errReport := c.writeReport(out)
+	return errors.Join(errReport, out.Flush(), file.Close())
+}
+
+func (c *coverage) writeReport(out io.Writer) error {
+	addresses := 0
+	for _, executed := range c.executed {
+		if executed {
+			addresses++
+		}
+	}
+	fmt.Fprintf(out, "Coverage:\n")
+	fmt.Fprintf(out, "  %v addresses executed outside the sideways banks\n", addresses)
+	for bank, bankExecuted := range c.bankExecuted {
+		addresses = 0
+		for _, executed := range bankExecuted {
+			if executed {
+				addresses++
+			}
+		}
+		if addresses > 0 {
+			fmt.Fprintf(out, "  %v addresses executed on ROM %X %s\n",
+				addresses, bank, romTitle(c.env.mem.sideRom[bank]))
+		}
+	}
+
+	var annotated [][]string
+	var total coverageCount
+	for _, listing := range c.listings {
+		lines, count, err := c.annotate(listing)
+		if err != nil {
+			return err
+		}
+		annotated = append(annotated, lines)
+		total.instructions += count.instructions
+		total.executed += count.executed
+		fmt.Fprintf(out, "  %s: %v\n", listing.filename, count)
+	}
+	if len(c.listings) > 1 {
+		fmt.Fprintf(out, "  Total: %v\n", total)
+	}
+
+	for i, lines := range annotated {
+		fmt.Fprintf(out, "\n=== %s ===\n", c.listings[i].filename)
+		for _, line := range lines {
+			fmt.Fprintln(out, line)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const coverageCa65Listing = `ca65 V2.18 - Ubuntu 2.18-1
+Main file   : loop.s
+Current file: loop.s
+
+000000r 1                               .org $0900
+000900  1  A2 00        main:           ldx #0
+000902  1  CA           loop:           dex
+000903  1  D0 FD                        bne loop
+000905  1  60                           rts
+000906  1  EA           unused:         nop
+000907  1  41 42                        .byte "AB"
+`
+
+const coverageBeebAsmListing = `.main
+     0900   A2 00      LDX #0
+.loop
+     0902   CA         DEX
+     0903   D0 FD      BNE loop
+     0905   60         RTS
+     0906   EA         NOP
+`
+
+func TestCoverage(t *testing.T) {
+	dir := t.TempDir()
+	ca65 := filepath.Join(dir, "loop.lst")
+	beebasm := filepath.Join(dir, "loop.txt")
+	report := filepath.Join(dir, "coverage.txt")
+	err := os.WriteFile(ca65, []byte(coverageCa65Listing), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(beebasm, []byte(coverageBeebAsmListing), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var env *environment
+	integrationTestBasicWithSetup([]string{
+		"?&900=&A2:?&901=0:?&902=&CA:?&903=&D0:?&904=&FD:?&905=&60",
+		"CALL &900",
+	}, func(e *environment) {
+		env = e
+		var err error
+		env.coverage, err = newCoverage(env, report, ca65+","+beebasm)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	err = env.coverage.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	expected := []string{
+		"loop.lst: 4 of 5 instructions, 80.00%\n",
+		"loop.txt: 4 of 5 instructions, 80.00%\n",
+		"Total: 8 of 10 instructions, 80.00%\n",
+		"addresses executed on ROM F BASIC\n",
+		"+ 000902  1  CA           loop:           dex\n",
+		"- 000906  1  EA           unused:         nop\n",
+		"  000907  1  41 42                        .byte \"AB\"\n",
+		"+      0903   D0 FD      BNE loop\n",
+		"-      0906   EA         NOP\n",
+		"  .loop\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Log(out)
+			t.Errorf("Missing on the report: %q", e)
+		}
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ivanizag/iz6502"
+)
+
+/*
+	CPU variants:
+		6502:  NMOS 6502 of the BBC Model B, with the undocumented opcodes
+		65c02: CMOS 65C02, the default
+		65c12: CMOS 65SC12 of the BBC Master, a 65C02 without the Rockwell
+			bit instructions RMB, SMB, BBR and BBS
+
+	iz6502 doesn't execute the undocumented NMOS opcodes other than NOPs.
+	The stable ones are emulated here, see:
+		https://www.masswerk.at/nowgobang/2021/6502-illegal-opcodes
+		http://bbc.nvg.org/doc/6502OpList.txt
+	LAS and TAS set the stack pointer with setSP. KIL jams the CPU, it is
+	reported as not implemented and bbz stops or enters the monitor.
+*/
+
+const (
+	cpuNMOS6502  = "6502"
+	cpuCMOS65C02 = "65c02"
+	cpuCMOS65C12 = "65c12"
+
+	flagC uint8 = 0x01
+	flagZ uint8 = 0x02
+	flagD uint8 = 0x08
+	flagV uint8 = 0x40
+	flagN uint8 = 0x80
+)
+
+func (env *environment) setCPU(model string, trace bool) error {
+	cpu, err := env.newCPU(model, trace)
+	if err != nil {
+		return err
+	}
+	env.cpu = cpu
+	env.extraCycles = 0
+	env.cpuModel = model
+	return nil
+}
+
+func (env *environment) newCPU(model string, trace bool) (*iz6502.State, error) {
+	var cpu *iz6502.State
+	switch model {
+	case cpuNMOS6502:
+		cpu = iz6502.NewNMOS6502(env.mem)
+	case cpuCMOS65C02, cpuCMOS65C12:
+		cpu = iz6502.NewCMOS65c02(env.mem)
+	default:
+		return nil, fmt.Errorf("unknown CPU '%s', valid options are %s, %s and %s",
+			model, cpuNMOS6502, cpuCMOS65C02, cpuCMOS65C12)
+	}
+	cpu.SetTrace(trace)
+	return cpu, nil
+}
+
+/*
+Machine reported by OSBYTE 0 and INKEY(-256) for the CPU variant: a
+Model B with OS 1.20 for the NMOS 6502 and a Master 128 with MOS 3.20 for
+the 65C12. With the 65C02, bbz identifies itself.
+*/
+func (env *environment) machineType() (osVersion uint8, inkey256 uint8) {
+	switch env.cpuModel {
+	case cpuNMOS6502:
+		return 1, 0xff
+	case cpuCMOS65C12:
+		return 3, 0xfd
+	default:
+		return 0, 0x28 // BBZ, not currently reserved
+	}
+}
+
+func (env *environment) executeInstruction() {
+	switch env.cpuModel {
+	case cpuNMOS6502:
+		pc, _ := env.cpu.GetPCAndSP()
+		opcode := env.mem.PeekCode(pc)
+		if op, ok := nmosUndocumented[opcode]; ok {
+			env.executeUndocumented(pc, op)
+			return
+		}
+		if nmosKIL(opcode) {
+			// The CPU stays on the KIL until a reset
+			env.notImplemented(fmt.Sprintf("KIL(OPCODE=0x%02x,PC=0x%04x)", opcode, pc))
+			if !env.debugger.onError {
+				env.con.write(fmt.Sprintf("\nCPU halted by KIL at &%04X\n", pc))
+				env.stop = true
+			}
+			return
+		}
+	case cpuCMOS65C12:
+		pc, _ := env.cpu.GetPCAndSP()
+		opcode := env.mem.PeekCode(pc)
+		if opcode&0x07 == 0x07 {
+			// RMB, SMB, BBR and BBS are one byte NOPs on the 65SC12
+			env.cpu.SetPC(pc + 1)
+			env.addCycles(1)
+			return
+		}
+	}
+	env.cpu.ExecuteInstruction()
+}
+
+const (
+	modeImm = iota
+	modeZp
+	modeZpX
+	modeZpY
+	modeAbs
+	modeAbsX
+	modeAbsY
+	modeIndX
+	modeIndY
+)
+
+type undocumentedOp struct {
+	name   string
+	mode   int
+	cycles int
+}
+
+var nmosUndocumented = map[uint8]undocumentedOp{}
+
+func init() {
+	rmw := func(name string, base uint8) {
+		// The read-modify-write ones share the addressing modes
+		nmosUndocumented[base+0x07] = undocumentedOp{name, modeZp, 5}
+		nmosUndocumented[base+0x17] = undocumentedOp{name, modeZpX, 6}
+		nmosUndocumented[base+0x0f] = undocumentedOp{name, modeAbs, 6}
+		nmosUndocumented[base+0x1f] = undocumentedOp{name, modeAbsX, 7}
+		nmosUndocumented[base+0x1b] = undocumentedOp{name, modeAbsY, 7}
+		nmosUndocumented[base+0x03] = undocumentedOp{name, modeIndX, 8}
+		nmosUndocumented[base+0x13] = undocumentedOp{name, modeIndY, 8}
+	}
+	rmw("SLO", 0x00)
+	rmw("RLA", 0x20)
+	rmw("SRE", 0x40)
+	rmw("RRA", 0x60)
+	rmw("DCP", 0xc0)
+	rmw("ISC", 0xe0)
+
+	nmosUndocumented[0x87] = undocumentedOp{"SAX", modeZp, 3}
+	nmosUndocumented[0x97] = undocumentedOp{"SAX", modeZpY, 4}
+	nmosUndocumented[0x8f] = undocumentedOp{"SAX", modeAbs, 4}
+	nmosUndocumented[0x83] = undocumentedOp{"SAX", modeIndX, 6}
+
+	nmosUndocumented[0xa7] = undocumentedOp{"LAX", modeZp, 3}
+	nmosUndocumented[0xb7] = undocumentedOp{"LAX", modeZpY, 4}
+	nmosUndocumented[0xaf] = undocumentedOp{"LAX", modeAbs, 4}
+	nmosUndocumented[0xbf] = undocumentedOp{"LAX", modeAbsY, 4}
+	nmosUndocumented[0xa3] = undocumentedOp{"LAX", modeIndX, 6}
+	nmosUndocumented[0xb3] = undocumentedOp{"LAX", modeIndY, 5}
+	nmosUndocumented[0xab] = undocumentedOp{"LXA", modeImm, 2}
+
+	nmosUndocumented[0x0b] = undocumentedOp{"ANC", modeImm, 2}
+	nmosUndocumented[0x2b] = undocumentedOp{"ANC", modeImm, 2}
+	nmosUndocumented[0x4b] = undocumentedOp{"ALR", modeImm, 2}
+	nmosUndocumented[0x6b] = undocumentedOp{"ARR", modeImm, 2}
+	nmosUndocumented[0x8b] = undocumentedOp{"XAA", modeImm, 2}
+	nmosUndocumented[0xcb] = undocumentedOp{"SBX", modeImm, 2}
+	nmosUndocumented[0xeb] = undocumentedOp{"SBC", modeImm, 2}
+
+	nmosUndocumented[0xbb] = undocumentedOp{"LAS", modeAbsY, 4}
+	nmosUndocumented[0x9b] = undocumentedOp{"TAS", modeAbsY, 5}
+
+	nmosUndocumented[0x93] = undocumentedOp{"SHA", modeIndY, 6}
+	nmosUndocumented[0x9f] = undocumentedOp{"SHA", modeAbsY, 5}
+	nmosUndocumented[0x9e] = undocumentedOp{"SHX", modeAbsY, 5}
+	nmosUndocumented[0x9c] = undocumentedOp{"SHY", modeAbsX, 5}
+}
+
+func (env *environment) executeUndocumented(pc uint16, op undocumentedOp) {
+	mem := env.mem
+	a, x, y, p := env.cpu.GetAXYP()
+
+	// Effective address
+	var address uint16
+	var base uint16 // Address before indexing, for SHA, SHX and SHY
+	length := uint16(2)
+	operand := mem.Peek(pc + 1)
+	switch op.mode {
+	case modeImm:
+		address = pc + 1
+	case modeZp:
+		address = uint16(operand)
+	case modeZpX:
+		address = uint16(operand + x)
+	case modeZpY:
+		address = uint16(operand + y)
+	case modeAbs, modeAbsX, modeAbsY:
+		length = 3
+		base = mem.peekWord(pc + 1)
+		address = base
+		if op.mode == modeAbsX {
+			address += uint16(x)
+		} else if op.mode == modeAbsY {
+			address += uint16(y)
+		}
+	case modeIndX:
+		zp := operand + x
+		address = uint16(mem.Peek(uint16(zp))) + uint16(mem.Peek(uint16(zp+1)))<<8
+	case modeIndY:
+		base = uint16(mem.Peek(uint16(operand))) + uint16(mem.Peek(uint16(operand+1)))<<8
+		address = base + uint16(y)
+	}
+
+	var newSP uint8 // For LAS and TAS
+	setNZ := func(value uint8) {
+		p &^= flagN | flagZ
+		p |= value & flagN
+		if value == 0 {
+			p |= flagZ
+		}
+	}
+	setC := func(carry bool) {
+		p &^= flagC
+		if carry {
+			p |= flagC
+		}
+	}
+
+	switch op.name {
+	case "SLO":
+		value := mem.Peek(address)
+		setC(value&0x80 != 0)
+		value <<= 1
+		mem.Poke(address, value)
+		a |= value
+		setNZ(a)
+	case "RLA":
+		value := mem.Peek(address)
+		carry := p & flagC
+		setC(value&0x80 != 0)
+		value = value<<1 | carry
+		mem.Poke(address, value)
+		a &= value
+		setNZ(a)
+	case "SRE":
+		value := mem.Peek(address)
+		setC(value&0x01 != 0)
+		value >>= 1
+		mem.Poke(address, value)
+		a ^= value
+		setNZ(a)
+	case "RRA":
+		value := mem.Peek(address)
+		carry := p & flagC
+		setC(value&0x01 != 0)
+		value = value>>1 | carry<<7
+		mem.Poke(address, value)
+		a, p = nmosADC(a, value, p)
+	case "DCP":
+		value := mem.Peek(address) - 1
+		mem.Poke(address, value)
+		setC(a >= value)
+		setNZ(a - value)
+	case "ISC":
+		value := mem.Peek(address) + 1
+		mem.Poke(address, value)
+		a, p = nmosSBC(a, value, p)
+	case "SAX":
+		mem.Poke(address, a&x)
+	case "LAX":
+		a = mem.Peek(address)
+		x = a
+		setNZ(a)
+	case "LXA":
+		// Unstable, the usual magic constant is &EE
+		a = (a | 0xee) & mem.Peek(address)
+		x = a
+		setNZ(a)
+	case "ANC":
+		a &= mem.Peek(address)
+		setNZ(a)
+		setC(a&0x80 != 0)
+	case "ALR":
+		a &= mem.Peek(address)
+		setC(a&0x01 != 0)
+		a >>= 1
+		setNZ(a)
+	case "ARR":
+		a &= mem.Peek(address)
+		a = a>>1 | (p&flagC)<<7
+		setNZ(a)
+		setC(a&0x40 != 0)
+		p &^= flagV
+		if (a>>6^a>>5)&1 != 0 {
+			p |= flagV
+		}
+	case "XAA":
+		// Unstable, the usual magic constant is &EE
+		a = (a | 0xee) & x & mem.Peek(address)
+		setNZ(a)
+	case "SBX":
+		value := mem.Peek(address)
+		setC(a&x >= value)
+		x = a&x - value
+		setNZ(x)
+	case "SBC":
+		a, p = nmosSBC(a, mem.Peek(address), p)
+	case "LAS":
+		_, sp := env.cpu.GetPCAndSP()
+		a = mem.Peek(address) & sp
+		x = a
+		setNZ(a)
+		newSP = a
+	case "TAS":
+		newSP = a & x
+		mem.Poke(address, a&x&(uint8(base>>8)+1))
+	case "SHA":
+		mem.Poke(address, a&x&(uint8(base>>8)+1))
+	case "SHX":
+		mem.Poke(address, x&(uint8(base>>8)+1))
+	case "SHY":
+		mem.Poke(address, y&(uint8(base>>8)+1))
+	}
+
+	env.cpu.SetAXYP(a, x, y, p)
+	env.cpu.SetPC(pc + length)
+	env.addCycles(op.cycles)
+	if op.name == "LAS" || op.name == "TAS" {
+		err := env.setSP(newSP)
+		if err != nil {
+			env.notImplemented(fmt.Sprintf("%s(PC=0x%04x): %v", op.name, pc, err))
+		}
+	}
+}
+
+// The opcodes that jam the NMOS 6502, &x2 except &82, &A2, &C2 and &E2
+func nmosKIL(opcode uint8) bool {
+	return opcode&0x0f == 0x02 && (opcode < 0x80 || opcode == 0x92 || opcode == 0xb2 ||
+		opcode == 0xd2 || opcode == 0xf2)
+}
+
+func nmosADC(a uint8, value uint8, p uint8) (uint8, uint8) {
+	carry := uint16(p & flagC)
+	binary := uint16(a) + uint16(value) + carry
+	p &^= flagN | flagZ | flagV | flagC
+	if uint8(binary) == 0 {
+		p |= flagZ // The Z flag is from the binary result also on decimal mode
+	}
+
+	if p&flagD == 0 {
+		if binary > 0xff {
+			p |= flagC
+		}
+		if (a^value)&0x80 == 0 && (a^uint8(binary))&0x80 != 0 {
+			p |= flagV
+		}
+		result := uint8(binary)
+		p |= result & flagN
+		return result, p
+	}
+
+	lo := uint16(a&0x0f) + uint16(value&0x0f) + carry
+	if lo > 9 {
+		lo += 6
+	}
+	hi := uint16(a>>4) + uint16(value>>4)
+	if lo > 0x0f {
+		hi++
+	}
+	// N and V are set before the high nibble adjustment
+	partial := uint8(hi<<4) | uint8(lo&0x0f)
+	p |= partial & flagN
+	if (a^value)&0x80 == 0 && (a^partial)&0x80 != 0 {
+		p |= flagV
+	}
+	if hi > 9 {
+		hi += 6
+	}
+	if hi > 0x0f {
+		p |= flagC
+	}
+	return uint8(hi<<4) | uint8(lo&0x0f), p
+}
+
+func nmosSBC(a uint8, value uint8, p uint8) (uint8, uint8) {
+	borrow := 1 - int(p&flagC)
+	binary := int(a) - int(value) - borrow
+	p &^= flagN | flagZ | flagV | flagC
+
+	// Flags are from the binary result also on decimal mode
+	result := uint8(binary)
+	if binary >= 0 {
+		p |= flagC
+	}
+	if result == 0 {
+		p |= flagZ
+	}
+	p |= result & flagN
+	if (a^value)&0x80 != 0 && (a^result)&0x80 != 0 {
+		p |= flagV
+	}
+
+	if p&flagD == 0 {
+		return result, p
+	}
+
+	lo := int(a&0x0f) - int(value&0x0f) - borrow
+	hi := int(a>>4) - int(value>>4)
+	if lo < 0 {
+		lo -= 6
+		hi--
+	}
+	if hi < 0 {
+		hi -= 6
+	}
+	return uint8(hi<<4) | uint8(lo&0x0f), p
+}
+
+/*
+Cycles executed, the ones counted by iz6502 and the ones added by bbz for
+the instructions emulated here. iz6502 has no API to add cycles, they are
+kept apart.
+*/
+func (env *environment) cycles() uint64 {
+	return env.cpu.GetCycles() + env.extraCycles
+}
+
+func (env *environment) addCycles(cycles int) {
+	env.extraCycles += uint64(cycles)
+}
+
+/*
+Position of the stack pointer on the state written by Save of iz6502
+v1.2.1: the cycles as an uint64 and then A, X, Y, P, SP and PC. Check it
+when updating iz6502.
+*/
+const iz6502StateSP = 8 + 4
+
+/*
+Set the stack pointer, used by the monitor, the gdb stub, LAS and TAS. iz6502
+has no API to set it, the CPU state is saved, patched and loaded again. If
+the stack pointer read back is not the one set, the layout of the state has
+changed and the previous state is restored.
+*/
+func (env *environment) setSP(sp uint8) error {
+	var buf bytes.Buffer
+	err := env.cpu.Save(&buf)
+	if err != nil {
+		return err
+	}
+	saved := bytes.Clone(buf.Bytes())
+	if len(saved) <= iz6502StateSP {
+		return errIz6502Layout
+	}
+	data := buf.Bytes()
+	data[iz6502StateSP] = sp
+	err = env.cpu.Load(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	if _, newSP := env.cpu.GetPCAndSP(); newSP != sp {
+		err = env.cpu.Load(bytes.NewReader(saved))
+		if err != nil {
+			return err
+		}
+		return errIz6502Layout
+	}
+	return nil
+}
+
+var errIz6502Layout = errors.New("the stack pointer is not on the expected position of the iz6502 state")
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func integrationTestCPU(t *testing.T, model string, lines []string) string {
+	return integrationTestBasicWithSetup(lines, func(env *environment) {
+		err := env.setCPU(model, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestCPUNMOSUndocumented(t *testing.T) {
+	out := integrationTestCPU(t, cpuNMOS6502, []string{
+		"PRINT INKEY(-256)",
+		"?&70=42:?&900=&A7:?&901=&70:?&902=&60",
+		"PRINT USR(&900) AND &FFFF",
+		"?&71=&81:?&900=&07:?&901=&71:A%=2",
+		"PRINT ~USR(&900) AND &FF, ~?&71",
+	})
+
+	if !strings.Contains(out, "PRINT INKEY(-256)\n        -1\n") {
+		t.Error("The machine should be a Model B")
+	}
+	if !strings.Contains(out, "AND &FFFF\n     10794\n") {
+		t.Error("LAX failed")
+	}
+	if !strings.Contains(out, "~?&71\n         2         2\n") {
+		t.Error("SLO failed")
+	}
+}
+
+func TestCPU65C12(t *testing.T) {
+	out := integrationTestCPU(t, cpuCMOS65C12, []string{
+		"A%=0:X%=1:PRINT (USR(&FFF4) AND &FF00) DIV 256",
+		"?&88=255:?&900=&07:?&901=&88:?&902=&60:CALL &900:PRINT ?&88",
+	})
+
+	if !strings.Contains(out, "DIV 256\n         3\n") {
+		t.Error("The machine should be a Master 128")
+	}
+	if !strings.Contains(out, "PRINT ?&88\n       255\n") {
+		t.Error("RMB0 should be a one byte NOP and leave the memory unchanged")
+	}
+}
+
+func TestCPUNMOSStackPointer(t *testing.T) {
+	out := integrationTestCPU(t, cpuNMOS6502, []string{
+		// TSX:STX &71:LAS &A00,Y:STA &70:RTS
+		"?&A00=&FF:!&900=&BB7186BA:!&904=&70850A00:?&908=&60",
+		"Y%=0:CALL &900:PRINT ?&70=?&71",
+		// TSX:STX &71:DEX*4:LDA #&FF:TAS &A00,Y:TSX:STX &70:INX*4:TXS:RTS
+		"!&900=&CA7186BA:!&904=&A9CACACA:!&908=&0A009BFF:!&90C=&E87086BA:!&910=&9AE8E8E8:?&914=&60",
+		"Y%=0:CALL &900:PRINT ?&71-?&70",
+	})
+
+	if !strings.Contains(out, "PRINT ?&70=?&71\n        -1\n") {
+		t.Log(out)
+		t.Error("LAS should load A with the stack pointer")
+	}
+	if !strings.Contains(out, "PRINT ?&71-?&70\n         4\n") {
+		t.Log(out)
+		t.Error("TAS should set the stack pointer to A AND X")
+	}
+}
+
+func TestCPUNMOSKil(t *testing.T) {
+	out := integrationTestCPU(t, cpuNMOS6502, []string{
+		"?&900=&02:CALL &900",
+		"PRINT \"Not reached\"",
+	})
+
+	if !strings.Contains(out, "CPU halted by KIL at &0900") {
+		t.Log(out)
+		t.Error("KIL should halt the CPU")
+	}
+	if strings.Contains(out, "Not reached") {
+		t.Error("bbz should stop after KIL")
+	}
+}
+
+/*
+setSP patches the state saved by iz6502, this fails if the layout of the
+state changes.
+*/
+func TestCPUSetSP(t *testing.T) {
+	for _, model := range []string{cpuNMOS6502, cpuCMOS65C02} {
+		env := newEnvironment(nil, false, false, false, false, false)
+		err := env.setCPU(model, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.cpu.SetAXYP(0x11, 0x22, 0x33, 0x44)
+		env.cpu.SetPC(0x1234)
+
+		err = env.setSP(0x42)
+		if err != nil {
+			t.Fatalf("%v: %v", model, err)
+		}
+		a, x, y, p := env.cpu.GetAXYP()
+		pc, sp := env.cpu.GetPCAndSP()
+		if sp != 0x42 {
+			t.Errorf("%v: SP is 0x%02x and should be 0x42", model, sp)
+		}
+		if a != 0x11 || x != 0x22 || y != 0x33 || p != 0x44 || pc != 0x1234 {
+			t.Errorf("%v: setSP changed the registers", model)
+		}
+	}
+}
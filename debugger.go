@@ -0,0 +1,415 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+	Machine code monitor. It is entered with *DEBUG, with Ctrl-\ while a
+	program is running or, with the -debug option, on a BRK and on the calls
+	not implemented.
+
+	The numbers are hex with an optional & prefix. The addresses can also be
+	symbols, see symbols.go, a symbol named as a hex number wins over the
+	number without prefix. Memory on a sideways ROM bank is accessed with
+	the slot as prefix, as in c:8000.
+*/
+
+const debuggerHelp = `Commands:
+  r                   show the registers
+  r <reg> <value>     set A, X, Y, P, SP or PC
+  m [[bank:]addr] [n] dump memory, bank is a sideways ROM slot
+  e [bank:]addr b...  edit memory
+  d [addr] [n]        disassemble
+  s [n]               single step
+  n                   step over a JSR
+  g <addr>            run to the address, a number or a symbol
+  b                   list the breakpoints
+  b <spec> [trace]    add a breakpoint, see *BREAK
+  b clear             remove the breakpoints
+  c                   resume
+  q                   quit bbz
+`
+
+type debugger struct {
+	env     *environment
+	onError bool // Enter the monitor on BRK and on not implemented calls
+
+	requested   bool        // From *DEBUG, a watchpoint or a call not implemented
+	interrupted atomic.Bool // From the signal handler goroutine, Ctrl-\
+
+	reason    string
+	steps     int
+	runTo     uint16
+	running   bool // Running to an address
+	resumed   bool // Don't stop again on the same instruction
+	inMonitor bool
+	pc        uint16 // Instruction being executed
+
+	breakpoints []*breakpoint // See breakpoints.go
+
+	nextDump   uint16
+	nextDisasm uint16
+}
+
+func newDebugger(env *environment) *debugger {
+	var d debugger
+	d.env = env
+	return &d
+}
+
+// Stop on the next instruction
+func (d *debugger) request(reason string) {
+	d.reason = reason
+	d.requested = true
+}
+
+// Stop on the next instruction, called from the signal handler goroutine
+func (d *debugger) interrupt() {
+	d.interrupted.Store(true)
+}
+
+// Called before each instruction, true if the monitor has to be entered
+func (d *debugger) mustStop(pc uint16) bool {
+	resumed := d.resumed
+	d.resumed = false
+	d.pc = pc
+	if d.interrupted.Swap(false) {
+		d.reason = "Ctrl-\\"
+		return true
+	}
+	if d.requested {
+		return true
+	}
+	if len(d.breakpoints) > 0 && !resumed && d.checkPC(pc) {
+		return true
+	}
+	if d.steps > 0 {
+		d.steps--
+		if d.steps == 0 {
+			return true
+		}
+	}
+	if d.running && pc == d.runTo && !resumed {
+		d.running = false
+		d.reason = "Reached"
+		return true
+	}
+	if d.onError && d.env.mem.PeekCode(pc) == 0x00 && !resumed {
+		d.reason = "BRK"
+		if location := d.env.symbols.describe(pc); location != "" {
+			d.reason += " at " + location
+		}
+		return true
+	}
+	return false
+}
+
+func (d *debugger) monitor() {
+	env := d.env
+	d.requested = false
+	d.steps = 0
+	d.running = false
+	d.inMonitor = true
+	defer func() {
+		d.resumed = true
+		d.inMonitor = false
+	}()
+
+	if d.reason != "" {
+		env.con.write(fmt.Sprintf("\n%s\n", d.reason))
+		d.reason = ""
+	}
+	pc, _ := env.cpu.GetPCAndSP()
+	d.nextDisasm = pc
+	d.showRegisters()
+
+	for {
+		env.con.write("dbg> ")
+		line, stop := env.con.readline()
+		if stop {
+			env.stop = true
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+
+		switch strings.ToLower(args[0]) {
+		case "r":
+			if len(args) == 3 {
+				d.setRegister(args[1], args[2])
+			}
+			d.showRegisters()
+		case "m":
+			d.dumpMemory(args[1:])
+		case "e":
+			d.editMemory(args[1:])
+		case "d":
+			d.disassemble(args[1:])
+		case "s":
+			d.steps = 1
+			if len(args) > 1 {
+				n, err := strconv.Atoi(args[1])
+				if err != nil || n < 1 {
+					env.con.write("Bad count\n")
+					continue
+				}
+				d.steps = n
+			}
+			return
+		case "n":
+			opcode := env.mem.PeekCode(pc)
+			if opcode == 0x20 { // JSR
+				d.runTo = pc + 3
+				d.running = true
+			} else {
+				d.steps = 1
+			}
+			return
+		case "g":
+			if len(args) < 2 {
+				env.con.write("Address missing\n")
+				continue
+			}
+			address, ok := d.parseAddress(args[1])
+			if !ok {
+				env.con.write("Bad address\n")
+				continue
+			}
+			d.runTo = address
+			d.running = true
+			return
+		case "c":
+			return
+		case "q":
+			env.stop = true
+			return
+		case "b":
+			err := d.breakCommand(args[1:])
+			if err != nil {
+				env.con.write(err.Error() + "\n")
+			}
+		case "h", "?":
+			env.con.write(debuggerHelp)
+		default:
+			env.con.write("Unknown command, h for help\n")
+		}
+	}
+}
+
+func (d *debugger) showRegisters() {
+	env := d.env
+	a, x, y, p := env.cpu.GetAXYP()
+	pc, sp := env.cpu.GetPCAndSP()
+
+	flags := ""
+	for i, name := range "NV-BDIZC" {
+		if p&(0x80>>i) != 0 {
+			flags += string(name)
+		} else {
+			flags += strings.ToLower(string(name))
+		}
+	}
+	env.con.write(fmt.Sprintf("PC=%04X A=%02X X=%02X Y=%02X SP=%02X P=%s ROM=%X\n",
+		pc, a, x, y, sp, flags, env.mem.activeRom))
+	d.showInstruction(pc)
+}
+
+// Disassemble an instruction, preceded by its symbol if it has one
+func (d *debugger) showInstruction(address uint16) uint16 {
+	env := d.env
+	if name, ok := env.symbols.name(address); ok {
+		env.con.write(name + ":\n")
+	}
+	text, length := env.disassemble(address, env.mem.Peek)
+	env.con.write(text + "\n")
+	return length
+}
+
+func (d *debugger) setRegister(name string, value string) {
+	env := d.env
+	v, ok := d.parseAddress(value)
+	if !ok {
+		env.con.write("Bad value\n")
+		return
+	}
+	a, x, y, p := env.cpu.GetAXYP()
+	switch strings.ToUpper(name) {
+	case "A":
+		a = uint8(v)
+	case "X":
+		x = uint8(v)
+	case "Y":
+		y = uint8(v)
+	case "P":
+		p = uint8(v)
+	case "PC":
+		env.cpu.SetPC(v)
+		return
+	case "SP":
+		err := env.setSP(uint8(v))
+		if err != nil {
+			env.con.write(err.Error() + "\n")
+		}
+		return
+	default:
+		env.con.write("Unknown register\n")
+		return
+	}
+	env.cpu.SetAXYP(a, x, y, p)
+}
+
+/*
+Parse an address with an optional sideways ROM bank, "8000" or "c:8000".
+Returns the peek and poke functions to access it.
+*/
+func (d *debugger) parseLocation(s string) (uint16, func(uint16) uint8, func(uint16, uint8), bool) {
+	mem := d.env.mem
+	bankText, addressText, hasBank := strings.Cut(s, ":")
+	if !hasBank {
+		address, ok := d.parseAddress(s)
+		return address, mem.Peek, mem.Poke, ok
+	}
+
+	address, ok := d.parseAddress(addressText)
+	bank, okBank := parseHex(bankText)
+	if !ok || !okBank || bank > 0xf {
+		return 0, nil, nil, false
+	}
+	peek, poke := mem.sidewaysAccess(uint8(bank))
+	return address, peek, poke, true
+}
+
+// Peek and poke on a sideways ROM bank, selected or not
+func (mem *acornMemory) sidewaysAccess(bank uint8) (func(uint16) uint8, func(uint16, uint8)) {
+	rom := mem.sideRom[bank&0xf]
+	peek := func(a uint16) uint8 {
+		if a >= romStartAddress && int(a-romStartAddress) < len(rom) {
+			return rom[a-romStartAddress]
+		}
+		return mem.Peek(a)
+	}
+	poke := func(a uint16, value uint8) {
+		if a >= romStartAddress && int(a-romStartAddress) < len(rom) {
+			rom[a-romStartAddress] = value
+			return
+		}
+		mem.Poke(a, value)
+	}
+	return peek, poke
+}
+
+func (d *debugger) dumpMemory(args []string) {
+	env := d.env
+	address := d.nextDump
+	peek := env.mem.Peek
+	count := uint16(0x80)
+	if len(args) > 0 {
+		var ok bool
+		address, peek, _, ok = d.parseLocation(args[0])
+		if !ok {
+			env.con.write("Bad address\n")
+			return
+		}
+	}
+	if len(args) > 1 {
+		n, ok := parseHex(args[1])
+		if !ok {
+			env.con.write("Bad count\n")
+			return
+		}
+		count = n
+	}
+
+	for i := uint16(0); i < count; i += 16 {
+		line := fmt.Sprintf("%04X ", address+i)
+		chars := ""
+		for j := uint16(0); j < 16 && i+j < count; j++ {
+			value := peek(address + i + j)
+			line += fmt.Sprintf(" %02X", value)
+			if value >= 0x20 && value < 0x7f {
+				chars += string(value)
+			} else {
+				chars += "."
+			}
+		}
+		env.con.write(fmt.Sprintf("%-54s %s\n", line, chars))
+	}
+	d.nextDump = address + count
+}
+
+func (d *debugger) editMemory(args []string) {
+	env := d.env
+	if len(args) < 2 {
+		env.con.write("Address and bytes needed\n")
+		return
+	}
+	address, _, poke, ok := d.parseLocation(args[0])
+	if !ok {
+		env.con.write("Bad address\n")
+		return
+	}
+	for i, text := range args[1:] {
+		value, ok := parseHex(text)
+		if !ok || value > 0xff {
+			env.con.write("Bad byte\n")
+			return
+		}
+		poke(address+uint16(i), uint8(value))
+	}
+}
+
+func (d *debugger) disassemble(args []string) {
+	env := d.env
+	address := d.nextDisasm
+	count := 16
+	if len(args) > 0 {
+		var ok bool
+		address, ok = d.parseAddress(args[0])
+		if !ok {
+			env.con.write("Bad address\n")
+			return
+		}
+	}
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			env.con.write("Bad count\n")
+			return
+		}
+		count = n
+	}
+
+	for i := 0; i < count; i++ {
+		address += d.showInstruction(address)
+	}
+	d.nextDisasm = address
+}
+
+/*
+Symbol or hex number. A symbol named as a hex number, as add or beef, is
+taken as the symbol, &add is the number.
+*/
+func (d *debugger) parseAddress(s string) (uint16, bool) {
+	symbols := d.env.symbols
+	if address, ok := symbols.lookupExact(s); ok {
+		return address, true
+	}
+	address, ok := parseHex(s)
+	if !ok {
+		address, ok = symbols.lookup(s)
+	}
+	return address, ok
+}
+
+// Hex number with an optional & or $ prefix
+func parseHex(s string) (uint16, bool) {
+	s = strings.TrimLeft(s, "&$")
+	value, err := strconv.ParseUint(s, 16, 16)
+	return uint16(value), err == nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDebuggerMonitor(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"?&900=&A9:?&901=&41:?&902=&60",
+		"*DEBUG",
+		"d 900 2",
+		"m 900 3",
+		"e 70 2A",
+		"g 902",
+		"CALL &900",
+		"r",
+		"s",
+		"c",
+		"PRINT ?&70",
+	})
+
+	if !strings.Contains(out, "0900  A9 41     LDA #&41\n0902  60        RTS\n") {
+		t.Log(out)
+		t.Error("Disassembly failed")
+	}
+	if !strings.Contains(out, "0900  A9 41 60") {
+		t.Log(out)
+		t.Error("Memory dump failed")
+	}
+	if !strings.Contains(out, "Reached\nPC=0902 A=41") {
+		t.Log(out)
+		t.Error("Run to address failed")
+	}
+	if !strings.Contains(out, "PRINT ?&70\n        42\n") {
+		t.Log(out)
+		t.Error("Memory edit failed")
+	}
+}
+
+func TestDebuggerSetSP(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"*DEBUG",
+		"r SP 80",
+		"r SP FD",
+		"c",
+	})
+
+	if !strings.Contains(out, "dbg> r SP 80\nPC=FB0D A=00 X=00 Y=07 SP=80 P=nv-bdizc") {
+		t.Log(out)
+		t.Error("Only the stack pointer should change")
+	}
+}
+
+func TestDebuggerOnBRK(t *testing.T) {
+	out := integrationTestBasicWithSetup([]string{
+		"?&900=0:CALL &900",
+		"c",
+		"c",
+	}, func(env *environment) {
+		env.debugger.onError = true
+	})
+
+	if !strings.Contains(out, "BRK\nPC=0900") {
+		t.Log(out)
+		t.Error("The monitor should be entered on BRK")
+	}
+}
+
+func TestDebuggerOnFatalError(t *testing.T) {
+	out := integrationTestBasicWithSetup([]string{
+		"CALL &FF00",
+		"q",
+	}, func(env *environment) {
+		env.debugger.onError = true
+	})
+
+	if !strings.Contains(out, "Extender vectors not implemented, ff00 was called\nPC=FF00") {
+		t.Log(out)
+		t.Error("The monitor should be entered instead of panicking")
+	}
+}
+
+func TestDebuggerInterrupt(t *testing.T) {
+	out := integrationTestBasicWithSetup([]string{
+		"c",
+	}, func(env *environment) {
+		env.debugger.interrupt()
+	})
+
+	if !strings.Contains(out, "Ctrl-\\\nPC=") {
+		t.Log(out)
+		t.Error("The monitor should be entered on Ctrl-\\")
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"?&900=&A9:?&901=&41:?&902=&85:?&903=&70:?&904=&60",
+		"*BREAK 902",
+		"*BREAK OSBYTE=81 TRACE",
+		"*BREAK w:70",
+		"CALL &900",
+		"c",
+		"c",
+		"*BREAK CLEAR",
+		"A=INKEY(0)",
+		"*BREAK",
+	})
+
+	if !strings.Contains(out, "Breakpoint 902\nPC=0902 A=41") {
+		t.Log(out)
+		t.Error("PC breakpoint failed")
+	}
+	if !strings.Contains(out, "Write &0070=&41 at PC=&0902\nPC=0904") {
+		t.Log(out)
+		t.Error("Watchpoint failed")
+	}
+	if strings.Contains(out, "Breakpoint OSBYTE=81") {
+		t.Log(out)
+		t.Error("Breakpoints should be removed")
+	}
+	if !strings.Contains(out, "No breakpoints") {
+		t.Log(out)
+		t.Error("*BREAK list failed")
+	}
+}
+
+func TestBreakpointMOSSkipped(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"?&900=&60",
+		"*BREAK OSWRCH",
+		"b clear",
+		"r PC 900",
+		"c",
+		"PRINT \"done\"",
+	})
+
+	// The prompt is not written
+	if !strings.Contains(out, "dbg> c\nPRINT \"done\"\ndone") {
+		t.Log(out)
+		t.Error("The MOS call should not be serviced after the PC changes on the monitor")
+	}
+}
+
+func TestBreakpointMOSQuit(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"*BREAK OSWRCH",
+		"q",
+	})
+
+	if !strings.HasSuffix(out, "dbg> q\n") {
+		t.Log(out)
+		t.Error("The MOS call should not be serviced after quitting on the monitor")
+	}
+}
+
+func TestTracepointMOS(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"*BREAK OSBYTE=81 TRACE",
+		"A=INKEY(0)",
+	})
+
+	if !strings.Contains(out, "Breakpoint OSBYTE=81\nPC=FB0C A=81") {
+		t.Log(out)
+		t.Error("MOS tracepoint failed")
+	}
+}
+
+func TestWatchpointNotOnFetch(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"?&900=&A9:?&901=&41:?&902=&60",
+		"*BREAK r:900-902",
+		"CALL &900",
+		"PRINT ?&901",
+		"c",
+	})
+
+	if strings.Contains(out, "at PC=&09") {
+		t.Log(out)
+		t.Error("The instruction fetches should not trigger the watchpoints")
+	}
+	if !strings.Contains(out, "PRINT ?&901\n\nRead &0901=&41") {
+		t.Log(out)
+		t.Error("The reads of the program should trigger the watchpoints")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+	6502 disassembler for the debugger. The table is the 65C02 one with the
+	Rockwell bit instructions. On the NMOS 6502 the undocumented opcodes
+	emulated on cpu.go are shown with their usual names and the 65C02
+	additions are shown as ???. The operands with a symbol, see symbols.go,
+	are shown with the name.
+
+	See:
+		http://www.6502.org/tutorials/65c02opcodes.html
+*/
+
+const (
+	disImp     = iota // Implied
+	disAcc            // Accumulator
+	disImm            // #&nn
+	disZp             // &nn
+	disZpX            // &nn,X
+	disZpY            // &nn,Y
+	disAbs            // &nnnn
+	disAbsX           // &nnnn,X
+	disAbsY           // &nnnn,Y
+	disInd            // (&nnnn)
+	disIndX           // (&nn,X)
+	disIndY           // (&nn),Y
+	disZpInd          // (&nn)
+	disAbsIndX        // (&nnnn,X)
+	disRel            // Branch
+	disZpRel          // &nn,branch
+)
+
+var disModeNames = map[string]int{
+	"imp": disImp, "acc": disAcc, "imm": disImm,
+	"zp": disZp, "zpx": disZpX, "zpy": disZpY,
+	"abs": disAbs, "abx": disAbsX, "aby": disAbsY,
+	"ind": disInd, "izx": disIndX, "izy": disIndY,
+	"izp": disZpInd, "iax": disAbsIndX,
+	"rel": disRel, "zpr": disZpRel,
+}
+
+var undocumentedModes = map[int]int{
+	modeImm: disImm, modeZp: disZp, modeZpX: disZpX, modeZpY: disZpY,
+	modeAbs: disAbs, modeAbsX: disAbsX, modeAbsY: disAbsY,
+	modeIndX: disIndX, modeIndY: disIndY,
+}
+
+const opcodeTable65C02 = `
+BRK:imp ORA:izx NOP:imm NOP:imp TSB:zp  ORA:zp  ASL:zp  RMB0:zp PHP:imp ORA:imm ASL:acc NOP:imp TSB:abs ORA:abs ASL:abs BBR0:zpr
+BPL:rel ORA:izy ORA:izp NOP:imp TRB:zp  ORA:zpx ASL:zpx RMB1:zp CLC:imp ORA:aby INC:acc NOP:imp TRB:abs ORA:abx ASL:abx BBR1:zpr
+JSR:abs AND:izx NOP:imm NOP:imp BIT:zp  AND:zp  ROL:zp  RMB2:zp PLP:imp AND:imm ROL:acc NOP:imp BIT:abs AND:abs ROL:abs BBR2:zpr
+BMI:rel AND:izy AND:izp NOP:imp BIT:zpx AND:zpx ROL:zpx RMB3:zp SEC:imp AND:aby DEC:acc NOP:imp BIT:abx AND:abx ROL:abx BBR3:zpr
+RTI:imp EOR:izx NOP:imm NOP:imp NOP:zp  EOR:zp  LSR:zp  RMB4:zp PHA:imp EOR:imm LSR:acc NOP:imp JMP:abs EOR:abs LSR:abs BBR4:zpr
+BVC:rel EOR:izy EOR:izp NOP:imp NOP:zpx EOR:zpx LSR:zpx RMB5:zp CLI:imp EOR:aby PHY:imp NOP:imp NOP:abs EOR:abx LSR:abx BBR5:zpr
+RTS:imp ADC:izx NOP:imm NOP:imp STZ:zp  ADC:zp  ROR:zp  RMB6:zp PLA:imp ADC:imm ROR:acc NOP:imp JMP:ind ADC:abs ROR:abs BBR6:zpr
+BVS:rel ADC:izy ADC:izp NOP:imp STZ:zpx ADC:zpx ROR:zpx RMB7:zp SEI:imp ADC:aby PLY:imp NOP:imp JMP:iax ADC:abx ROR:abx BBR7:zpr
+BRA:rel STA:izx NOP:imm NOP:imp STY:zp  STA:zp  STX:zp  SMB0:zp DEY:imp BIT:imm TXA:imp NOP:imp STY:abs STA:abs STX:abs BBS0:zpr
+BCC:rel STA:izy STA:izp NOP:imp STY:zpx STA:zpx STX:zpy SMB1:zp TYA:imp STA:aby TXS:imp NOP:imp STZ:abs STA:abx STZ:abx BBS1:zpr
+LDY:imm LDA:izx LDX:imm NOP:imp LDY:zp  LDA:zp  LDX:zp  SMB2:zp TAY:imp LDA:imm TAX:imp NOP:imp LDY:abs LDA:abs LDX:abs BBS2:zpr
+BCS:rel LDA:izy LDA:izp NOP:imp LDY:zpx LDA:zpx LDX:zpy SMB3:zp CLV:imp LDA:aby TSX:imp NOP:imp LDY:abx LDA:abx LDX:aby BBS3:zpr
+CPY:imm CMP:izx NOP:imm NOP:imp CPY:zp  CMP:zp  DEC:zp  SMB4:zp INY:imp CMP:imm DEX:imp NOP:imp CPY:abs CMP:abs DEC:abs BBS4:zpr
+BNE:rel CMP:izy CMP:izp NOP:imp NOP:zpx CMP:zpx DEC:zpx SMB5:zp CLD:imp CMP:aby PHX:imp NOP:imp NOP:abs CMP:abx DEC:abx BBS5:zpr
+CPX:imm SBC:izx NOP:imm NOP:imp CPX:zp  SBC:zp  INC:zp  SMB6:zp INX:imp SBC:imm NOP:imp NOP:imp CPX:abs SBC:abs INC:abs BBS6:zpr
+BEQ:rel SBC:izy SBC:izp NOP:imp NOP:zpx SBC:zpx INC:zpx SMB7:zp SED:imp SBC:aby PLX:imp NOP:imp NOP:abs SBC:abx INC:abx BBS7:zpr
+`
+
+// Opcodes added on the 65C02, not available on the NMOS 6502
+var cmosOnlyOpcodes = []uint8{
+	0x04, 0x0c, 0x12, 0x14, 0x1a, 0x1c, 0x32, 0x34, 0x3a, 0x3c, 0x52, 0x5a,
+	0x64, 0x72, 0x74, 0x7a, 0x7c, 0x80, 0x89, 0x92, 0x9c, 0x9e, 0xb2, 0xd2,
+	0xda, 0xf2, 0xfa,
+}
+
+type disOpcode struct {
+	name string
+	mode int
+}
+
+var opcodes65C02 [256]disOpcode
+
+func init() {
+	fields := strings.Fields(opcodeTable65C02)
+	for i, field := range fields {
+		name, mode, _ := strings.Cut(field, ":")
+		opcodes65C02[i] = disOpcode{name, disModeNames[mode]}
+	}
+}
+
+func (env *environment) opcodeInfo(opcode uint8) disOpcode {
+	switch env.cpuModel {
+	case cpuNMOS6502:
+		if op, ok := nmosUndocumented[opcode]; ok {
+			return disOpcode{op.name, undocumentedModes[op.mode]}
+		}
+		for _, cmos := range cmosOnlyOpcodes {
+			if opcode == cmos {
+				return disOpcode{"???", disImp}
+			}
+		}
+		if opcode&0x03 == 0x03 || opcode&0x0f == 0x02 && opcode != 0xa2 {
+			// Unstable undocumented opcodes and KIL
+			return disOpcode{"???", disImp}
+		}
+	case cpuCMOS65C12:
+		if opcode&0x07 == 0x07 {
+			return disOpcode{"NOP", disImp}
+		}
+	}
+	return opcodes65C02[opcode]
+}
+
+func disLength(mode int) uint16 {
+	switch mode {
+	case disImp, disAcc:
+		return 1
+	case disAbs, disAbsX, disAbsY, disInd, disAbsIndX, disZpRel:
+		return 3
+	default:
+		return 2
+	}
+}
+
+/*
+Disassemble the instruction at address with the peek function. Returns the
+text and the length of the instruction.
+*/
+func (env *environment) disassemble(address uint16, peek func(uint16) uint8) (string, uint16) {
+	op := env.opcodeInfo(peek(address))
+	length := disLength(op.mode)
+	b1 := peek(address + 1)
+	b2 := peek(address + 2)
+	word := uint16(b1) + uint16(b2)<<8
+
+	sym := env.symbols
+	var operand string
+	switch op.mode {
+	case disAcc:
+		operand = "A"
+	case disImm:
+		operand = fmt.Sprintf("#&%02X", b1)
+	case disZp:
+		operand = sym.operand(uint16(b1), "&%02X")
+	case disZpX:
+		operand = sym.operand(uint16(b1), "&%02X") + ",X"
+	case disZpY:
+		operand = sym.operand(uint16(b1), "&%02X") + ",Y"
+	case disAbs:
+		operand = sym.operand(word, "&%04X")
+	case disAbsX:
+		operand = sym.operand(word, "&%04X") + ",X"
+	case disAbsY:
+		operand = sym.operand(word, "&%04X") + ",Y"
+	case disInd:
+		operand = "(" + sym.operand(word, "&%04X") + ")"
+	case disIndX:
+		operand = "(" + sym.operand(uint16(b1), "&%02X") + ",X)"
+	case disIndY:
+		operand = "(" + sym.operand(uint16(b1), "&%02X") + "),Y"
+	case disZpInd:
+		operand = "(" + sym.operand(uint16(b1), "&%02X") + ")"
+	case disAbsIndX:
+		operand = "(" + sym.operand(word, "&%04X") + ",X)"
+	case disRel:
+		operand = sym.operand(address+2+uint16(int8(b1)), "&%04X")
+	case disZpRel:
+		operand = sym.operand(uint16(b1), "&%02X") + "," +
+			sym.operand(address+3+uint16(int8(b2)), "&%04X")
+	}
+
+	bytes := ""
+	for i := uint16(0); i < 3; i++ {
+		if i < length {
+			bytes += fmt.Sprintf("%02X ", peek(address+i))
+		} else {
+			bytes += "   "
+		}
+	}
+
+	text := fmt.Sprintf("%04X  %s %s %s", address, bytes, op.name, operand)
+	return strings.TrimRight(text, " "), length
+}
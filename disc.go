@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Disc images for OSWORD &7F, the commands of the 8271 floppy disc
+	controller. CP/M on the Z80 second processor reads and writes its discs
+	with them.
+
+	The images are given with -disc0 and -disc1, .ssd files with one side and
+	.dsd files with two sides interleaved by track, the second side is the
+	drive 2 or 3. The tracks have 10 sectors of 256 bytes, up to 80 tracks.
+	The writes go to the image file. If it can't be written the image is
+	write protected.
+
+	See:
+		https://beebwiki.mdfs.net/OSWORD_%267F
+		https://beebwiki.mdfs.net/Acorn_DFS_disc_format
+*/
+
+const (
+	discTracks          = 80
+	discSectorsPerTrack = 10
+	discSectorSize      = 256
+	discTrackSize       = discSectorsPerTrack * discSectorSize
+
+	// 8271 commands without the drive select bits
+	disc8271Write128          uint8 = 0x0a
+	disc8271Write             uint8 = 0x0b
+	disc8271WriteDeleted128   uint8 = 0x0e
+	disc8271WriteDeleted      uint8 = 0x0f
+	disc8271Read128           uint8 = 0x12
+	disc8271Read              uint8 = 0x13
+	disc8271ReadAndDeleted128 uint8 = 0x16
+	disc8271ReadAndDeleted    uint8 = 0x17
+	disc8271ReadID            uint8 = 0x1b
+	disc8271Verify128         uint8 = 0x1e
+	disc8271Verify            uint8 = 0x1f
+	disc8271Format            uint8 = 0x23
+	disc8271Seek              uint8 = 0x29
+	disc8271ReadStatus        uint8 = 0x2c
+	disc8271Specify           uint8 = 0x35
+	disc8271WriteRegister     uint8 = 0x3a
+	disc8271ReadRegister      uint8 = 0x3d
+
+	// 8271 results
+	disc8271Ok             uint8 = 0x00
+	disc8271NotReady       uint8 = 0x10
+	disc8271WriteProtected uint8 = 0x12
+	disc8271SectorNotFound uint8 = 0x18
+)
+
+type discImage struct {
+	file     *os.File
+	sides    int
+	readOnly bool
+}
+
+func (env *environment) attachDisc(drive int, filename string) error {
+	sides := 1
+	if strings.EqualFold(filepath.Ext(filename), ".dsd") {
+		sides = 2
+	}
+
+	readOnly := false
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrPermission) {
+		readOnly = true
+		file, err = os.Open(filename)
+	}
+	if err != nil {
+		return err
+	}
+
+	env.discs[drive] = &discImage{file, sides, readOnly}
+	return nil
+}
+
+func (env *environment) hasDiscs() bool {
+	return env.discs[0] != nil || env.discs[1] != nil
+}
+
+func (env *environment) closeDiscs() {
+	for i, disc := range env.discs {
+		if disc != nil {
+			disc.file.Close()
+			env.discs[i] = nil
+		}
+	}
+}
+
+// Image and side of a drive, the drives 2 and 3 are the second side of 0 and 1
+func (env *environment) discDrive(drive uint8) (*discImage, int) {
+	disc := env.discs[drive&1]
+	side := int(drive>>1) & 1
+	if disc == nil || side >= disc.sides {
+		return nil, 0
+	}
+	return disc, side
+}
+
+func (d *discImage) offset(side int, track uint8, sector uint8) int64 {
+	return int64((int(track)*d.sides+side)*discTrackSize + int(sector)*discSectorSize)
+}
+
+func (d *discImage) read(side int, track uint8, sector uint8, length int) ([]uint8, error) {
+	data := make([]uint8, length)
+	_, err := d.file.ReadAt(data, d.offset(side, track, sector))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	// The sectors after the end of the image read as zeros
+	return data, nil
+}
+
+func (d *discImage) write(side int, track uint8, sector uint8, data []uint8) error {
+	_, err := d.file.WriteAt(data, d.offset(side, track, sector))
+	return err
+}
+
+/*
+OSWORD &7F, on XY:
+
+	XY+0    drive
+	XY+1    address of the data, 4 bytes
+	XY+5    number of parameters
+	XY+6    command
+	XY+7    parameters
+	XY+7+n  result
+*/
+func execOSWORD7F(env *environment, xy uint16) {
+	drive := env.mem.Peek(xy)
+	if drive == 0xff {
+		drive = 0
+	}
+	address := env.mem.peekDoubleWord(xy + 1)
+	paramCount := env.mem.Peek(xy + 5)
+	command := env.mem.Peek(xy+6) & 0x3f
+	params := env.mem.peekSlice(xy+7, uint16(paramCount))
+	param := func(i int) uint8 {
+		if i < len(params) {
+			return params[i]
+		}
+		return 0
+	}
+
+	result := disc8271Ok
+	disc, side := env.discDrive(drive)
+	track := param(0)
+	sector := param(1)
+
+	switch command {
+	case disc8271Read128, disc8271Read, disc8271ReadAndDeleted128, disc8271ReadAndDeleted,
+		disc8271Verify128, disc8271Verify:
+		length, ok := discTransferLength(command, sector, param(2))
+		if disc == nil {
+			result = disc8271NotReady
+		} else if !ok || track >= discTracks {
+			result = disc8271SectorNotFound
+		} else if command != disc8271Verify128 && command != disc8271Verify {
+			data, err := disc.read(side, track, sector, length)
+			if err != nil {
+				env.raiseError(errorTodo, err.Error())
+				return
+			}
+			env.pokeTransfer(address, uint16(length), data)
+		}
+
+	case disc8271Write128, disc8271Write, disc8271WriteDeleted128, disc8271WriteDeleted:
+		length, ok := discTransferLength(command, sector, param(2))
+		if disc == nil {
+			result = disc8271NotReady
+		} else if disc.readOnly {
+			result = disc8271WriteProtected
+		} else if !ok || track >= discTracks {
+			result = disc8271SectorNotFound
+		} else {
+			err := disc.write(side, track, sector, env.peekTransfer(address, uint16(length)))
+			if err != nil {
+				env.raiseError(errorTodo, err.Error())
+				return
+			}
+		}
+
+	case disc8271ReadID:
+		// The IDs of the sectors on the track: track, head, sector and size
+		count := int(param(2) & 0x1f)
+		if disc == nil {
+			result = disc8271NotReady
+			break
+		}
+		ids := make([]uint8, 0, count*4)
+		for i := 0; i < count; i++ {
+			ids = append(ids, track, 0, uint8(i%discSectorsPerTrack), 1)
+		}
+		env.pokeTransfer(address, uint16(len(ids)), ids)
+
+	case disc8271Format:
+		if disc == nil {
+			result = disc8271NotReady
+		} else if disc.readOnly {
+			result = disc8271WriteProtected
+		} else if track >= discTracks {
+			result = disc8271SectorNotFound
+		} else {
+			blank := make([]uint8, discTrackSize)
+			for i := range blank {
+				blank[i] = 0xe5
+			}
+			err := disc.write(side, track, 0, blank)
+			if err != nil {
+				env.raiseError(errorTodo, err.Error())
+				return
+			}
+		}
+
+	case disc8271ReadStatus:
+		// Ready, and write protected if the image can't be written
+		status := uint8(0)
+		if d, _ := env.discDrive(drive); d != nil {
+			status |= 0x44
+			if d.readOnly {
+				status |= 0x08
+			}
+		}
+		result = status
+
+	case disc8271Seek, disc8271Specify, disc8271WriteRegister:
+		// Nothing to do, there are no heads to move
+
+	case disc8271ReadRegister:
+		result = 0
+
+	default:
+		env.notImplemented(fmt.Sprintf("OSWORD7F(CMD=0x%02x)", command))
+		return
+	}
+
+	env.mem.Poke(xy+7+uint16(paramCount), result)
+	env.log(fmt.Sprintf("OSWORD7f('Disc command',DRIVE=%v,CMD=0x%02x,TRACK=%v,SECTOR=%v,ADDRESS=0x%08x) => 0x%02x",
+		drive, command, track, sector, address, result))
+}
+
+/*
+Bytes transferred by the read, write and verify commands. The multiple sector
+commands have the number of sectors on the low 5 bits of the third parameter
+and the size on the high 3 bits as 128 shifted left. The sectors must be on
+the track.
+*/
+func discTransferLength(command uint8, sector uint8, sizeAndCount uint8) (int, bool) {
+	length := 128
+	if command&1 == 1 {
+		count := int(sizeAndCount & 0x1f)
+		length = count * (128 << (sizeAndCount >> 5))
+	}
+	end := int(sector)*discSectorSize + length
+	return length, sector < discSectorsPerTrack && end <= discTrackSize
+}
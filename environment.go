@@ -9,26 +9,58 @@ import (
 )
 
 type environment struct {
-	cpu *iz6502.State
-	mem *acornMemory
-	vdu *vdu
-	con console
+	cpu      *iz6502.State
+	cpuModel string
+	mem      *acornMemory
+	vdu      *vdu
+	con      console
+	sound    *soundSystem
+	adc      *adcSystem
+	cmos     *cmosRAM
+	debugger *debugger
+	symbols  *symbolTable
+	speed    *speedControl
+	mosTrace *mosTrace      // nil without -mos-trace
+	profiler *guestProfiler // nil without -guest-profile
+	coverage *coverage      // nil without -coverage
+	gdb      *gdbStub       // nil without -gdb
+	z80      *tubeZ80       // nil without -z80
+
+	// memory mapped devices
+	userVia *userVia
+
+	// cycles not counted by iz6502, see cpu.go
+	extraCycles uint64
+
+	// tube mode, the language location on the second processor
+	tubeLanguageStart uint16
+	tubeLanguageEnd   uint16
 
 	// clock, used by OSWORD01 and 02
 	referenceTime time.Time
+	virtualClock  *virtualClock // nil unless on deterministic mode, see clock.go
+	waited        time.Duration // Time advanced by the waits of INKEY
+
+	// real time clock, used by OSWORD0E and 0F
+	rtcOffset time.Duration
 
 	// timer, used by OSWORD03 and 04
 	timer           uint64 // Only 40 bits are used
 	lastTimerUpdate time.Time
 
+	// disc images for OSWORD &7F, see disc.go
+	discs [2]*discImage
+
 	// files
-	file [maxFiles]*os.File
+	file     [maxFiles]*os.File
+	fileMode [maxFiles]uint8 // OSFIND open mode, for the snapshots
 
 	// exec content
 	execContent []string
 
 	// behaviour
 	stop                bool
+	restored            bool // Resume from a snapshot instead of booting the language
 	lastEscapeTimestamp time.Time
 
 	// configuration
@@ -46,8 +78,19 @@ func newEnvironment(roms []*string, cpuLog bool, apiLog bool, apiLogIO bool, mem
 	env.mem = newAcornMemory(memLog)
 	//env.cpu = iz6502.NewNMOS6502(env.mem)
 	env.cpu = iz6502.NewCMOS65c02(env.mem)
+	env.cpuModel = cpuCMOS65C02
 	env.cpu.SetTrace(cpuLog)
 	env.vdu = newVdu(&env)
+	env.mem.screenChanged = env.vdu.screenChanged
+	env.userVia = newUserVia(env.cycles)
+	env.mem.registerIO(sheilaUserVia, sheilaUserVia+0x1f, env.userVia)
+	env.sound = newSoundSystem()
+	env.sound.clock = env.emulatedTime
+	env.adc = newAdcSystem()
+	env.cmos = newCmosRAM()
+	env.debugger = newDebugger(&env)
+	env.symbols = newSymbolTable()
+	env.speed = newSpeedControl(&env)
 	env.apiLog = apiLog
 	env.apiLogIO = apiLogIO
 	env.panicOnErr = panicOnErr
@@ -62,11 +105,37 @@ func newEnvironment(roms []*string, cpuLog bool, apiLog bool, apiLogIO bool, mem
 	env.mem.completeWithRam()
 
 	initOSVars(&env)
+	env.vdu.updateVariables()
 
 	return &env
 }
 
 func (env *environment) close() {
+	err := env.sound.close()
+	if err != nil {
+		fmt.Printf("Sound can't be written:\n    %s\n", err)
+	}
+	env.adc.close()
+	env.userVia.close()
+	env.closeDiscs()
+	if env.gdb != nil {
+		env.gdb.close()
+	}
+	if env.mosTrace != nil {
+		env.mosTrace.close()
+	}
+	if env.coverage != nil {
+		err = env.coverage.close()
+		if err != nil {
+			fmt.Printf("Coverage can't be written:\n    %s\n", err)
+		}
+	}
+	if env.profiler != nil {
+		err = env.profiler.close()
+		if err != nil {
+			fmt.Printf("Guest profile can't be written:\n    %s\n", err)
+		}
+	}
 	env.con.close()
 }
 
@@ -104,20 +173,31 @@ func (env *environment) initLanguage(slot uint8) {
 		Next, the MOS will set the error point at &FD/&FE to point at the version string (or copyright
 		message if no version string is present).
 	*/
-	copyrightAddress := 0x8000 + 1 + uint16(env.mem.Peek(romCopyrightOffsetPointer))
+	base := romStartAddress
+	if env.isTube() {
+		// The language is copied to the second processor
+		base = env.tubeLoadLanguage(slot)
+		env.tubeLanguageStart = base
+	}
+	offset := base - romStartAddress
+
+	copyrightAddress := base + 1 + uint16(env.mem.Peek(romCopyrightOffsetPointer+offset))
 	env.mem.pokeWord(zpErrorPointer, copyrightAddress)
 	/*
 		The MOS also automatically prints the ROM's title string (&8009) so that the user is acknowledged.
 	*/
-	language := env.mem.peekString(romTitleString, 0)
+	language := env.mem.peekString(romTitleString+offset, 0)
 	env.con.writef("%s\n\n", language)
 
 	_, x, y, p := env.cpu.GetAXYP()
 	env.cpu.SetAXYP(1, x, y, p)
-	env.cpu.SetPC(romStartAddress)
+	env.cpu.SetPC(base)
 }
 
 func (env *environment) readline() (string, bool) {
+	// Keyboard input resets the paged mode line counter
+	env.mem.Poke(mosPagedLineCount, 0)
+
 	if len(env.execContent) > 0 {
 		line := env.execContent[0]
 		env.execContent = env.execContent[1:]
@@ -130,7 +210,18 @@ func (env *environment) readline() (string, bool) {
 }
 
 func (env *environment) readChar() (uint8, bool) {
-	return env.con.readChar()
+	env.mem.Poke(mosPagedLineCount, 0)
+	ch, stop := env.con.readChar()
+	env.adc.keyPressed(ch)
+	return ch, stop
+}
+
+// Resolution of the ADC conversions as set with OSBYTE &BE
+func (env *environment) adcBits() uint8 {
+	if env.mem.Peek(mosAdcConversion) == 8 {
+		return 8
+	}
+	return 12
 }
 
 func (env *environment) raiseError(code uint8, msg string) {
@@ -147,6 +238,9 @@ func (env *environment) raiseError(code uint8, msg string) {
 	env.storeError(errorArea, code, msg, errorMessageMaxLength)
 	env.cpu.SetPC(errorArea)
 
+	if env.mosTrace != nil {
+		env.mosTrace.addError(code, msg)
+	}
 	env.log(fmt.Sprintf("RAISE(ERR=%02x, '%s')", code, msg))
 }
 
@@ -168,12 +262,18 @@ func (env *environment) storeError(address uint16, code uint8, msg string, maxMs
 }
 
 func (env *environment) log(msg string) {
+	if env.mosTrace != nil {
+		env.mosTrace.addLog(msg)
+	}
 	if env.apiLog {
 		fmt.Printf("[[[%s]]]\n", msg)
 	}
 }
 
 func (env *environment) logIO(msg string) {
+	if env.mosTrace != nil {
+		env.mosTrace.addLog(msg)
+	}
 	if env.apiLogIO {
 		fmt.Printf("[[[%s]]]\n", msg)
 	}
@@ -181,8 +281,19 @@ func (env *environment) logIO(msg string) {
 
 func (env *environment) notImplemented(feature string) {
 	msg := fmt.Sprintf("Not implemented: %s", feature)
-	if env.panicOnErr {
+	if env.debugger.onError {
+		env.debugger.request(msg)
+	} else if env.panicOnErr {
 		panic(msg)
 	}
 	env.log(msg)
 }
+
+// Errors that can't be recovered, with -debug the monitor is entered instead
+func (env *environment) fatalError(msg string) {
+	if env.debugger.onError {
+		env.debugger.request(msg)
+		return
+	}
+	panic(msg)
+}
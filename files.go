@@ -45,6 +45,9 @@ func (env *environment) openFile(filename string, mode uint8) uint8 {
 		//env.raiseError(errorTodo, err.Error())
 		i = -1
 	}
+	if i >= 0 {
+		env.fileMode[i] = mode
+	}
 
 	return uint8(i + 1)
 }
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+	GDB remote serial protocol stub, enabled with -gdb. bbz waits stopped
+	on the first instruction until a debugger attaches. The program keeps
+	running after a detach, and stops again when a debugger connects.
+
+	The registers are A, X, Y, P, SP and PC, the PC with 16 bits, as
+	described on the target.xml served with qXfer. The addresses from
+	&100000 access the sideways banks: &1S8000 is &8000 on the ROM on slot
+	S. Software breakpoints are kept on the stub, the memory is not changed.
+
+	See:
+		https://sourceware.org/gdb/current/onlinedocs/gdb.html/Remote-Protocol.html
+*/
+
+const gdbTargetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <architecture>6502</architecture>
+  <feature name="org.gnu.gdb.6502.core">
+    <reg name="a" bitsize="8" type="uint8"/>
+    <reg name="x" bitsize="8" type="uint8"/>
+    <reg name="y" bitsize="8" type="uint8"/>
+    <reg name="p" bitsize="8" type="uint8"/>
+    <reg name="sp" bitsize="8" type="uint8"/>
+    <reg name="pc" bitsize="16" type="code_ptr"/>
+  </feature>
+</target>
+`
+
+const (
+	gdbSignalInt  = 2
+	gdbSignalTrap = 5
+
+	gdbBankedMemory = 0x100000
+)
+
+type gdbStub struct {
+	env      *environment
+	listener net.Listener
+
+	conn      net.Conn
+	connected chan net.Conn
+	in        chan byte
+	out       *bufio.Writer
+
+	halt         atomic.Bool // Ctrl-C from the debugger
+	stepping     bool
+	resumed      bool
+	replyPending bool // A stop reply is due after c or s
+	breakpoints  map[uint16]bool
+}
+
+func newGdbStub(env *environment, address string) (*gdbStub, error) {
+	if strings.HasPrefix(address, ":") {
+		// Only on localhost
+		address = "127.0.0.1" + address
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	var g gdbStub
+	g.env = env
+	g.listener = listener
+	g.connected = make(chan net.Conn, 1)
+	g.breakpoints = make(map[uint16]bool)
+	g.halt.Store(true) // Wait for the debugger before running
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// Stop to serve the new debugger
+			g.halt.Store(true)
+			g.connected <- conn
+		}
+	}()
+	return &g, nil
+}
+
+func (g *gdbStub) close() {
+	g.listener.Close()
+	if g.conn != nil {
+		if g.replyPending {
+			// The program ended while the debugger waits on c or s
+			g.replyPending = false
+			g.send("W00")
+		}
+		g.conn.Close()
+	}
+}
+
+// Called before each instruction, true if the CPU has to stop
+func (g *gdbStub) mustStop(pc uint16) bool {
+	resumed := g.resumed
+	g.resumed = false
+	if g.halt.Load() || g.stepping {
+		return true
+	}
+	return !resumed && len(g.breakpoints) > 0 && g.breakpoints[pc]
+}
+
+// Serve the debugger while the CPU is stopped
+func (g *gdbStub) stopped() {
+	signal := gdbSignalTrap
+	if g.halt.Load() && !g.stepping {
+		signal = gdbSignalInt
+	}
+	g.stepping = false
+	defer func() { g.resumed = true }()
+
+	if g.conn == nil {
+		g.attach(<-g.connected)
+	}
+	g.halt.Store(false)
+	if g.replyPending {
+		g.replyPending = false
+		g.send(fmt.Sprintf("S%02x", signal))
+	}
+
+	for {
+		packet, ok := g.readPacket()
+		if !ok {
+			// Connection closed, serve a debugger connecting after an
+			// unclean disconnect or keep running
+			g.detach()
+			select {
+			case conn := <-g.connected:
+				g.attach(conn)
+				g.halt.Store(false)
+				continue
+			default:
+				return
+			}
+		}
+		reply, resume := g.process(packet)
+		if resume {
+			return
+		}
+		g.send(reply)
+	}
+}
+
+func (g *gdbStub) attach(conn net.Conn) {
+	g.conn = conn
+	g.out = bufio.NewWriter(conn)
+	in := make(chan byte, 4096)
+	g.in = in
+	go func() {
+		reader := bufio.NewReader(conn)
+		for {
+			b, err := reader.ReadByte()
+			if err != nil {
+				close(in)
+				return
+			}
+			if b == 0x03 {
+				// Ctrl-C, interrupt the execution
+				g.halt.Store(true)
+				continue
+			}
+			in <- b
+		}
+	}()
+}
+
+func (g *gdbStub) detach() {
+	if g.conn != nil {
+		g.conn.Close()
+	}
+	g.conn = nil
+	g.replyPending = false
+	g.breakpoints = make(map[uint16]bool)
+}
+
+func (g *gdbStub) readPacket() (string, bool) {
+	for {
+		// Skip until the start of a packet, acks included
+		b, ok := <-g.in
+		if !ok {
+			return "", false
+		}
+		if b != '$' {
+			continue
+		}
+
+		var data []byte
+		for {
+			b, ok = <-g.in
+			if !ok {
+				return "", false
+			}
+			if b == '#' {
+				break
+			}
+			data = append(data, b)
+		}
+		checksum := make([]byte, 2)
+		for i := range checksum {
+			checksum[i], ok = <-g.in
+			if !ok {
+				return "", false
+			}
+		}
+
+		expected, err := strconv.ParseUint(string(checksum), 16, 8)
+		if err != nil || uint8(expected) != gdbChecksum(data) {
+			g.conn.Write([]byte("-"))
+			continue
+		}
+		g.conn.Write([]byte("+"))
+		return string(data), true
+	}
+}
+
+func (g *gdbStub) send(reply string) {
+	fmt.Fprintf(g.out, "$%s#%02x", reply, gdbChecksum([]byte(reply)))
+	g.out.Flush()
+}
+
+func gdbChecksum(data []byte) uint8 {
+	sum := uint8(0)
+	for _, b := range data {
+		sum += b
+	}
+	return sum
+}
+
+// Process a packet, returns the reply and true if the execution resumes
+func (g *gdbStub) process(packet string) (string, bool) {
+	env := g.env
+	if packet == "" {
+		return "", false
+	}
+	args := packet[1:]
+
+	switch packet[0] {
+	case '?':
+		return fmt.Sprintf("S%02x", gdbSignalTrap), false
+
+	case 'g':
+		return hex.EncodeToString(g.registers()), false
+
+	case 'G':
+		data, err := hex.DecodeString(args)
+		if err != nil || len(data) != 7 {
+			return "E01", false
+		}
+		if g.setRegisters(data) != nil {
+			return "E02", false
+		}
+		return "OK", false
+
+	case 'p':
+		n, err := strconv.ParseUint(args, 16, 8)
+		regs := g.registers()
+		switch {
+		case err != nil || n > 5:
+			return "E01", false
+		case n == 5:
+			return hex.EncodeToString(regs[5:7]), false
+		default:
+			return hex.EncodeToString(regs[n : n+1]), false
+		}
+
+	case 'P':
+		nText, valueText, _ := strings.Cut(args, "=")
+		n, err := strconv.ParseUint(nText, 16, 8)
+		value, errValue := hex.DecodeString(valueText)
+		if err != nil || errValue != nil || n > 5 || len(value) == 0 {
+			return "E01", false
+		}
+		regs := g.registers()
+		if n == 5 && len(value) == 2 {
+			copy(regs[5:7], value)
+		} else {
+			regs[n] = value[0]
+		}
+		if g.setRegisters(regs) != nil {
+			return "E02", false
+		}
+		return "OK", false
+
+	case 'm':
+		addressText, lengthText, _ := strings.Cut(args, ",")
+		address, err := strconv.ParseUint(addressText, 16, 32)
+		length, errLength := strconv.ParseUint(lengthText, 16, 16)
+		if err != nil || errLength != nil {
+			return "E01", false
+		}
+		data := make([]uint8, length)
+		for i := range data {
+			data[i] = g.peek(uint32(address) + uint32(i))
+		}
+		return hex.EncodeToString(data), false
+
+	case 'M':
+		header, dataText, _ := strings.Cut(args, ":")
+		addressText, _, _ := strings.Cut(header, ",")
+		address, err := strconv.ParseUint(addressText, 16, 32)
+		data, errData := hex.DecodeString(dataText)
+		if err != nil || errData != nil {
+			return "E01", false
+		}
+		for i, value := range data {
+			g.poke(uint32(address)+uint32(i), value)
+		}
+		return "OK", false
+
+	case 'Z', 'z':
+		// Z0 software and Z1 hardware breakpoints, the same here
+		fields := strings.Split(args, ",")
+		if len(fields) < 2 || (fields[0] != "0" && fields[0] != "1") {
+			return "", false
+		}
+		address, err := strconv.ParseUint(fields[1], 16, 16)
+		if err != nil {
+			return "E01", false
+		}
+		if packet[0] == 'Z' {
+			g.breakpoints[uint16(address)] = true
+		} else {
+			delete(g.breakpoints, uint16(address))
+		}
+		return "OK", false
+
+	case 'c', 's':
+		if args != "" {
+			address, err := strconv.ParseUint(args, 16, 16)
+			if err != nil {
+				return "E01", false
+			}
+			env.cpu.SetPC(uint16(address))
+		}
+		g.stepping = packet[0] == 's'
+		g.replyPending = true
+		return "", true
+
+	case 'D':
+		g.send("OK")
+		g.detach()
+		return "", true
+
+	case 'k':
+		g.detach()
+		env.stop = true
+		return "", true
+
+	case 'H':
+		return "OK", false
+
+	case 'q':
+		return g.query(packet), false
+	}
+
+	return "", false
+}
+
+func (g *gdbStub) query(packet string) string {
+	switch {
+	case strings.HasPrefix(packet, "qSupported"):
+		return "PacketSize=1000;qXfer:features:read+"
+	case strings.HasPrefix(packet, "qXfer:features:read:target.xml:"):
+		offsetText, lengthText, _ := strings.Cut(strings.TrimPrefix(packet, "qXfer:features:read:target.xml:"), ",")
+		offset, err := strconv.ParseUint(offsetText, 16, 32)
+		length, errLength := strconv.ParseUint(lengthText, 16, 32)
+		if err != nil || errLength != nil {
+			return "E01"
+		}
+		if offset >= uint64(len(gdbTargetXML)) {
+			return "l"
+		}
+		end := offset + length
+		if end >= uint64(len(gdbTargetXML)) {
+			return "l" + gdbTargetXML[offset:]
+		}
+		return "m" + gdbTargetXML[offset:end]
+	case packet == "qAttached":
+		return "1"
+	case packet == "qC":
+		return "QC1"
+	case packet == "qfThreadInfo":
+		return "m1"
+	case packet == "qsThreadInfo":
+		return "l"
+	}
+	return ""
+}
+
+// A, X, Y, P, SP and PC little endian
+func (g *gdbStub) registers() []uint8 {
+	a, x, y, p := g.env.cpu.GetAXYP()
+	pc, sp := g.env.cpu.GetPCAndSP()
+	return []uint8{a, x, y, p, sp, uint8(pc), uint8(pc >> 8)}
+}
+
+func (g *gdbStub) setRegisters(regs []uint8) error {
+	g.env.cpu.SetAXYP(regs[0], regs[1], regs[2], regs[3])
+	g.env.cpu.SetPC(uint16(regs[5]) + uint16(regs[6])<<8)
+	return g.env.setSP(regs[4])
+}
+
+// Addresses from &100000 select a sideways bank
+func (g *gdbStub) access(address uint32) (func(uint16) uint8, func(uint16, uint8)) {
+	mem := g.env.mem
+	if address < gdbBankedMemory {
+		return mem.Peek, mem.Poke
+	}
+	return mem.sidewaysAccess(uint8(address >> 16))
+}
+
+// The accesses of the client are not accesses of the program, don't trigger
+// the watchpoints of the monitor
+func (g *gdbStub) peek(address uint32) uint8 {
+	mem := g.env.mem
+	watch := mem.watch
+	mem.watch = nil
+	defer func() { mem.watch = watch }()
+
+	peek, _ := g.access(address)
+	return peek(uint16(address))
+}
+
+func (g *gdbStub) poke(address uint32, value uint8) {
+	mem := g.env.mem
+	watch := mem.watch
+	mem.watch = nil
+	defer func() { mem.watch = watch }()
+
+	_, poke := g.access(address)
+	poke(uint16(address), value)
+}
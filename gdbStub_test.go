@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type gdbTestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (c *gdbTestClient) command(packet string) string {
+	fmt.Fprintf(c.conn, "$%s#%02x", packet, gdbChecksum([]byte(packet)))
+	ack, err := c.reader.ReadByte()
+	if err != nil || ack != '+' {
+		c.t.Fatalf("No ack for %s", packet)
+	}
+	start, err := c.reader.ReadString('$')
+	if err != nil {
+		c.t.Fatalf("No reply for %s: %v %q", packet, err, start)
+	}
+	reply, err := c.reader.ReadString('#')
+	if err != nil {
+		c.t.Fatalf("Bad reply for %s: %v", packet, err)
+	}
+	c.reader.Discard(2)
+	c.conn.Write([]byte("+"))
+	return strings.TrimSuffix(reply, "#")
+}
+
+func newGdbTestClient(t *testing.T, stub *gdbStub) *gdbTestClient {
+	conn, err := net.Dial("tcp", stub.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &gdbTestClient{t, conn, bufio.NewReader(conn)}
+}
+
+// Run BASIC with a gdb stub, the output is sent on done when it ends
+func integrationTestGdb(t *testing.T, lines []string) (*gdbStub, chan string) {
+	stubs := make(chan *gdbStub)
+	done := make(chan string, 1)
+	go func() {
+		done <- integrationTestBasicWithSetup(lines, func(env *environment) {
+			stub, err := newGdbStub(env, "127.0.0.1:0")
+			if err != nil {
+				t.Error(err)
+				stub = nil
+			}
+			env.gdb = stub
+			stubs <- stub
+		})
+	}()
+	stub := <-stubs
+	if stub == nil {
+		t.FailNow()
+	}
+	return stub, done
+}
+
+func TestGdbStub(t *testing.T) {
+	stub, done := integrationTestGdb(t, []string{
+		"?&900=&A9:?&901=&41:?&902=&60",
+		"CALL &900",
+		"PRINT ?&70",
+	})
+	defer stub.close()
+	c := newGdbTestClient(t, stub)
+	defer c.conn.Close()
+
+	expect := func(packet string, expected string) {
+		reply := c.command(packet)
+		if reply != expected {
+			t.Errorf("%s: expected %q, got %q", packet, expected, reply)
+		}
+	}
+
+	expect("?", "S05")
+	expect("M70,1:2a", "OK")
+	expect("m70,1", "2a")
+	expect("m1f8009,5", "4241534943") // "BASIC" on the ROM of slot F
+	expect("Z0,902,1", "OK")
+	expect("c", "S05")
+
+	regs := c.command("g")
+	if !strings.HasPrefix(regs, "41") || !strings.HasSuffix(regs, "0209") {
+		t.Errorf("Expected A=&41 and PC=&0902, got %s", regs)
+	}
+	expect("P0=42", "OK")
+	expect("p0", "42")
+
+	expect("z0,902,1", "OK")
+	expect("s", "S05")
+	expect("D", "OK")
+
+	var out string
+	select {
+	case out = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The program didn't end after the detach")
+	}
+
+	if !strings.Contains(out, "PRINT ?&70\n        42\n") {
+		t.Log(out)
+		t.Error("Memory write failed")
+	}
+}
+
+func TestGdbReconnect(t *testing.T) {
+	stub, done := integrationTestGdb(t, []string{
+		"REPEAT UNTIL ?&70=42",
+		"PRINT \"DONE\"",
+	})
+	defer stub.close()
+
+	// The first debugger resumes and disconnects without detaching
+	c := newGdbTestClient(t, stub)
+	if reply := c.command("?"); reply != "S05" {
+		t.Errorf("?: expected \"S05\", got %q", reply)
+	}
+	fmt.Fprintf(c.conn, "$c#%02x", gdbChecksum([]byte("c")))
+	c.reader.ReadByte()
+	c.conn.Close()
+
+	c = newGdbTestClient(t, stub)
+	defer c.conn.Close()
+	if reply := c.command("M70,1:2a"); reply != "OK" {
+		t.Errorf("The new debugger should be served, got %q", reply)
+	}
+	c.command("D")
+
+	var out string
+	select {
+	case out = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The program didn't end after the detach")
+	}
+	if !strings.Contains(out, "DONE") {
+		t.Log(out)
+		t.Error("The program should end after the memory write")
+	}
+}
+
+func TestGdbProgramEnd(t *testing.T) {
+	stub, done := integrationTestGdb(t, []string{
+		"PRINT \"DONE\"",
+	})
+	c := newGdbTestClient(t, stub)
+	defer c.conn.Close()
+	if reply := c.command("?"); reply != "S05" {
+		t.Errorf("?: expected \"S05\", got %q", reply)
+	}
+	fmt.Fprintf(c.conn, "$c#%02x", gdbChecksum([]byte("c")))
+	c.reader.ReadByte()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The program didn't end")
+	}
+	stub.close()
+
+	reply, err := c.reader.ReadString('#')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "$W00#" {
+		t.Errorf("The debugger should be told that the program exited, got %q", reply)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+/*
+	Profiler of the 6502 program, enabled with -guest-profile. It counts the
+	instructions and cycles executed on each address, with the sideways ROM
+	bank for the addresses from &8000 to &BFFF, and the MOS calls serviced by
+	bbz with the host time spent on them. The -profile option profiles bbz
+	itself.
+
+	At exit two reports are written:
+		<name>.txt        hot addresses, ROM banks, routines and MOS calls
+		<name>.callgrind  for KCachegrind or callgrind_annotate
+
+	The routines are the symbols loaded with -symbols, each address is
+	counted on the symbol at or before it on the same region: RAM, sideways
+	ROM or MOS. The addresses without symbol are counted on the region or
+	the ROM bank. On the callgrind file the addresses on a sideways bank
+	are &1S8000 to &1SBFFF for the slot S, as on the GDB stub.
+
+	See:
+		https://valgrind.org/docs/manual/cl-format.html
+*/
+
+const profilerHotAddresses = 25
+
+type profilerCounts struct {
+	instructions uint64
+	cycles       uint64
+}
+
+type mosCallStats struct {
+	count    uint64
+	hostTime time.Duration
+}
+
+type guestProfiler struct {
+	env  *environment
+	name string
+
+	counts     [0x10000]profilerCounts
+	bankCounts [16][]profilerCounts // &8000 to &BFFF, allocated on use
+
+	// Instruction being executed
+	pc         uint16
+	bank       int // -1 if not on a sideways bank
+	cyclesFrom uint64
+
+	mosCalls map[string]*mosCallStats
+	mosCall  string
+	mosStart time.Time
+}
+
+func newGuestProfiler(env *environment, name string) *guestProfiler {
+	var p guestProfiler
+	p.env = env
+	p.name = name
+	p.mosCalls = make(map[string]*mosCallStats)
+	return &p
+}
+
+// Called before each instruction
+func (p *guestProfiler) before() {
+	env := p.env
+	p.pc, _ = env.cpu.GetPCAndSP()
+	p.bank = env.codeBank(p.pc)
+	p.cyclesFrom = env.cycles()
+}
+
+// Sideways ROM bank of the code on the address, -1 if not on a bank
+func (env *environment) codeBank(address uint16) int {
+	if address >= romStartAddress && address <= romEndAddress && !env.isTube() {
+		return int(env.mem.activeRom)
+	}
+	return -1
+}
+
+// Called after each instruction
+func (p *guestProfiler) after() {
+	counts := &p.counts[p.pc]
+	if p.bank >= 0 {
+		if p.bankCounts[p.bank] == nil {
+			p.bankCounts[p.bank] = make([]profilerCounts, romEndAddress-romStartAddress+1)
+		}
+		counts = &p.bankCounts[p.bank][p.pc-romStartAddress]
+	}
+	counts.instructions++
+	counts.cycles += p.env.cycles() - p.cyclesFrom
+}
+
+// Called before the MOS call on the entry point is serviced
+func (p *guestProfiler) mosBegin(ep uint16) {
+	p.mosCall = mosCallName(ep)
+	p.mosStart = time.Now()
+}
+
+// Called after the MOS call is serviced
+func (p *guestProfiler) mosEnd() {
+	stats, ok := p.mosCalls[p.mosCall]
+	if !ok {
+		stats = &mosCallStats{}
+		p.mosCalls[p.mosCall] = stats
+	}
+	stats.count++
+	stats.hostTime += time.Since(p.mosStart)
+}
+
+type profilerEntry struct {
+	bank    int
+	address uint16
+	profilerCounts
+}
+
+// Addresses executed, sorted by bank and address
+func (p *guestProfiler) entries() []profilerEntry {
+	var entries []profilerEntry
+	for address, counts := range p.counts {
+		if counts.instructions > 0 {
+			entries = append(entries, profilerEntry{-1, uint16(address), counts})
+		}
+	}
+	for bank, bankCounts := range p.bankCounts {
+		for offset, counts := range bankCounts {
+			if counts.instructions > 0 {
+				entries = append(entries, profilerEntry{bank, romStartAddress + uint16(offset), counts})
+			}
+		}
+	}
+	return entries
+}
+
+func (p *guestProfiler) location(e profilerEntry) string {
+	text := fmt.Sprintf("&%04X", e.address)
+	if e.bank >= 0 {
+		text = fmt.Sprintf("%X:%04X", e.bank, e.address)
+	}
+	if description := p.env.symbols.describe(e.address); description != "" {
+		text += " " + description
+	}
+	return text
+}
+
+// Routine of an address, the symbol on the same memory region or the region
+func (p *guestProfiler) routine(e profilerEntry) string {
+	region := profilerRegion(e.address)
+	if name, ok := p.env.symbols.containing(e.address); ok {
+		address, _ := p.env.symbols.lookup(name)
+		if profilerRegion(address) == region {
+			return name
+		}
+	}
+	if e.bank >= 0 {
+		return fmt.Sprintf("ROM %X", e.bank)
+	}
+	return region
+}
+
+func profilerRegion(address uint16) string {
+	switch {
+	case address < romStartAddress:
+		return "RAM"
+	case address <= romEndAddress:
+		return "ROM"
+	default:
+		return "MOS"
+	}
+}
+
+func (p *guestProfiler) close() error {
+	errText := p.writeFile(p.name+".txt", p.writeReport)
+	errCallgrind := p.writeFile(p.name+".callgrind", p.writeCallgrind)
+	return errors.Join(errText, errCallgrind)
+}
+
+func (p *guestProfiler) writeFile(filename string, write func(io.Writer)) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(file)
+	write(out)
+	return errors.Join(out.Flush(), file.Close())
+}
+
+func percentage(value uint64, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(value) * 100 / float64(total)
+}
+
+func (p *guestProfiler) writeReport(out io.Writer) {
+	entries := p.entries()
+	var total profilerCounts
+	for _, e := range entries {
+		total.instructions += e.instructions
+		total.cycles += e.cycles
+	}
+	fmt.Fprintf(out, "Guest profile: %v instructions, %v cycles\n", total.instructions, total.cycles)
+
+	section := func(title string, column string, rows []profilerEntry, labels []string) {
+		fmt.Fprintf(out, "\n%s:\n", title)
+		fmt.Fprintf(out, "%12s %7s %12s  %s\n", "Cycles", "%", "Instructions", column)
+		for i, e := range rows {
+			fmt.Fprintf(out, "%12v %6.2f%% %12v  %s\n",
+				e.cycles, percentage(e.cycles, total.cycles), e.instructions, labels[i])
+		}
+	}
+
+	hot := append([]profilerEntry(nil), entries...)
+	sort.SliceStable(hot, func(i, j int) bool { return hot[i].cycles > hot[j].cycles })
+	if len(hot) > profilerHotAddresses {
+		hot = hot[:profilerHotAddresses]
+	}
+	var labels []string
+	for _, e := range hot {
+		labels = append(labels, p.location(e))
+	}
+	section("Hot addresses", "Address", hot, labels)
+
+	var banks []profilerEntry
+	labels = nil
+	for bank := range p.bankCounts {
+		e := profilerEntry{bank: bank}
+		for _, counts := range p.bankCounts[bank] {
+			e.instructions += counts.instructions
+			e.cycles += counts.cycles
+		}
+		if e.instructions > 0 {
+			banks = append(banks, e)
+			labels = append(labels, fmt.Sprintf("%X %s", bank, romTitle(p.env.mem.sideRom[bank])))
+		}
+	}
+	section("ROM banks", "Bank", banks, labels)
+
+	if p.env.symbols.hasLoaded() {
+		routines := make(map[string]*profilerEntry)
+		var names []string
+		for _, e := range entries {
+			name := p.routine(e)
+			r, ok := routines[name]
+			if !ok {
+				r = &profilerEntry{}
+				routines[name] = r
+				names = append(names, name)
+			}
+			r.instructions += e.instructions
+			r.cycles += e.cycles
+		}
+		sort.SliceStable(names, func(i, j int) bool {
+			return routines[names[i]].cycles > routines[names[j]].cycles
+		})
+		var rows []profilerEntry
+		for _, name := range names {
+			rows = append(rows, *routines[name])
+		}
+		section("Routines", "Routine", rows, names)
+	}
+
+	var calls []string
+	for name := range p.mosCalls {
+		calls = append(calls, name)
+	}
+	sort.Strings(calls)
+	sort.SliceStable(calls, func(i, j int) bool {
+		return p.mosCalls[calls[i]].count > p.mosCalls[calls[j]].count
+	})
+	fmt.Fprintf(out, "\nMOS calls:\n")
+	fmt.Fprintf(out, "%12s %12s  %s\n", "Count", "Host time", "Call")
+	for _, name := range calls {
+		stats := p.mosCalls[name]
+		fmt.Fprintf(out, "%12v %12v  %s\n", stats.count, stats.hostTime.Round(time.Microsecond), name)
+	}
+}
+
+func (p *guestProfiler) writeCallgrind(out io.Writer) {
+	fmt.Fprintf(out, "# callgrind format\n")
+	fmt.Fprintf(out, "version: 1\n")
+	fmt.Fprintf(out, "creator: bbz\n")
+	fmt.Fprintf(out, "positions: instr\n")
+	fmt.Fprintf(out, "events: Cycles Instructions Calls HostNs\n\n")
+
+	file := ""
+	function := ""
+	for _, e := range p.entries() {
+		region := profilerRegion(e.address)
+		position := uint32(e.address)
+		if e.bank >= 0 {
+			region = fmt.Sprintf("ROM %X", e.bank)
+			position += gdbBankedMemory + uint32(e.bank)<<16
+		}
+		if region != file {
+			file = region
+			function = ""
+			fmt.Fprintf(out, "fl=%s\n", file)
+		}
+		if name := p.routine(e); name != function {
+			function = name
+			fmt.Fprintf(out, "fn=%s\n", function)
+		}
+		fmt.Fprintf(out, "0x%x %v %v\n", position, e.cycles, e.instructions)
+	}
+
+	fmt.Fprintf(out, "fl=MOS calls\n")
+	for ep := entryPoints; ep <= epEntryPointsLast; ep++ {
+		name := mosCallName(ep)
+		if stats, ok := p.mosCalls[name]; ok {
+			fmt.Fprintf(out, "fn=%s\n0x%x 0 0 %v %v\n", name, ep, stats.count, stats.hostTime.Nanoseconds())
+		}
+	}
+}
+
+// Title on the header of a sideways ROM image
+func romTitle(rom []uint8) string {
+	title := ""
+	for i := int(romTitleString - romStartAddress); i < len(rom) && rom[i] != 0; i++ {
+		title += string(rom[i])
+	}
+	return title
+}
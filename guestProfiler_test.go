@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGuestProfiler(t *testing.T) {
+	dir := t.TempDir()
+	symbols := filepath.Join(dir, "loop.lbl")
+	err := os.WriteFile(symbols, []byte("al C:0900 .main\nal C:0902 .loop\nal C:0905 .done\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "profile")
+
+	var env *environment
+	integrationTestBasicWithSetup([]string{
+		"?&900=&A2:?&901=0:?&902=&CA:?&903=&D0:?&904=&FD:?&905=&60",
+		"CALL &900",
+	}, func(e *environment) {
+		env = e
+		err := env.symbols.loadFiles(symbols)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.profiler = newGuestProfiler(env, name)
+	})
+	err = env.profiler.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := os.ReadFile(name + ".txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(report)
+	if !strings.Contains(out, "          256") || !strings.Contains(out, "&0902 loop\n") {
+		t.Log(out)
+		t.Error("The loop should be on the hot addresses, 256 times")
+	}
+	if !strings.Contains(out, "Routines:") || !strings.Contains(out, "  loop\n") ||
+		!strings.Contains(out, "  ROM F\n") {
+		t.Log(out)
+		t.Error("The routines should be aggregated by symbol")
+	}
+	if !strings.Contains(out, "F BASIC\n") {
+		t.Log(out)
+		t.Error("The BASIC ROM bank should be on the report")
+	}
+	if !strings.Contains(out, "  OSWRCH\n") {
+		t.Log(out)
+		t.Error("The MOS calls should be counted")
+	}
+
+	callgrind, err := os.ReadFile(name + ".callgrind")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(callgrind), "fn=loop\n0x902 ") {
+		t.Log(string(callgrind))
+		t.Error("The callgrind file should have the loop")
+	}
+	if !strings.Contains(string(callgrind), "fl=MOS\nfn=MOS\n0xfb0a ") {
+		t.Log(string(callgrind))
+		t.Error("The MOS code should be on its own region")
+	}
+}
@@ -6,6 +6,14 @@ import (
 )
 
 func integrationTestBasic(lines []string) string {
+	return integrationTestBasicWithSetup(lines, nil)
+}
+
+/*
+Run BASIC after a setup of the environment, as main does with the command
+line options. The setup can keep the environment to check it after the run.
+*/
+func integrationTestBasicWithSetup(lines []string, setup func(env *environment)) string {
 
 	def := "BASIC.ROM"
 	roms := []*string{&def}
@@ -13,6 +21,9 @@ func integrationTestBasic(lines []string) string {
 	env := newEnvironment(roms, false, false, false, false, false)
 	con := newConsoleMock(env, lines)
 	env.con = con
+	if setup != nil {
+		setup(env)
+	}
 	RunMOS(env)
 	return con.output
 }
@@ -38,12 +49,5 @@ func integrationTestBasicWithFile(lines []string, fileContent string) (string, e
 		}
 	}
 
-	def := "BASIC.ROM"
-	roms := []*string{&def}
-
-	env := newEnvironment(roms, false, false, false, false, false)
-	con := newConsoleMock(env, lines)
-	env.con = con
-	RunMOS(env)
-	return con.output, nil
+	return integrationTestBasic(lines), nil
 }
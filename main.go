@@ -39,6 +39,112 @@ func main() {
 		"r",
 		false,
 		"disable readline like input with history")
+	soundOut := flag.String(
+		"sound-out",
+		"",
+		"render the sound to a file, WAV for the .wav extension and raw PCM otherwise")
+	soundPlay := flag.String(
+		"sound",
+		"",
+		"play the sound live with 'aplay', 'pw-play', 'paplay', 'null' or a command reading raw PCM from stdin")
+	adcSource := flag.String(
+		"adc",
+		"",
+		"file, named pipe or '|command' with the samples for the ADC channels")
+	adcButtons := flag.String(
+		"adc-buttons",
+		"",
+		"keys acting as the joystick fire buttons 0 and 1")
+	userPort := flag.String(
+		"userport",
+		"",
+		"connect the user port to a file, named pipe, 'tcp:host:port' or 'unix:path'")
+	userPortIn := flag.String(
+		"userport-in",
+		"",
+		"file or named pipe with the levels of the user port input lines")
+	cpuModel := flag.String(
+		"cpu",
+		cpuCMOS65C02,
+		"CPU variant: 6502 (NMOS with undocumented opcodes), 65c02 or 65c12 (Master)")
+	cmosFile := flag.String(
+		"cmos",
+		"",
+		"file to persist the CMOS RAM of the Master, used with -cpu 65c12")
+	coverageFile := flag.String(
+		"coverage",
+		"",
+		"record the addresses executed and write the coverage report to a file at exit")
+	coverageListings := flag.String(
+		"coverage-listing",
+		"",
+		"ca65 or BeebAsm -v listings to annotate on the coverage report, separated by commas, as rom.lst or c:rom.lst for slot c")
+	debug := flag.Bool(
+		"debug",
+		false,
+		"enter the monitor on BRK and on not implemented MOS calls")
+	breakpoints := flag.String(
+		"break",
+		"",
+		"breakpoints separated by commas: 1900, c:8000, OSWORD=7, r:3000-3fff, w:70 or rw:70-7f")
+	tracepoints := flag.String(
+		"tracepoint",
+		"",
+		"tracepoints separated by commas, the state is shown and the execution continues")
+	gdbAddress := flag.String(
+		"gdb",
+		"",
+		"serve the GDB remote protocol on localhost, as ':2159', bbz waits for the debugger")
+	symbols := flag.String(
+		"symbols",
+		"",
+		"symbol files separated by commas: VICE labels (ca65 .lbl), BeebAsm -d dumps or ca65 listings")
+	mosTraceFile := flag.String(
+		"mos-trace",
+		"",
+		"write the MOS calls to a file as JSON lines")
+	mosTraceFilter := flag.String(
+		"mos-trace-filter",
+		"",
+		"MOS calls written by -mos-trace separated by commas, as OSFILE,OSFIND or OSBYTE=81")
+	tube := flag.Bool(
+		"tube",
+		false,
+		"run the language on a 6502 second processor with 64K of memory")
+	z80Rom := flag.String(
+		"z80",
+		"",
+		"run a Z80 second processor with 64K of memory booting the client ROM on the file")
+	discFiles := [2]*string{
+		flag.String(
+			"disc0",
+			"",
+			"disc image for the drives 0 and 2 of OSWORD &7F, .ssd with one side or .dsd with two"),
+		flag.String(
+			"disc1",
+			"",
+			"disc image for the drives 1 and 3 of OSWORD &7F, .ssd with one side or .dsd with two"),
+	}
+	guestProfile := flag.String(
+		"guest-profile",
+		"",
+		"profile the 6502 program, the reports are written at exit to <name>.txt and <name>.callgrind")
+	deterministic := flag.Bool(
+		"deterministic",
+		false,
+		"advance the clocks with the cycles executed at 2MHz for reproducible runs, INKEY doesn't sleep")
+	rtcDate := flag.String(
+		"rtc",
+		"",
+		"start the real time clock on a date as '2024-01-31 12:00:00', 2000-01-01 on deterministic mode")
+	speed := flag.String(
+		"speed",
+		speedUnlimited,
+		"CPU speed: 'real' for 2MHz, a multiple as '4x', a frequency as '8MHz' or 'unlimited'")
+	restoreFile := flag.String(
+		"restore",
+		"",
+		"resume from a snapshot saved with *SNAPSHOT instead of booting the language")
 	profileEnable := flag.Bool(
 		"profile",
 		false,
@@ -79,21 +185,188 @@ func main() {
 	defer env.close()
 	handleControlC(env)
 
+	err := env.setCPU(*cpuModel, *traceCPU)
+	if err != nil {
+		fmt.Printf("Invalid CPU:\n    %s\n", err)
+		os.Exit(1)
+	}
+
+	err = env.speed.set(*speed)
+	if err != nil {
+		fmt.Printf("Invalid speed:\n    %s\n", err)
+		os.Exit(1)
+	}
+
+	if *deterministic {
+		env.setDeterministic()
+	}
+	if *rtcDate != "" {
+		err := env.setRtc(*rtcDate)
+		if err != nil {
+			fmt.Printf("Invalid date for the real time clock:\n    %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *cmosFile != "" && !env.isMaster() {
+		fmt.Printf("Invalid CMOS RAM file:\n    %s\n", "-cmos needs the Master CPU, -cpu 65c12")
+		os.Exit(1)
+	}
+	if *cmosFile != "" {
+		err := env.cmos.load(*cmosFile)
+		if err != nil {
+			fmt.Printf("CMOS RAM file can't be loaded:\n    %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	err = env.symbols.loadFiles(*symbols)
+	if err != nil {
+		fmt.Printf("Symbols can't be loaded:\n    %s\n", err)
+		os.Exit(1)
+	}
+
+	env.debugger.onError = *debug
+	err = env.debugger.addBreakpoints(*breakpoints, false)
+	if err == nil {
+		err = env.debugger.addBreakpoints(*tracepoints, true)
+	}
+	if err != nil {
+		fmt.Printf("Invalid breakpoint:\n    %s\n", err)
+		os.Exit(1)
+	}
+
+	if *coverageFile != "" {
+		env.coverage, err = newCoverage(env, *coverageFile, *coverageListings)
+		if err != nil {
+			fmt.Printf("Coverage can't be started:\n    %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *guestProfile != "" {
+		env.profiler = newGuestProfiler(env, *guestProfile)
+	}
+
+	if *mosTraceFile != "" {
+		env.mosTrace, err = newMosTrace(env, *mosTraceFile, *mosTraceFilter)
+		if err != nil {
+			fmt.Printf("MOS trace can't be started:\n    %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *gdbAddress != "" {
+		env.gdb, err = newGdbStub(env, *gdbAddress)
+		if err != nil {
+			fmt.Printf("GDB stub can't be started:\n    %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *tube && *z80Rom != "" {
+		fmt.Printf("Invalid second processor:\n    -tube and -z80 can't be used together\n")
+		os.Exit(1)
+	}
+	if *tube {
+		env.enableTube()
+	}
+	if *z80Rom != "" {
+		err := env.enableTubeZ80(*z80Rom)
+		if err != nil {
+			fmt.Printf("Z80 client ROM can't be loaded:\n    %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	for i, discFile := range discFiles {
+		if *discFile != "" {
+			err := env.attachDisc(i, *discFile)
+			if err != nil {
+				fmt.Printf("Disc image can't be opened:\n    %s\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	var sinks teeSink
+	if *soundOut != "" {
+		sink, err := newFileSink(*soundOut)
+		if err != nil {
+			fmt.Printf("Sound output can't be created:\n    %s\n", err)
+			os.Exit(1)
+		}
+		sinks = append(sinks, sink)
+	}
+	if *soundPlay != "" {
+		sink, err := newLiveSink(*soundPlay)
+		if err != nil {
+			fmt.Printf("Sound player can't be started:\n    %s\n", err)
+			os.Exit(1)
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 1 {
+		env.sound.sink = sinks[0]
+	} else if len(sinks) > 1 {
+		env.sound.sink = sinks
+	}
+	if *soundPlay != "" {
+		env.sound.startLive()
+	}
+
+	if *adcSource != "" {
+		err := env.adc.openSource(*adcSource)
+		if err != nil {
+			fmt.Printf("ADC source can't be opened:\n    %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *adcButtons != "" {
+		err := env.adc.setButtonKeys(*adcButtons)
+		if err != nil {
+			fmt.Printf("Invalid fire button keys:\n    %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *userPort != "" || *userPortIn != "" {
+		err := env.userVia.connect(*userPort, *userPortIn)
+		if err != nil {
+			fmt.Printf("User port can't be connected:\n    %s\n", err)
+			os.Exit(1)
+		}
+	}
+
 	if *rawline {
 		env.con = newConsoleSimple(env)
 	} else {
 		env.con = newConsoleLiner(env)
 	}
 
+	if *restoreFile != "" {
+		err := env.loadSnapshot(*restoreFile)
+		if err != nil {
+			fmt.Printf("Snapshot can't be restored:\n    %s\n", err)
+			os.Exit(1)
+		}
+		env.restored = true
+	}
+
 	RunMOS(env)
 }
 
 func handleControlC(env *environment) {
 	c := make(chan os.Signal, 2)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 	go func() {
 		for {
-			<-c
+			s := <-c
+			if s == syscall.SIGQUIT {
+				// Ctrl-\ enters the monitor
+				env.debugger.interrupt()
+				continue
+			}
 			env.escape()
 		}
 	}()
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+	BBC Master 128 personality, MOS 3.20. It is selected with the 65C12 CPU.
+
+	The configuration is kept on the CMOS RAM of the real time clock, 50
+	bytes read and written with OSBYTE &A1 and &A2 and changed with
+	*CONFIGURE. The CMOS RAM is stored on the host file given with -cmos,
+	without it the configuration is lost on exit.
+
+	CMOS RAM allocation used for the configuration:
+		&05  bits 0-3 LANG, bits 4-7 FILE
+		&0A  bits 0-2 MODE, bit 3 SHADOW, bit 4 TV interlace off, bits 5-7 TV shift
+		&0B  bit 3 SHCAPS, bit 4 NOCAPS, bit 5 CAPS
+		&0C  DELAY
+		&0D  REPEAT
+		&0E  IGNORE
+		&0F  bits 2-4 BAUD-1, bits 5-7 PRINT
+		&10  bit 1 LOUD, bit 4 BOOT, bits 5-7 DATA
+
+	See:
+		https://beebwiki.mdfs.net/CMOS_configuration_RAM_allocation
+		BBC Master Reference Manual Part 1, chapter on *CONFIGURE
+*/
+
+const (
+	cmosSize = 50
+
+	cmosFileLang  = 0x05
+	cmosModeTV    = 0x0a
+	cmosCaps      = 0x0b
+	cmosDelay     = 0x0c
+	cmosRepeat    = 0x0d
+	cmosIgnore    = 0x0e
+	cmosBaudPrint = 0x0f
+	cmosFlags     = 0x10
+)
+
+var cmosDefaults = [cmosSize]uint8{
+	cmosFileLang:  0xcf, // DFS and the ROM on slot 15
+	cmosModeTV:    0x07, // Mode 7, no shadow
+	cmosCaps:      0x20, // CAPS
+	cmosDelay:     50,
+	cmosRepeat:    8,
+	cmosIgnore:    10,
+	cmosBaudPrint: 0x38, // 9600 baud, parallel printer
+	cmosFlags:     0x12, // LOUD, BOOT
+	0x06:          0xff, // All ROMs inserted
+	0x07:          0xff,
+}
+
+type cmosRAM struct {
+	data     [cmosSize]uint8
+	filename string
+}
+
+func newCmosRAM() *cmosRAM {
+	var c cmosRAM
+	c.data = cmosDefaults
+	return &c
+}
+
+// Use a host file to persist the CMOS RAM. The file is created if missing.
+func (c *cmosRAM) load(filename string) error {
+	c.filename = filename
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return c.save()
+	}
+	if err != nil {
+		return err
+	}
+	copy(c.data[:], data)
+	return nil
+}
+
+func (c *cmosRAM) save() error {
+	if c.filename == "" {
+		return nil
+	}
+	return os.WriteFile(c.filename, c.data[:], 0644)
+}
+
+func (c *cmosRAM) read(address uint8) uint8 {
+	if int(address) >= cmosSize {
+		return 0xff
+	}
+	return c.data[address]
+}
+
+// Returns the error of the host file, the value is written anyway
+func (c *cmosRAM) write(address uint8, value uint8) error {
+	if int(address) >= cmosSize {
+		return nil
+	}
+	c.data[address] = value
+	return c.save()
+}
+
+// Change some bits of a CMOS location
+func (c *cmosRAM) writeBits(address uint8, mask uint8, value uint8) error {
+	return c.write(address, c.data[address]&^mask|value&mask)
+}
+
+func (env *environment) isMaster() bool {
+	return env.cpuModel == cpuCMOS65C12
+}
+
+/*
+The *CONFIGURE options. Numeric options have a CMOS location, a mask and a
+shift. Flags have the value stored when selected, and the name of the
+opposite option.
+*/
+type configOption struct {
+	name     string
+	opposite string
+	address  uint8
+	mask     uint8
+	shift    uint8
+	value    uint8 // For flags
+	numeric  bool
+	offset   uint8 // Added to the stored value when shown
+	argument string
+}
+
+var configOptions = []configOption{
+	{name: "BAUD", address: cmosBaudPrint, mask: 0x1c, shift: 2, numeric: true, offset: 1, argument: "<D>"},
+	{name: "BOOT", opposite: "NOBOOT", address: cmosFlags, mask: 0x10, value: 0x10},
+	{name: "CAPS", address: cmosCaps, mask: 0x38, value: 0x20},
+	{name: "DATA", address: cmosFlags, mask: 0xe0, shift: 5, numeric: true, argument: "<D>"},
+	{name: "DELAY", address: cmosDelay, mask: 0xff, numeric: true, argument: "<D>"},
+	{name: "FILE", address: cmosFileLang, mask: 0xf0, shift: 4, numeric: true, argument: "<D>"},
+	{name: "IGNORE", address: cmosIgnore, mask: 0xff, numeric: true, argument: "[<D>]"},
+	{name: "LANG", address: cmosFileLang, mask: 0x0f, numeric: true, argument: "<D>"},
+	{name: "LOUD", opposite: "QUIET", address: cmosFlags, mask: 0x02, value: 0x02},
+	{name: "MODE", address: cmosModeTV, mask: 0x07, numeric: true, argument: "<D>"},
+	{name: "NOCAPS", address: cmosCaps, mask: 0x38, value: 0x10},
+	{name: "PRINT", address: cmosBaudPrint, mask: 0xe0, shift: 5, numeric: true, argument: "<D>"},
+	{name: "REPEAT", address: cmosRepeat, mask: 0xff, numeric: true, argument: "<D>"},
+	{name: "SHADOW", opposite: "NOSHADOW", address: cmosModeTV, mask: 0x08, value: 0x08},
+	{name: "SHCAPS", address: cmosCaps, mask: 0x38, value: 0x08},
+	{name: "TV", address: cmosModeTV, mask: 0xf0, shift: 4, numeric: true, argument: "[<D>[,<D>]]"},
+}
+
+func findConfigOption(name string) (*configOption, bool) {
+	for i := range configOptions {
+		option := &configOptions[i]
+		if option.name == name {
+			return option, true
+		}
+		if option.opposite != "" && option.opposite == name {
+			return option, false
+		}
+	}
+	return nil, false
+}
+
+func execCONFIGURE(env *environment, args string) {
+	args = strings.ToUpper(strings.TrimSpace(args))
+	if args == "" {
+		env.con.write("Configuration options:\n")
+		for _, option := range configOptions {
+			if option.argument == "" {
+				env.con.writef("%s\n", option.name)
+			} else {
+				env.con.writef("%-10s%s\n", option.name, option.argument)
+			}
+			if option.opposite != "" {
+				env.con.writef("%s\n", option.opposite)
+			}
+		}
+		return
+	}
+
+	name := args
+	value := ""
+	if i := strings.IndexAny(args, " 0123456789"); i >= 0 {
+		name = args[:i]
+		value = strings.TrimSpace(args[i:])
+	}
+	option, selected := findConfigOption(name)
+	if option == nil {
+		env.raiseError(254, "Bad command")
+		return
+	}
+
+	if !option.numeric {
+		stored := option.value
+		if !selected {
+			stored = 0
+		}
+		err := env.cmos.writeBits(option.address, option.mask, stored)
+		if err != nil {
+			env.raiseError(errorTodo, err.Error())
+		}
+		return
+	}
+
+	if option.name == "TV" {
+		// TV <vertical shift>,<interlace>
+		shift, interlace := 0, 0
+		if value != "" {
+			parts := strings.SplitN(value, ",", 2)
+			var err error
+			shift, err = strconv.Atoi(strings.TrimSpace(parts[0]))
+			if err == nil && len(parts) > 1 {
+				interlace, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+			}
+			if err != nil {
+				env.raiseError(254, "Bad command")
+				return
+			}
+		}
+		err := env.cmos.writeBits(cmosModeTV, 0xf0, uint8(shift&0x07)<<5|uint8(interlace&1)<<4)
+		if err != nil {
+			env.raiseError(errorTodo, err.Error())
+		}
+		return
+	}
+
+	n := 0
+	if value != "" {
+		var err error
+		n, err = strconv.Atoi(value)
+		if err != nil || n < 0 || n > 255 {
+			env.raiseError(254, "Bad command")
+			return
+		}
+	} else if option.name != "IGNORE" {
+		env.raiseError(254, "Bad command")
+		return
+	}
+	stored := uint8(n) - option.offset
+	err := env.cmos.writeBits(option.address, option.mask, stored<<option.shift)
+	if err != nil {
+		env.raiseError(errorTodo, err.Error())
+	}
+}
+
+func execSTATUS(env *environment, args string) {
+	args = strings.ToUpper(strings.TrimSpace(args))
+	if args == "" {
+		env.con.write("Configuration status:\n")
+	}
+
+	found := false
+	for _, option := range configOptions {
+		if args != "" && args != option.name && args != option.opposite {
+			continue
+		}
+		found = true
+		stored := env.cmos.read(option.address) & option.mask
+		switch {
+		case option.name == "TV":
+			env.con.writef("%-10s%v,%v\n", option.name, stored>>5, (stored>>4)&1)
+		case option.numeric:
+			env.con.writef("%-10s%v\n", option.name, stored>>option.shift+option.offset)
+		case stored == option.value:
+			env.con.writef("%s\n", option.name)
+		case option.opposite != "":
+			env.con.writef("%s\n", option.opposite)
+		}
+	}
+
+	if !found {
+		env.raiseError(254, "Bad command")
+	}
+}
+
+/*
+OSBYTE &44, test the sideways RAM presence. On exit, the bits 0 to 3 of X
+are set for the banks 4 to 7 that are RAM.
+*/
+func (env *environment) sidewaysRamBanks() uint8 {
+	banks := uint8(0)
+	for slot := 4; slot <= 7; slot++ {
+		if !env.mem.writeProtectRom[slot] {
+			banks |= 1 << (slot - 4)
+		}
+	}
+	return banks
+}
+
+func boolToUint8(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
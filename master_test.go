@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func integrationTestMaster(t *testing.T, cmosFile string, lines []string) string {
+	return integrationTestBasicWithSetup(lines, func(env *environment) {
+		err := env.setCPU(cpuCMOS65C12, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = env.cmos.load(cmosFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestMasterConfigure(t *testing.T) {
+	cmosFile := filepath.Join(t.TempDir(), "cmos")
+	out := integrationTestMaster(t, cmosFile, []string{
+		"*CONFIGURE MODE 3",
+		"*CONFIGURE NOBOOT",
+		"*CONFIGURE TV 255,1",
+		"*STATUS MODE",
+		"*STATUS BOOT",
+		"*STATUS TV",
+	})
+
+	if !strings.Contains(out, "MODE      3\n") {
+		t.Error("*STATUS MODE failed")
+	}
+	if !strings.Contains(out, "NOBOOT\n") {
+		t.Error("*STATUS BOOT failed")
+	}
+	if !strings.Contains(out, "TV        7,1\n") {
+		t.Error("*STATUS TV failed")
+	}
+
+	// The configuration is kept on the CMOS file
+	data, err := os.ReadFile(cmosFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != cmosSize || data[cmosModeTV] != 0xf3 {
+		t.Errorf("CMOS file not updated, %v", data)
+	}
+	out = integrationTestMaster(t, cmosFile, []string{
+		"*STATUS MODE",
+	})
+	if !strings.Contains(out, "MODE      3\n") {
+		t.Error("the CMOS RAM was not loaded")
+	}
+}
+
+func TestMasterCmosWriteError(t *testing.T) {
+	out := integrationTestBasicWithSetup([]string{
+		"*CONFIGURE MODE 3",
+		"*STATUS MODE",
+	}, func(env *environment) {
+		err := env.setCPU(cpuCMOS65C12, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.cmos.filename = filepath.Join(t.TempDir(), "missing", "cmos")
+	})
+
+	if !strings.Contains(out, "no such file or directory") {
+		t.Log(out)
+		t.Error("The error writing the CMOS file should be reported")
+	}
+	if !strings.Contains(out, "MODE      3\n") {
+		t.Log(out)
+		t.Error("The CMOS RAM should be updated anyway")
+	}
+}
+
+func TestMasterCmosOsbyte(t *testing.T) {
+	cmosFile := filepath.Join(t.TempDir(), "cmos")
+	out := integrationTestMaster(t, cmosFile, []string{
+		"A%=&A2:X%=30:Y%=123:CALL &FFF4",
+		"A%=&A1:X%=30:PRINT (USR(&FFF4) AND &FF0000) DIV &10000",
+		"A%=&46:X%=255:PRINT (USR(&FFF4) AND &FF00) DIV &100",
+	})
+
+	if !strings.Contains(out, "DIV &10000\n       123\n") {
+		t.Error("OSBYTE &A1/&A2 failed")
+	}
+	if !strings.Contains(out, "DIV &100\n         1\n") {
+		t.Error("OSBYTE &46 should return the UK country code")
+	}
+}
+
+func TestMasterShadowMemory(t *testing.T) {
+	cmosFile := filepath.Join(t.TempDir(), "cmos")
+	out := integrationTestMaster(t, cmosFile, []string{
+		"?&4000=1",
+		"A%=&6C:X%=1:CALL &FFF4",
+		"?&4000=2",
+		"A%=&6C:X%=0:CALL &FFF4",
+		"PRINT ?&4000",
+		"A%=&72:X%=0:CALL &FFF4",
+		"A%=&72:X%=1:PRINT (USR(&FFF4) AND &FF00) DIV &100",
+	})
+
+	if !strings.Contains(out, "PRINT ?&4000\n         1\n") {
+		t.Error("the main memory should not be changed when shadow is selected")
+	}
+	if !strings.Contains(out, "DIV &100\n         0\n") {
+		t.Error("OSBYTE &72 should return the previous setting")
+	}
+}
+
+func TestMasterRealTimeClock(t *testing.T) {
+	cmosFile := filepath.Join(t.TempDir(), "cmos")
+	out := integrationTestMaster(t, cmosFile, []string{
+		"?&900=2:?&901=&24:?&902=&03:?&903=&15:?&905=&10:?&906=&20:?&907=&30",
+		"A%=&0E:X%=0:Y%=9:CALL &FFF1:PRINT $&900",
+		"$&901=\"Sun,01 Jan 2023.12:34:56\":?&900=24",
+		"A%=&0F:X%=0:Y%=9:CALL &FFF1",
+		"?&900=1:A%=&0E:X%=0:Y%=9:CALL &FFF1:PRINT ~?&900",
+	})
+
+	if !strings.Contains(out, "PRINT $&900\nFri,15 Mar 2024.10:20:30\n") {
+		t.Error("OSWORD &0E function 2 failed")
+	}
+	if !strings.Contains(out, "PRINT ~?&900\n        23\n") {
+		t.Error("OSWORD &0F failed")
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+	Structured trace of the MOS calls, enabled with -mos-trace. Each call
+	serviced by bbz is written to the file as a JSON object on its own line,
+	with the registers on entry, the decoded parameters, the registers on
+	exit, the error raised if any and the messages of the -m log.
+
+	The filter given with -mos-trace-filter selects the calls, separated by
+	commas, with an optional value for A as in OSBYTE=81. Without filter,
+	all the calls except OSWRCH and OSRDCH are written.
+
+	Example, the files loaded:
+		bbz -mos-trace calls.jsonl -mos-trace-filter OSFILE=FF
+		jq -r .params.filename calls.jsonl
+*/
+
+// Names of the entry points without a MOS call, see mosCalls
+var mosCallNames = map[uint16]string{
+	epUPT:    "UPTV",
+	epEVNT:   "EVNTV",
+	epIRQ2:   "IRQ2V",
+	epIRQ1:   "IRQ1V",
+	epBRK:    "BRKV",
+	epUSER:   "USERV",
+	epSYSBRK: "BRK",
+	epNET:    "NETV",
+	epVDU:    "VDUV",
+	epKEY:    "KEYV",
+	epINS:    "INSV",
+	epREM:    "REMV",
+	epCNP:    "CNPV",
+	epIND1:   "IND1V",
+	epIND2:   "IND2V",
+	epIND3:   "IND3V",
+}
+
+// Bytes sent on the OSWORD control blocks, as on the Tube protocol
+var oswordInputLengths = []uint16{
+	0x00, 0x00, 0x05, 0x00, 0x05, 0x04, 0x05, 0x08, 0x0e, 0x04, 0x01,
+	0x01, 0x05, 0x00, 0x01, 0x20, 0x10, 0x0d, 0x00, 0x04, 0x80,
+}
+
+const oswordDefaultInputLength = 16
+
+func mosCallName(ep uint16) string {
+	for _, call := range mosCalls {
+		if call.entryPoint == ep && ep != 0 {
+			return call.name
+		}
+	}
+	if name, ok := mosCallNames[ep]; ok {
+		return name
+	}
+	return fmt.Sprintf("EP&%04X", ep)
+}
+
+type mosTraceRegisters struct {
+	A uint8 `json:"a"`
+	X uint8 `json:"x"`
+	Y uint8 `json:"y"`
+	C bool  `json:"c"`
+}
+
+type mosTraceError struct {
+	Number  uint8  `json:"number"`
+	Message string `json:"message"`
+}
+
+type mosTraceRecord struct {
+	Call   string             `json:"call"`
+	A      uint8              `json:"a"`
+	X      uint8              `json:"x"`
+	Y      uint8              `json:"y"`
+	Params map[string]any     `json:"params,omitempty"`
+	Result *mosTraceRegisters `json:"result,omitempty"`
+	Error  *mosTraceError     `json:"error,omitempty"`
+	Log    []string           `json:"log,omitempty"`
+	Rom    uint8              `json:"rom"`
+	Cycles uint64             `json:"cycles"`
+	Time   string             `json:"time"`
+}
+
+type mosTraceFilter struct {
+	call string
+	a    int // -1 for any
+}
+
+type mosTrace struct {
+	env     *environment
+	file    *os.File
+	out     *bufio.Writer
+	encoder *json.Encoder
+	filters []mosTraceFilter
+	current *mosTraceRecord // Call being serviced
+}
+
+func newMosTrace(env *environment, filename string, filters string) (*mosTrace, error) {
+	var t mosTrace
+	t.env = env
+	err := t.parseFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	t.file, err = os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	t.out = bufio.NewWriter(t.file)
+	t.encoder = json.NewEncoder(t.out)
+	t.encoder.SetEscapeHTML(false)
+	return &t, nil
+}
+
+func (t *mosTrace) parseFilters(filters string) error {
+	for _, spec := range strings.Split(filters, ",") {
+		spec = strings.TrimSpace(strings.ToUpper(spec))
+		if spec == "" {
+			continue
+		}
+		name, aText, hasA := strings.Cut(spec, "=")
+		known := false
+		for ep := entryPoints; ep <= epEntryPointsLast; ep++ {
+			known = known || mosCallName(ep) == name
+		}
+		if !known {
+			return fmt.Errorf("%s: unknown MOS call", spec)
+		}
+		filter := mosTraceFilter{name, -1}
+		if hasA {
+			a, ok := parseHex(aText)
+			if !ok || a > 0xff {
+				return fmt.Errorf("%s: bad value for A", spec)
+			}
+			filter.a = int(a)
+		}
+		t.filters = append(t.filters, filter)
+	}
+	return nil
+}
+
+func (t *mosTrace) selected(call string, a uint8) bool {
+	if len(t.filters) == 0 {
+		return call != "OSWRCH" && call != "OSRDCH"
+	}
+	for _, filter := range t.filters {
+		if filter.call == call && (filter.a < 0 || uint8(filter.a) == a) {
+			return true
+		}
+	}
+	return false
+}
+
+// Called before the MOS call on the entry point is serviced
+func (t *mosTrace) begin(ep uint16) {
+	env := t.env
+	a, x, y, _ := env.cpu.GetAXYP()
+	call := mosCallName(ep)
+	t.current = nil
+	if !t.selected(call, a) {
+		return
+	}
+
+	var record mosTraceRecord
+	record.Call = call
+	record.A = a
+	record.X = x
+	record.Y = y
+	record.Params = t.decodeParams(ep, a, x, y)
+	record.Rom = env.mem.activeRom
+	record.Cycles = env.cycles()
+	record.Time = env.now().Format(time.RFC3339Nano)
+	t.current = &record
+}
+
+// Called after the MOS call is serviced
+func (t *mosTrace) end() {
+	record := t.current
+	if record == nil {
+		return
+	}
+	t.current = nil
+
+	a, x, y, p := t.env.cpu.GetAXYP()
+	record.Result = &mosTraceRegisters{a, x, y, p&1 != 0}
+	err := t.encoder.Encode(record)
+	if err != nil {
+		t.env.log(fmt.Sprintf("MOS trace failed: %s", err))
+	}
+}
+
+func (t *mosTrace) addLog(msg string) {
+	if t.current != nil {
+		t.current.Log = append(t.current.Log, msg)
+	}
+}
+
+func (t *mosTrace) addError(code uint8, msg string) {
+	if t.current != nil {
+		t.current.Error = &mosTraceError{code, msg}
+	}
+}
+
+func (t *mosTrace) close() error {
+	return errors.Join(t.out.Flush(), t.file.Close())
+}
+
+func (t *mosTrace) decodeParams(ep uint16, a uint8, x uint8, y uint8) map[string]any {
+	mem := t.env.mem
+	// Decoding is not an access of the program, don't trigger watchpoints
+	watch := mem.watch
+	mem.watch = nil
+	defer func() { mem.watch = watch }()
+
+	xy := uint16(x) + uint16(y)<<8
+	params := make(map[string]any)
+	switch ep {
+	case epFILE:
+		params["filename"] = mem.peekString(mem.peekWord(xy), '\r')
+		params["load"] = mem.peekDoubleWord(xy + cbLoadAddress)
+		params["exec"] = mem.peekDoubleWord(xy + cbExecutionAddress)
+		params["start"] = mem.peekDoubleWord(xy + cbStartAddressOrSize)
+		params["end"] = mem.peekDoubleWord(xy + cbEndAddressOrAttributes)
+	case epFIND:
+		if a == 0 {
+			params["handle"] = y
+		} else {
+			params["filename"] = mem.peekString(xy, '\r')
+		}
+	case epGBPB:
+		params["handle"] = mem.Peek(xy)
+		params["address"] = mem.peekDoubleWord(xy + 1)
+		params["count"] = mem.peekDoubleWord(xy + 5)
+		params["pointer"] = mem.peekDoubleWord(xy + 9)
+	case epARGS:
+		params["handle"] = y
+		params["value"] = mem.peekDoubleWord(uint16(x))
+	case epBGET, epBPUT:
+		params["handle"] = y
+	case epCLI:
+		params["command"] = mem.peekString(xy, '\r')
+	case epWORD:
+		params["block"] = xy
+		if a == 0 {
+			params["buffer"] = mem.peekWord(xy)
+			params["max_length"] = mem.Peek(xy + 2)
+		} else {
+			length := uint16(oswordDefaultInputLength)
+			if int(a) < len(oswordInputLengths) {
+				length = oswordInputLengths[a]
+			}
+			params["data"] = hex.EncodeToString(mem.peekSlice(xy, length))
+		}
+	case epGSINIT:
+		params["string"] = mem.peekString(mem.peekWord(zpStr)+uint16(y), '\r')
+	case epSYSBRK:
+		_, sp := t.env.cpu.GetPCAndSP()
+		address := mem.peekWord(0x100+uint16(sp+2)) - 1
+		params["number"] = mem.Peek(address)
+		params["message"] = mem.peekString(address+1, 0)
+		params["address"] = address - 1
+	}
+
+	if len(params) == 0 {
+		return nil
+	}
+	return params
+}
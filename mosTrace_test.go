@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMosTrace(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "calls.jsonl")
+	var env *environment
+	integrationTestBasicWithSetup([]string{
+		"A%=INKEY(0)",
+		"*FX 0,Z",
+	}, func(e *environment) {
+		env = e
+		var err error
+		env.mosTrace, err = newMosTrace(env, filename, "OSCLI,OSBYTE=81")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	env.mosTrace.close()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var records []mosTraceRecord
+	for _, line := range lines {
+		var record mosTraceRecord
+		err := json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			t.Fatalf("Invalid JSON line %s: %v", line, err)
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 2 {
+		t.Log(string(data))
+		t.Fatalf("Two calls expected, got %v", len(records))
+	}
+	if records[0].Call != "OSBYTE" || records[0].A != 0x81 || records[0].Result == nil {
+		t.Log(string(data))
+		t.Error("The OSBYTE &81 call is missing")
+	}
+	if records[1].Call != "OSCLI" || records[1].Params["command"] != "*FX 0,Z" ||
+		records[1].Error == nil || records[1].Error.Number != 254 {
+		t.Log(string(data))
+		t.Error("The OSCLI call with the error is missing")
+	}
+}
+
+func TestMosTraceEndOfInput(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "calls.jsonl")
+	var env *environment
+	integrationTestBasicWithSetup([]string{
+		"A=GET",
+	}, func(e *environment) {
+		env = e
+		var err error
+		env.mosTrace, err = newMosTrace(env, filename, "OSRDCH")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	env.mosTrace.close()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"call":"OSRDCH"`) {
+		t.Log(string(data))
+		t.Error("The OSRDCH call stopped by the end of the input should be traced")
+	}
+}
+
+func TestMosTraceFilter(t *testing.T) {
+	var trace mosTrace
+	err := trace.parseFilters("osfile, OSBYTE=81")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !trace.selected("OSFILE", 0xff) || !trace.selected("OSBYTE", 0x81) ||
+		trace.selected("OSBYTE", 0x80) || trace.selected("OSWORD", 0) {
+		t.Error("The filter is not applied")
+	}
+	if trace.parseFilters("OSFOO") == nil {
+		t.Error("Unknown calls should be rejected")
+	}
+}
@@ -22,11 +22,20 @@ func execOSBYTE(env *environment) {
 			On exit,
 				X=0, OS 1.00
 				X=1, OS 1.20
+				X=3, MOS 3.20 of the Master 128
 		*/
+		osVersion, _ := env.machineType()
 		if x == 0 {
-			env.raiseError(errorTodo, "MOS as interpreted by BZZ")
+			switch env.cpuModel {
+			case cpuNMOS6502:
+				env.raiseError(errorTodo, "OS 1.20 as interpreted by BBZ")
+			case cpuCMOS65C12:
+				env.raiseError(errorTodo, "MOS 3.20 as interpreted by BBZ")
+			default:
+				env.raiseError(errorTodo, "MOS as interpreted by BZZ")
+			}
 		} else {
-			newX = 0
+			newX = osVersion
 		}
 
 	case 0x02:
@@ -79,18 +88,158 @@ func execOSBYTE(env *environment) {
 		// We do nothing
 
 	case 0x0f:
-		option = "Flush specific buffer"
+		option = "Flush buffer class"
 		/*
 			Entry parameters: X value selects class of buffer
+				X=0 all buffers are flushed
+				X<>0 the current input buffer is flushed
 		*/
-		// We do nothing
+		if x == 0 {
+			for channel := uint8(0); channel <= bufferSound3-bufferSound0; channel++ {
+				env.sound.flush(channel)
+			}
+		}
+		// There is nothing to do for the input buffers
 
 	case 0x15:
 		option = "Flush specific buffer"
 		/*
 			Entry parameters: X determines the buffer to be cleared
+				0 keyboard buffer
+				1 RS423 input buffer
+				2 RS423 output buffer
+				3 printer buffer
+				4 sound channel 0 (noise)
+				5 sound channel 1
+				6 sound channel 2
+				7 sound channel 3
+				8 speech buffer
 		*/
-		// We do nothing
+		if x >= bufferSound0 && x <= bufferSound3 {
+			env.sound.flush(x - bufferSound0)
+		}
+		// There is nothing to do for the other buffers
+
+	case 0x10:
+		option = "Select ADC channels"
+		/*
+			Entry parameters: X contains the number of channels to be sampled, 0 to
+			disable the sampling.
+			On exit, X contains the previous number of channels.
+		*/
+		newX = env.mem.Peek(mosAdcMaxChannel)
+		if x > adcChannels {
+			x = adcChannels
+		}
+		env.mem.Poke(mosAdcMaxChannel, x)
+
+	case 0x11:
+		option = "Force an ADC conversion"
+		/*
+			Entry parameters: X specifies the channel number to start conversion on
+		*/
+		if x >= 1 && x <= adcChannels {
+			env.mem.Poke(mosAdcChannel, x)
+			env.adc.convert(x, env.adcBits())
+		}
+
+	case 0x44:
+		if !env.isMaster() {
+			newA = osByteToRoms(env, a, x, y)
+			break
+		}
+		option = "Test sideways RAM presence"
+		/*
+			On exit:
+				X bits 0 to 3 are set for the sideways RAM banks 4 to 7
+		*/
+		newX = env.sidewaysRamBanks()
+
+	case 0x45:
+		if !env.isMaster() {
+			newA = osByteToRoms(env, a, x, y)
+			break
+		}
+		option = "Test pseudo/absolute use of sideways RAM"
+		/*
+			On exit:
+				X bits 0 to 3 are set for the banks 4 to 7 used as pseudo
+				addressing RAM
+		*/
+		newX = 0
+
+	case 0x46:
+		if !env.isMaster() {
+			newA = osByteToRoms(env, a, x, y)
+			break
+		}
+		option = "Read/write country code"
+		/*
+			On entry:
+				X=255 to read the country code, otherwise the new code
+			On exit:
+				X=country code, 1 for UK
+		*/
+		newX = 1
+
+	case 0x6c:
+		if !env.isMaster() {
+			newA = osByteToRoms(env, a, x, y)
+			break
+		}
+		option = "Select main/shadow memory for CPU access"
+		/*
+			On entry:
+				X=0 main memory is accessed at &3000 to &7FFF
+				X=1 shadow memory is accessed at &3000 to &7FFF
+			On exit:
+				X=previous setting
+		*/
+		newX = boolToUint8(env.mem.shadowSelected)
+		env.mem.selectShadow(x != 0)
+
+	case 0x70:
+		if !env.isMaster() {
+			newA = osByteToRoms(env, a, x, y)
+			break
+		}
+		option = "Select main/shadow memory for VDU access"
+		/*
+			On entry:
+				X=0 select the memory used by the current display mode
+				X=1 main memory is used by the VDU drivers
+				X=2 shadow memory is used by the VDU drivers
+			On exit:
+				X=previous setting
+		*/
+		newX = boolToUint8(env.mem.shadowVdu) + 1
+		if x == 0 {
+			env.mem.shadowVdu = env.vdu.shadow
+		} else {
+			env.mem.shadowVdu = x == 2
+		}
+
+	case 0x71:
+		if !env.isMaster() {
+			newA = osByteToRoms(env, a, x, y)
+			break
+		}
+		option = "Select main/shadow memory for display hardware"
+		/*
+			On entry:
+				X=0 select the memory used by the current display mode
+				X=1 main memory is displayed
+				X=2 shadow memory is displayed
+			On exit:
+				X=previous setting
+		*/
+		newX = boolToUint8(env.mem.shadowDisplay) + 1
+		if x == 0 {
+			env.mem.shadowDisplay = env.vdu.shadow
+		} else {
+			env.mem.allocShadow()
+			env.mem.shadowDisplay = x == 2
+		}
 
 	case 0x72:
 		option = "Specify video memory to use on next MODE change"
@@ -101,8 +250,25 @@ func execOSBYTE(env *environment) {
 				X=255 never use shadow memory even if MODE > 127 (Solidisk ROM/RAM Extension)
 			On exit:
 				X=previous setting
+			The setting is stored on the location read with OSBYTE &EF.
 		*/
-		newX = 1
+		newX = env.mem.Peek(mosShadowState)
+		env.mem.Poke(mosShadowState, x)
+
+	case 0x75:
+		option = "Read VDU status"
+		/*
+			On exit, X contains the VDU status byte:
+				bit 0 printer output enabled by VDU 2
+				bit 1 scrolling disabled
+				bit 2 paged scrolling selected
+				bit 3 software scrolling selected (text window)
+				bit 4 shadow screen mode
+				bit 5 printing at graphics cursor (VDU 5)
+				bit 6 cursor editing mode
+				bit 7 screen disabled (VDU 21)
+		*/
+		newX = env.mem.Peek(zpVduStatus)
 
 	case 0x76:
 		option = "Reflect keyboard status in keyboard LEDs"
@@ -192,10 +358,40 @@ func execOSBYTE(env *environment) {
 			On exit, for input buffers X contains the number of characters in the buffer
 			and for output buffers the number of spaces remaining.
 		*/
-		if x == 0xff { // Keyboard buffer
-			newX = 0
+		if x == 0 {
+			option = "Read ADC fire buttons"
+			// On exit, X has the fire buttons on bits 0 and 1 and Y the last channel converted
+			newX = env.adc.fireButtons()
+			newY = env.adc.lastChannel
+		} else if x <= adcChannels {
+			// On exit, X and Y contain the 16 bit value of the channel
+			var value uint16
+			if x <= env.mem.Peek(mosAdcMaxChannel) {
+				value = env.adc.convert(x, env.adcBits())
+				env.mem.Poke(mosAdcChannel, x)
+			} else {
+				// The channel is not sampled, the last value is kept
+				value = env.adc.value(x, env.adcBits())
+			}
+			newX = uint8(value & 0xff)
+			newY = uint8(value >> 8)
+		} else if x >= 0xf7 {
+			// Buffers, X is 255 minus the buffer number
+			buffer := 0xff - x
+			switch {
+			case buffer == bufferKeyboard || buffer == bufferRS423Input:
+				newX = 0 // Empty
+			case buffer == bufferRS423Output:
+				newX = 0xbf // Free space on an empty buffer
+			case buffer == bufferPrinter || buffer == bufferSpeech:
+				newX = 0x3f // Free space on an empty buffer
+			default:
+				newX = env.sound.freeSlots(buffer - bufferSound0)
+			}
+			newY = 0
+			option = fmt.Sprintf("Read buffer %v status", buffer)
 		} else {
-			env.notImplemented("OSBYTE80 supported only for X=0xff")
+			env.notImplemented("OSBYTE80 supported only for ADC channels and buffers")
 		}
 
 	case 0x81:
@@ -216,7 +412,7 @@ func execOSBYTE(env *environment) {
 			// We will just wait the time and return that no key was pressed
 			timeLimitMs := (uint16(x) + uint16(y)<<8) * 10
 			env.logIO(fmt.Sprintf("Sleep(%v ms", timeLimitMs))
-			time.Sleep(time.Duration(timeLimitMs) * time.Millisecond)
+			env.sleep(time.Duration(timeLimitMs) * time.Millisecond)
 			newY = 0xff
 			newP = newP | 1 // Set carry
 		} else if y == 0xff && x != 0 {
@@ -227,7 +423,7 @@ func execOSBYTE(env *environment) {
 		} else if y == 0xff && x == 0 {
 			option = "Check machine type"
 			// See: http://beebwiki.mdfs.net/INKEY
-			newX = 0x28 // BBZ, not currently reserved
+			_, newX = env.machineType()
 		} else {
 			option = "Undefined use of OSBYTE81"
 		}
@@ -243,29 +439,64 @@ func execOSBYTE(env *environment) {
 			(This address is &FFFF for the BBC microcomputer I/O
 			processor)
 		*/
-		newX = 0xff
-		newY = 0xff
+		if env.isTube() || env.z80 != nil {
+			// The second processor uses &0000
+			newX = 0
+			newY = 0
+		} else {
+			newX = 0xff
+			newY = 0xff
+		}
 
 	case 0x83:
 		option = "Read bottom of user mem"
-		newX = uint8(userMemBottom & 0xff)
-		newY = uint8(userMemBottom >> 8)
+		oshwm := userMemBottom
+		if env.isTube() {
+			oshwm = tubeMemBottom
+		}
+		newX = uint8(oshwm & 0xff)
+		newY = uint8(oshwm >> 8)
 
 	case 0x84:
 		option = "Read top of user mem"
-		newX = uint8(romStartAddress & 0xff)
-		newY = uint8(romStartAddress >> 8)
+		himem := env.vdu.modeInfo().screenStart
+		if env.vdu.shadow {
+			// The screen is on the shadow memory
+			himem = romStartAddress
+		}
+		if env.isTube() {
+			// The screen is on the I/O processor
+			himem = env.tubeHimem()
+		}
+		newX = uint8(himem & 0xff)
+		newY = uint8(himem >> 8)
 
 	case 0x85:
 		option = "Read top of user mem for mode"
-		newX = uint8(romStartAddress & 0xff)
-		newY = uint8(romStartAddress >> 8)
+		/*
+			Entry parameters: X contains the mode number
+			On exit, X and Y contain the address of the start of the screen memory
+			for that mode.
+			Modes 128 to 135 use the shadow memory, HIMEM is &8000.
+		*/
+		himem := modeInfos[x&7].screenStart
+		if env.vdu.isShadowMode(x) {
+			himem = romStartAddress
+		}
+		if env.isTube() {
+			himem = env.tubeHimem()
+		}
+		newX = uint8(himem & 0xff)
+		newY = uint8(himem >> 8)
 
 	case 0x86:
 		option = "Read text cursor position"
-		// Not implemented. Returns 1, 1
-		newX = 1
-		newY = 1
+		/*
+			On exit, X contains the horizontal position (POS) and Y the vertical
+			position (VPOS), both relative to the text window.
+		*/
+		newX = env.vdu.cursorX - env.vdu.textWindow[0]
+		newY = env.vdu.cursorY - env.vdu.textWindow[3]
 
 	case 0x87:
 		option = "Read character at text cursor position"
@@ -312,13 +543,34 @@ func execOSBYTE(env *environment) {
 			On exit, X contains low byte of number and Y contains the high byte
 			This call reads locations &300,X and &301,X
 		*/
-		// Not implemented. Just returns O.
-		newX = 0
-		newY = 0
-		if x == 0x09 {
-			//Bottom row / Right hand column
-			newX = 31
-			newY = 39 // Pascal editor only works with 80 columns
+		newX = env.mem.Peek(vduGraphicsWindow + uint16(x))
+		newY = env.mem.Peek(vduGraphicsWindow + uint16(x) + 1)
+
+	case 0xa1:
+		if !env.isMaster() {
+			newA = osByteToRoms(env, a, x, y)
+			break
+		}
+		option = "Read CMOS RAM"
+		/*
+			Entry parameters: X contains the CMOS RAM location, 0 to 49
+			On exit, Y contains the value read
+		*/
+		newY = env.cmos.read(x)
+
+	case 0xa2:
+		if !env.isMaster() {
+			newA = osByteToRoms(env, a, x, y)
+			break
+		}
+		option = "Write CMOS RAM"
+		/*
+			Entry parameters: X contains the CMOS RAM location, 0 to 49,
+			and Y the value to write
+		*/
+		err := env.cmos.write(x, y)
+		if err != nil {
+			env.raiseError(errorTodo, err.Error())
 		}
 
 	default:
@@ -328,14 +580,7 @@ func execOSBYTE(env *environment) {
 				option = "Read/write system variable"
 			}
 		} else {
-			// Send to the other ROMS if available.
-			env.mem.Poke(zpA, a)
-			env.mem.Poke(zpX, x)
-			env.mem.Poke(zpY, y)
-			newA = serviceOSBYTE
-			env.cpu.SetPC(procServiceRoms)
-			env.log(fmt.Sprintf("OSBYTE%02x_to_roms(X=0x%02x,Y=0x%02x)", a, x, y))
-			// procServiceRoms issues a 254-Bad command if the command is not handled by any ROM
+			newA = osByteToRoms(env, a, x, y)
 		}
 	}
 
@@ -349,3 +594,21 @@ func execOSBYTE(env *environment) {
 		}
 	}
 }
+
+// OSBYTE calls not handled by the MOS are offered to the sideways ROMs
+func osByteToRoms(env *environment, a uint8, x uint8, y uint8) uint8 {
+	if env.isTube() {
+		// The sideways ROMs are not available on the second processor
+		env.notImplemented(fmt.Sprintf("OSBYTE%02x", a))
+		return a
+	}
+
+	// Send to the other ROMS if available.
+	env.mem.Poke(zpA, a)
+	env.mem.Poke(zpX, x)
+	env.mem.Poke(zpY, y)
+	env.cpu.SetPC(procServiceRoms)
+	env.log(fmt.Sprintf("OSBYTE%02x_to_roms(X=0x%02x,Y=0x%02x)", a, x, y))
+	// procServiceRoms issues a 254-Bad command if the command is not handled by any ROM
+	return serviceOSBYTE
+}
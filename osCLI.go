@@ -23,8 +23,11 @@ var cliCommands = []string{
 	"FX",
 	"BASIC",
 	"BYE",
+	"BREAK",     // Added for bbz
+	"CONFIGURE", // Master only
 	"CODE",
 	"DIR",
+	"DEBUG", // Added for bbz
 	"DELETE",
 	"DRIVE",
 	"EXEC",
@@ -44,13 +47,22 @@ var cliCommands = []string{
 	"RUN",
 	"ROM",
 	"ROMS",
+	"RESTORE", // Added for bbz
 	"SAVE",
+	"SNAPSHOT", // Added for bbz
 	"SPOOL",
+	"SPEED",  // Added for bbz
+	"STATUS", // Master only
 	"TAPE",
 	"TV",
 	"TYPE",
 }
 
+var masterCommands = map[string]bool{
+	"CONFIGURE": true,
+	"STATUS":    true,
+}
+
 func execOSCLI(env *environment) {
 	a, x, y, p := env.cpu.GetAXYP()
 
@@ -87,6 +99,9 @@ func execOSCLI(env *environment) {
 		if line[pos] == '.' {
 			// Expand . shortcut
 			for _, candidate := range cliCommands {
+				if masterCommands[candidate] && !env.isMaster() {
+					continue
+				}
 				if strings.HasPrefix(candidate, command) {
 					command = candidate // Full command found
 					break
@@ -114,6 +129,11 @@ func execOSCLI(env *environment) {
 
 	case "BASIC":
 		// Runs the first language ROM with no service entry
+		if env.z80 != nil {
+			// The languages are for the 6502, they are not copied to the Z80
+			env.raiseError(errorTodo, "I cannot run this code")
+			break
+		}
 		unhandled = true
 		for slot := 0xf; slot >= 0; slot-- {
 			romType := env.mem.data[mosRomTypeTable+uint16(slot)]
@@ -199,6 +219,25 @@ func execOSCLI(env *environment) {
 			deleteFile(env, filename)
 		}
 
+	case "CONFIGURE":
+		if !env.isMaster() {
+			unhandled = true
+			break
+		}
+		execCONFIGURE(env, strings.TrimSuffix(line[pos:], "\r"))
+
+	case "BREAK":
+		// *BREAK [<spec> [TRACE] | CLEAR], see breakpoints.go
+		args := strings.Fields(strings.TrimSuffix(line[pos:], "\r"))
+		err := env.debugger.breakCommand(args)
+		if err != nil {
+			env.raiseError(254, "Bad command")
+		}
+
+	case "DEBUG":
+		// Enter the monitor after the command
+		env.debugger.request("")
+
 	case "DIR":
 		path := ""
 		_, path, valid = parseFilename(line, pos)
@@ -264,6 +303,9 @@ func execOSCLI(env *environment) {
 
 	case "HELP":
 		env.con.write("\nBBZ 0.0\n")
+		if env.isTube() {
+			break
+		}
 
 		// Send to the other ROMS if available.
 		env.mem.pokeWord(zpStr, xy)
@@ -343,7 +385,7 @@ func execOSCLI(env *environment) {
 		attr := loadFile(env, filename, addressNull)
 		if attr.fileType == osFileFound {
 			if attr.hasMetadata {
-				env.cpu.SetPC(uint16(attr.executionAddress))
+				env.runCode(attr.executionAddress)
 			} else {
 				env.raiseError(errorTodo, "Missing metadata file")
 			}
@@ -380,6 +422,21 @@ func execOSCLI(env *environment) {
 		}
 		env.mem.Poke(sheilaRomLatch, currentRom)
 
+	case "RESTORE":
+		// *RESTORE <filename>, see snapshot.go
+		filename := ""
+		_, filename, valid = parseFilename(line, pos)
+		if !valid || filename == "" {
+			env.raiseError(253, "Bad String")
+			break
+		}
+		err := env.loadSnapshot(filename)
+		if os.IsNotExist(err) {
+			env.raiseError(214, "File not found")
+		} else if err != nil {
+			env.raiseError(errorTodo, err.Error())
+		}
+
 	case "SAVE":
 		// *SAVE <filename> <start addr> <end addr or length> [<exec addr>] [<reload addr>]
 		// *SAVE A 1a34+2a
@@ -437,6 +494,19 @@ func execOSCLI(env *environment) {
 
 		saveFile(env, filename, startAddress, endAddress, executionAddress, loadAddress, false)
 
+	case "SNAPSHOT":
+		// *SNAPSHOT <filename>, see snapshot.go
+		filename := ""
+		_, filename, valid = parseFilename(line, pos)
+		if !valid || filename == "" {
+			env.raiseError(253, "Bad String")
+			break
+		}
+		err := env.saveSnapshot(filename)
+		if err != nil {
+			env.raiseError(errorTodo, err.Error())
+		}
+
 	case "SPOOL":
 		// *SPOOL filename
 		// *SPOOL
@@ -458,6 +528,25 @@ func execOSCLI(env *environment) {
 			env.mem.Poke(mosSpoolFileHandle, spoolFile)
 		}
 
+	case "SPEED":
+		// *SPEED [real | <n>x | <n>MHz | unlimited], see speed.go
+		setting := strings.TrimSpace(strings.TrimSuffix(line[pos:], "\r"))
+		if setting != "" {
+			err := env.speed.set(setting)
+			if err != nil {
+				env.raiseError(254, "Bad command")
+				break
+			}
+		}
+		env.con.write(env.speed.status())
+
+	case "STATUS":
+		if !env.isMaster() {
+			unhandled = true
+			break
+		}
+		execSTATUS(env, strings.TrimSuffix(line[pos:], "\r"))
+
 	case "TAPE":
 		execOSCLIfx(env, 0x8c, line, pos)
 	case "TV":
@@ -487,7 +576,10 @@ func execOSCLI(env *environment) {
 		unhandled = true
 	}
 
-	if unhandled {
+	if unhandled && env.isTube() {
+		// The sideways ROMs are not available on the second processor
+		env.raiseError(254, "Bad command")
+	} else if unhandled {
 		// Send to the other ROMS if available.
 		env.mem.pokeWord(zpStr, xy)
 		env.cpu.SetAXYP(serviceOSCLI, x, 1, p)
@@ -217,7 +217,7 @@ func loadFile(env *environment, filename string, loadAddress uint32) *fileAttrib
 		return attr
 	}
 
-	env.mem.pokeSlice(uint16(loadAddress), uint16(len(data)), data)
+	env.pokeTransfer(loadAddress, uint16(len(data)), data)
 	return attr
 }
 
@@ -234,7 +234,7 @@ func saveFile(env *environment, filename string,
 	if blank {
 		data = make([]uint8, attr.fileSize)
 	} else {
-		data = env.mem.peekSlice(uint16(startAddress), uint16(attr.fileSize))
+		data = env.peekTransfer(startAddress, uint16(attr.fileSize))
 	}
 
 	err := os.WriteFile(filename, data, 0644)
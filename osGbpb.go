@@ -69,7 +69,7 @@ func execOSGBPB(env *environment) {
 
 		transferred := uint32(0)
 		if !error && (a == 1 || a == 2) { // Write
-			data := env.mem.peekSlice(uint16(address), uint16(count))
+			data := env.peekTransfer(address, uint16(count))
 			n, err := file.Write(data)
 			if err != nil {
 				// Error
@@ -87,7 +87,7 @@ func execOSGBPB(env *environment) {
 				error = true
 				env.log(err.Error())
 			}
-			env.mem.pokeSlice(uint16(address), uint16(n), data)
+			env.pokeTransfer(address, uint16(n), data)
 			transferred = uint32(n)
 		}
 
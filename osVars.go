@@ -43,8 +43,18 @@ func initOSVars(env *environment) {
 
 	f(0xa8, "adress of extended vector table LO", uint8(extentedVectorTableStart&0xff))
 	f(0xa9, "adress of extended vector table HI", uint8(extentedVectorTableStart>>8))
+	f(0xbc, "Current ADC channel", 0)
+	f(0xbd, "Maximum ADC channel number", adcChannels)
+	f(0xbe, "ADC conversion type", 0)
+	f(0xd2, "Sound suppression status", 0)
+	f(0xd3, "Bell channel", 3)
+	f(0xd4, "Bell amplitude/envelope", 0x90)
+	f(0xd5, "Bell pitch", 0x65)
+	f(0xd6, "Bell duration", 7)
+	f(0xd9, "Paged mode line counter", 0)
 	f(0xda, "Number of items in VDU queue", 0)
 	f(0xec, "Character output device status", 0)
+	f(0xef, "Shadow state", 1)
 
 	/*
 		This location contains a value indicating the type of the last BREAK performed.
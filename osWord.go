@@ -5,6 +5,9 @@ import (
 	"time"
 )
 
+// Format of the real time clock strings
+const rtcFormat = "Mon,02 Jan 2006.15:04:05"
+
 func execOSWORD(env *environment) {
 	a, x, y, p := env.cpu.GetAXYP()
 	xy := uint16(x) + uint16(y)<<8
@@ -39,6 +42,7 @@ func execOSWORD(env *environment) {
 		pOut := p &^ 1 // Clear carry
 		env.cpu.SetAXYP(1, x, uint8(len(line)), pOut)
 		env.vdu.mode7Reset()
+		env.vdu.inputEcho(line)
 
 		env.log(fmt.Sprintf("OSWORD00('read line',BUF=0x%04x,range=%02x-%02x, maxlen=%v) => '%s'",
 			buffer, minChar, maxChar, maxLength, line))
@@ -50,7 +54,7 @@ func execOSWORD(env *environment) {
 			X and Y registers. This clock is incremented every hundredth of a second and is
 			set to 0 by a hard BREAK.
 		*/
-		duration := time.Since(env.referenceTime)
+		duration := env.now().Sub(env.referenceTime)
 		ticks := duration.Milliseconds() / 10
 		env.mem.pokeNBytes(xy, 5, uint64(ticks))
 
@@ -63,7 +67,7 @@ func execOSWORD(env *environment) {
 		*/
 		ticks := env.mem.peekNBytes(xy, 5)
 		duration := time.Duration(ticks * 10 * uint64(time.Millisecond))
-		env.referenceTime = time.Now()
+		env.referenceTime = env.now()
 		env.referenceTime = env.referenceTime.Add(duration * -1)
 
 		env.log(fmt.Sprintf("OSWORD02('write system clock',TICKS=%v)", ticks))
@@ -73,7 +77,7 @@ func execOSWORD(env *environment) {
 			In addition to the clock there is an interval timer which is incremented every
 			hundredth of a second. The interval is stored in five bytes pointed to by X and Y.
 		*/
-		duration := time.Since(env.lastTimerUpdate)
+		duration := env.now().Sub(env.lastTimerUpdate)
 		timer := env.timer + uint64(duration.Milliseconds()/10)
 		env.mem.pokeNBytes(xy, 5, uint64(timer))
 
@@ -87,7 +91,7 @@ func execOSWORD(env *environment) {
 			after two hundredths of a second.
 		*/
 		env.timer = env.mem.peekNBytes(xy, 5)
-		env.lastTimerUpdate = time.Now()
+		env.lastTimerUpdate = env.now()
 
 		env.log(fmt.Sprintf("OSWORD04('write interval timer',TIMER=%v)", env.timer))
 
@@ -100,7 +104,7 @@ func execOSWORD(env *environment) {
 		*/
 		address := uint32(env.mem.peekWord(xy)) +
 			uint32(env.mem.peekWord(xy+2))<<16
-		value := env.mem.Peek((uint16(address)))
+		value := env.mem.peekIO(uint16(address))
 		env.mem.Poke(xy+4, value)
 
 		env.logIO(fmt.Sprintf("OSWORD05('Read I/O processor memory',ADDRESS=0x%08x) => 0x%02x",
@@ -115,7 +119,7 @@ func execOSWORD(env *environment) {
 		address := uint32(env.mem.peekWord(xy)) +
 			uint32(env.mem.peekWord(xy+2))<<16
 		value := env.mem.Peek(xy + 4)
-		env.mem.Poke(uint16(address), value)
+		env.mem.pokeIO(uint16(address), value)
 
 		env.log(fmt.Sprintf("OSWORD06('Write I/O processor memory',ADDRESS=0x%08x,VAL=0x%02x)",
 			address, value))
@@ -130,7 +134,9 @@ func execOSWORD(env *environment) {
 		amplitude := int8(env.mem.peekWord(xy + 2))
 		pitch := env.mem.peekWord(xy + 4)
 		duration := env.mem.peekWord(xy + 6)
-		// TODO: play sound
+		if env.soundEnabled() {
+			env.sound.queueSound(channel, amplitude, uint8(pitch), uint8(duration))
+		}
 
 		env.log(fmt.Sprintf("OSWORD07('Sound command',CHAN=%v,AMPL=%v,PITCH=%v,DUR=%v)",
 			channel, amplitude, pitch, duration))
@@ -142,19 +148,30 @@ func execOSWORD(env *environment) {
 			parameter block address contained in the X and Y registers.
 		*/
 		number := env.mem.Peek(xy)
-		// TODO: define envelope
+		env.sound.defineEnvelope(number, env.mem.peekSlice(xy+1, 13))
 
 		env.log(fmt.Sprintf("OSWORD08('Define envelope',NUMBER=%v)", number))
 
+	case 0x0a: // Read character definition
+		/*
+			On entry, XY contains the character whose definition is required.
+			On exit, XY+1 to XY+8 contain the eight bytes of the definition,
+			top row first.
+		*/
+		ch := env.mem.Peek(xy)
+		env.mem.pokeSlice(xy+1, 8, env.vdu.font[ch][:])
+
+		env.log(fmt.Sprintf("OSWORD0a('Read character definition',CHAR=%v)", ch))
+
 	case 0x0e: // Read Real-Time clock
 		// See https://beebwiki.mdfs.net/OSWORD_%260E
 		functionCode := env.mem.Peek(xy)
-		t := time.Now()
+		t := env.now().Add(env.rtcOffset)
 
 		switch functionCode {
 		case 0, 3: // Return clock value as string
-			value := t.Format("Mon,02 Jan 2006.15:04:05")
-			env.mem.pokeString(xy, value, 0, 21)
+			value := t.Format(rtcFormat)
+			env.mem.pokeString(xy, value, 0x0d, 24)
 		case 1, 4: // Return BCD clock value
 			env.mem.pokeBCD(xy+0, uint8(t.Year()%100))
 			env.mem.pokeBCD(xy+1, uint8(t.Month()))
@@ -164,21 +181,81 @@ func execOSWORD(env *environment) {
 			env.mem.pokeBCD(xy+5, uint8(t.Minute()))
 			env.mem.pokeBCD(xy+6, uint8(t.Second()))
 		case 2: // Convert BCD to string
-			// TODO: get the date from the BCD values
-			value := t.Format("Mon,02 Jan 2006.15:04:05")
-			env.mem.pokeString(xy, value, 0, 21)
+			// The BCD values are on XY+1 to XY+7, the day of the week is recalculated
+			year := 2000 + int(env.mem.peekBCD(xy+1))
+			if year >= 2080 {
+				year -= 100
+			}
+			bcdTime := time.Date(year,
+				time.Month(env.mem.peekBCD(xy+2)),
+				int(env.mem.peekBCD(xy+3)),
+				int(env.mem.peekBCD(xy+5)),
+				int(env.mem.peekBCD(xy+6)),
+				int(env.mem.peekBCD(xy+7)),
+				0, time.Local)
+			value := bcdTime.Format(rtcFormat)
+			env.mem.pokeString(xy, value, 0x0d, 24)
 		default:
 			sendToROMs = true
 		}
 
 		env.log(fmt.Sprintf("OSWORD0e('Read Real-Time clock',FUNCTION=%v)", functionCode))
 
+	case 0x0f: // Write Real-Time clock
+		/*
+			Master only. XY?0 is the length of the string on XY+1:
+				8  to set the time, "HH:MM:SS"
+				15 to set the date, "Day,DD Mon YYYY"
+				24 to set both, "Day,DD Mon YYYY.HH:MM:SS"
+			The host clock is not changed, an offset is kept.
+		*/
+		if !env.isMaster() {
+			sendToROMs = true
+			break
+		}
+		length := env.mem.Peek(xy)
+		value := ""
+		for i := uint16(0); i < uint16(length); i++ {
+			value += string(env.mem.Peek(xy + 1 + i))
+		}
+
+		now := env.now().Add(env.rtcOffset)
+		var t time.Time
+		var err error
+		switch length {
+		case 8:
+			t, err = time.ParseInLocation("15:04:05", value, time.Local)
+			t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local)
+		case 15:
+			t, err = time.ParseInLocation(rtcFormat[:15], value, time.Local)
+			t = time.Date(t.Year(), t.Month(), t.Day(), now.Hour(), now.Minute(), now.Second(), 0, time.Local)
+		case 24:
+			t, err = time.ParseInLocation(rtcFormat, value, time.Local)
+		default:
+			err = fmt.Errorf("bad length %v", length)
+		}
+		if err == nil {
+			env.rtcOffset = t.Sub(env.now())
+		}
+
+		env.log(fmt.Sprintf("OSWORD0f('Write Real-Time clock',VALUE='%s',VALID=%v)", value, err == nil))
+
+	case 0x7f: // Disc controller command, see disc.go
+		if !env.hasDiscs() {
+			sendToROMs = true
+			break
+		}
+		execOSWORD7F(env, xy)
+
 	default:
 		sendToROMs = true
 
 	}
 
-	if sendToROMs {
+	if sendToROMs && env.isTube() {
+		// The sideways ROMs are not available on the second processor
+		env.notImplemented(fmt.Sprintf("OSWORD%02x", a))
+	} else if sendToROMs {
 		// Send to the other ROMS if available.
 		env.mem.Poke(zpA, a)
 		env.mem.Poke(zpX, x)
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+	Snapshots of the machine state, saved with *SNAPSHOT and restored with
+	*RESTORE or with the -restore option. The file starts with a magic
+	string and a version byte followed by the state encoded with gob:
+		CPU registers and model
+		64K of RAM, the I/O processor memory on Tube mode and shadow RAM
+		sideways banks, write protection and the selected slot
+		VDU state: mode, cursor, windows, colours, palette and font
+		open files by path, open mode and pointer
+		current directory, relative to the snapshot file
+		system clock, interval timer, real time clock offset and CMOS RAM
+		lines pending of *EXEC
+	The OS variables are on RAM. The sound, ADC and user VIA state are not
+	saved, the devices keep their state.
+
+	The snapshot is taken while *SNAPSHOT is serviced. When restored, the
+	execution resumes as if *SNAPSHOT had just returned. The snapshot is
+	checked, the files reopened and the CMOS RAM saved before the state is
+	changed, the machine is unchanged if the restore fails.
+*/
+
+const (
+	snapshotMagic   = "BBZSNAP"
+	snapshotVersion = 1
+)
+
+type snapshotFile struct {
+	Handle  uint8
+	Path    string
+	Mode    uint8
+	Pointer int64
+}
+
+type snapshotVdu struct {
+	Mode                uint8
+	Shadow              bool
+	CursorX             uint8
+	CursorY             uint8
+	TextWindow          [4]uint8
+	GraphWindow         [4]int16
+	GraphOrigin         [2]int16
+	GraphCursor         [2]int16
+	OldGraphCursor      [2]int16
+	GraphPlotMode       uint8
+	GraphBackPlotMode   uint8
+	CursorStartRegister uint8
+	TextColour          uint8
+	TextBackground      uint8
+	GraphColour         uint8
+	GraphBackground     uint8
+	Palette             [16]uint8
+	Font                [256][8]uint8
+	M7fgColour          uint8
+	M7bgColour          uint8
+	M7Flash             bool
+	M7Graphics          bool
+	M7Separated         bool
+	M7Conceal           bool
+	M7Hold              bool
+	M7HeldChar          uint8
+	M7HeldSeparated     bool
+	M7DoubleHeight      bool
+	M7RowDouble         bool
+	M7BottomRow         bool
+	Printer             bool
+	TextOnGr            bool
+	Ignore              bool
+	Paged               bool
+	Queue               []uint8
+}
+
+type snapshot struct {
+	CPUModel    string
+	CPU         []uint8 // As saved by iz6502
+	ExtraCycles uint64
+
+	Memory          []uint8
+	IOMemory        []uint8 // Tube mode only
+	Tube            bool
+	TubeLanguage    [2]uint16
+	Shadow          []uint8
+	ShadowFlags     [3]bool // selected, VDU and display
+	ScreenStart     uint16
+	SidewaysRoms    [16][]uint8
+	WriteProtectRom [16]bool
+	ActiveRom       uint8
+
+	Vdu snapshotVdu
+
+	Dir   string
+	Files []snapshotFile
+
+	Clock     time.Duration // Since the reference time
+	Timer     uint64
+	RtcOffset time.Duration
+	Cmos      []uint8
+
+	ExecContent []string
+}
+
+var errZ80Snapshot = errors.New("snapshots are not available with the Z80 second processor")
+
+func (env *environment) saveSnapshot(filename string) error {
+	if env.z80 != nil {
+		return errZ80Snapshot
+	}
+	var s snapshot
+	var cpu bytes.Buffer
+	err := env.cpu.Save(&cpu)
+	if err != nil {
+		return err
+	}
+	s.CPUModel = env.cpuModel
+	s.CPU = cpu.Bytes()
+	s.ExtraCycles = env.extraCycles
+
+	mem := env.mem
+	s.Memory = mem.data[:]
+	s.IOMemory = mem.ioData
+	s.Tube = mem.tube
+	s.TubeLanguage = [2]uint16{env.tubeLanguageStart, env.tubeLanguageEnd}
+	s.Shadow = mem.shadow
+	s.ShadowFlags = [3]bool{mem.shadowSelected, mem.shadowVdu, mem.shadowDisplay}
+	s.ScreenStart = mem.screenStart
+	s.SidewaysRoms = mem.sideRom
+	s.WriteProtectRom = mem.writeProtectRom
+	s.ActiveRom = mem.activeRom
+
+	s.Vdu = env.vdu.snapshot()
+
+	s.Dir, err = snapshotDir(filename)
+	if err != nil {
+		return err
+	}
+	for i, file := range env.file {
+		if file == nil {
+			continue
+		}
+		pointer, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		path, err := filepath.Abs(file.Name())
+		if err != nil {
+			return err
+		}
+		s.Files = append(s.Files, snapshotFile{uint8(i + 1), path, env.fileMode[i], pointer})
+	}
+
+	now := env.now()
+	s.Clock = now.Sub(env.referenceTime)
+	s.Timer = env.timer + uint64(now.Sub(env.lastTimerUpdate).Milliseconds()/10)
+	s.RtcOffset = env.rtcOffset
+	s.Cmos = env.cmos.data[:]
+	s.ExecContent = env.execContent
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(file)
+	out.WriteString(snapshotMagic)
+	out.WriteByte(snapshotVersion)
+	errEncode := gob.NewEncoder(out).Encode(&s)
+	return errors.Join(errEncode, out.Flush(), file.Close())
+}
+
+func (env *environment) loadSnapshot(filename string) error {
+	if env.z80 != nil {
+		return errZ80Snapshot
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(data, []byte(snapshotMagic)) || len(data) <= len(snapshotMagic) {
+		return fmt.Errorf("%s is not a bbz snapshot", filename)
+	}
+	version := data[len(snapshotMagic)]
+	if version != snapshotVersion {
+		return fmt.Errorf("snapshot version %v not supported, version %v expected", version, snapshotVersion)
+	}
+	var s snapshot
+	err = gob.NewDecoder(bytes.NewReader(data[len(snapshotMagic)+1:])).Decode(&s)
+	if err != nil {
+		return err
+	}
+	mem := env.mem
+	if len(s.Memory) != len(mem.data) || (s.Tube && len(s.IOMemory) != len(mem.data)) ||
+		len(s.Cmos) != cmosSize {
+		return fmt.Errorf("%s is not a valid bbz snapshot", filename)
+	}
+	cpu, err := env.newCPU(s.CPUModel, env.cpu.GetTrace())
+	if err != nil {
+		return err
+	}
+	err = cpu.Load(bytes.NewReader(s.CPU))
+	if err != nil {
+		return err
+	}
+
+	var files [maxFiles]*os.File
+	var modes [maxFiles]uint8
+	closeFiles := func() {
+		for _, file := range files {
+			if file != nil {
+				file.Close()
+			}
+		}
+	}
+	for _, f := range s.Files {
+		i := f.Handle - 1
+		if i >= maxFiles {
+			continue
+		}
+		files[i], err = reopenFile(f)
+		if err != nil {
+			closeFiles()
+			return err
+		}
+		modes[i] = f.Mode
+	}
+	cmos := *env.cmos
+	copy(cmos.data[:], s.Cmos)
+	err = cmos.save()
+	if err != nil {
+		closeFiles()
+		return err
+	}
+
+	// Nothing fails from here, the state is changed
+	for i, file := range env.file {
+		if file != nil {
+			file.Close()
+		}
+		env.file[i] = files[i]
+		env.fileMode[i] = modes[i]
+	}
+	dir := s.Dir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(filename), dir)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		env.log(fmt.Sprintf("Snapshot directory not restored: %s", err))
+	}
+
+	env.cpu = cpu
+	env.cpuModel = s.CPUModel
+	env.extraCycles = s.ExtraCycles
+
+	copy(mem.data[:], s.Memory)
+	mem.ioData = s.IOMemory
+	mem.tube = s.Tube
+	env.tubeLanguageStart = s.TubeLanguage[0]
+	env.tubeLanguageEnd = s.TubeLanguage[1]
+	mem.shadow = s.Shadow
+	mem.shadowSelected = s.ShadowFlags[0]
+	mem.shadowVdu = s.ShadowFlags[1]
+	mem.shadowDisplay = s.ShadowFlags[2]
+	mem.screenStart = s.ScreenStart
+	mem.sideRom = s.SidewaysRoms
+	mem.writeProtectRom = s.WriteProtectRom
+	mem.selectRom(s.ActiveRom)
+
+	env.vdu.restore(s.Vdu)
+
+	now := env.now()
+	env.referenceTime = now.Add(-s.Clock)
+	env.timer = s.Timer
+	env.lastTimerUpdate = now
+	env.rtcOffset = s.RtcOffset
+	*env.cmos = cmos
+	env.execContent = s.ExecContent
+	env.speed.pause()
+	return nil
+}
+
+// Current directory relative to the directory of the snapshot file if possible
+func snapshotDir(filename string) (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	base, err := filepath.Abs(filepath.Dir(filename))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(base, dir)
+	if err != nil {
+		return dir, nil
+	}
+	return rel, nil
+}
+
+// Open again a file of a snapshot, without truncating the files for output
+func reopenFile(f snapshotFile) (*os.File, error) {
+	flag := os.O_RDWR
+	if f.Mode == 0x40 {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(f.Path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Seek(f.Pointer, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (v *vdu) snapshot() snapshotVdu {
+	return snapshotVdu{
+		Mode:                v.mode,
+		Shadow:              v.shadow,
+		CursorX:             v.cursorX,
+		CursorY:             v.cursorY,
+		TextWindow:          v.textWindow,
+		GraphWindow:         v.graphWindow,
+		GraphOrigin:         v.graphOrigin,
+		GraphCursor:         v.graphCursor,
+		OldGraphCursor:      v.oldGraphCursor,
+		GraphPlotMode:       v.graphPlotMode,
+		GraphBackPlotMode:   v.graphBackPlotMode,
+		CursorStartRegister: v.cursorStartRegister,
+		TextColour:          v.textColour,
+		TextBackground:      v.textBackground,
+		GraphColour:         v.graphColour,
+		GraphBackground:     v.graphBackground,
+		Palette:             v.palette,
+		Font:                v.font,
+		M7fgColour:          v.m7fgColour,
+		M7bgColour:          v.m7bgColour,
+		M7Flash:             v.m7Flash,
+		M7Graphics:          v.m7Graphics,
+		M7Separated:         v.m7Separated,
+		M7Conceal:           v.m7Conceal,
+		M7Hold:              v.m7Hold,
+		M7HeldChar:          v.m7HeldChar,
+		M7HeldSeparated:     v.m7HeldSeparated,
+		M7DoubleHeight:      v.m7DoubleHeight,
+		M7RowDouble:         v.m7RowDouble,
+		M7BottomRow:         v.m7BottomRow,
+		Printer:             v.printer,
+		TextOnGr:            v.textOnGr,
+		Ignore:              v.ignore,
+		Paged:               v.paged,
+		Queue:               v.queue,
+	}
+}
+
+func (v *vdu) restore(s snapshotVdu) {
+	v.mode = s.Mode
+	v.shadow = s.Shadow
+	v.cursorX = s.CursorX
+	v.cursorY = s.CursorY
+	v.textWindow = s.TextWindow
+	v.graphWindow = s.GraphWindow
+	v.graphOrigin = s.GraphOrigin
+	v.graphCursor = s.GraphCursor
+	v.oldGraphCursor = s.OldGraphCursor
+	v.graphPlotMode = s.GraphPlotMode
+	v.graphBackPlotMode = s.GraphBackPlotMode
+	v.cursorStartRegister = s.CursorStartRegister
+	v.textColour = s.TextColour
+	v.textBackground = s.TextBackground
+	v.graphColour = s.GraphColour
+	v.graphBackground = s.GraphBackground
+	v.palette = s.Palette
+	v.font = s.Font
+	v.m7fgColour = s.M7fgColour
+	v.m7bgColour = s.M7bgColour
+	v.m7Flash = s.M7Flash
+	v.m7Graphics = s.M7Graphics
+	v.m7Separated = s.M7Separated
+	v.m7Conceal = s.M7Conceal
+	v.m7Hold = s.M7Hold
+	v.m7HeldChar = s.M7HeldChar
+	v.m7HeldSeparated = s.M7HeldSeparated
+	v.m7DoubleHeight = s.M7DoubleHeight
+	v.m7RowDouble = s.M7RowDouble
+	v.m7BottomRow = s.M7BottomRow
+	v.printer = s.Printer
+	v.textOnGr = s.TextOnGr
+	v.ignore = s.Ignore
+	v.paged = s.Paged
+	v.queue = s.Queue
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	dir := t.TempDir()
+	snapshotFile := filepath.Join(dir, "state.snp")
+	dataFile := filepath.Join(dir, "data")
+
+	out := integrationTestBasic([]string{
+		"A%=42:MODE 4:VDU 28,2,20,30,5",
+		"F%=OPENOUT \"" + dataFile + "\":BPUT#F%,65",
+		"*SNAPSHOT " + snapshotFile,
+		"PRINT \"A%=\";A%;\" X=\";POS",
+		"A%=7:BPUT#F%,66",
+		"*RESTORE " + snapshotFile,
+		"PRINT \"A%=\";A%",
+		"BPUT#F%,67:CLOSE#F%",
+	})
+
+	if !strings.Contains(out, "A%=42\n") {
+		t.Log(out)
+		t.Error("The variables were not restored")
+	}
+	data, err := os.ReadFile(dataFile)
+	if err != nil || string(data) != "AC" {
+		t.Errorf("The file pointer was not restored, the file has %q", data)
+	}
+
+	// Resume on a new machine
+	var env *environment
+	out = integrationTestBasicWithSetup([]string{
+		"PRINT \"A%=\";A%;\" MODE=\";?&355",
+		"CLOSE#F%",
+	}, func(e *environment) {
+		env = e
+		err := env.loadSnapshot(snapshotFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.restored = true
+	})
+
+	if !strings.Contains(out, "A%=42 MODE=4\n") {
+		t.Log(out)
+		t.Error("The snapshot was not resumed")
+	}
+	if env.vdu.textWindow != [4]uint8{2, 20, 30, 5} {
+		t.Errorf("The text window was not restored: %v", env.vdu.textWindow)
+	}
+}
+
+func TestSnapshotRestoreFailed(t *testing.T) {
+	dir := t.TempDir()
+	snapshotFile := filepath.Join(dir, "state.snp")
+	dataFile := filepath.Join(dir, "data")
+
+	integrationTestBasic([]string{
+		"A%=42",
+		"*SNAPSHOT " + snapshotFile,
+	})
+
+	// A snapshot with a CPU that can't be created
+	data, err := os.ReadFile(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s snapshot
+	err = gob.NewDecoder(bytes.NewReader(data[len(snapshotMagic)+1:])).Decode(&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.CPUModel = "z80"
+	var bad bytes.Buffer
+	bad.WriteString(snapshotMagic)
+	bad.WriteByte(snapshotVersion)
+	err = gob.NewEncoder(&bad).Encode(&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(snapshotFile, bad.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := integrationTestBasic([]string{
+		"A%=7:MODE 4:F%=OPENOUT \"" + dataFile + "\"",
+		"*RESTORE " + snapshotFile,
+		"PRINT \"A%=\";A%;\" MODE=\";?&355",
+		"BPUT#F%,65:CLOSE#F%",
+	})
+
+	if !strings.Contains(out, "unknown CPU 'z80'") {
+		t.Log(out)
+		t.Error("The restore should fail with the CPU")
+	}
+	if !strings.Contains(out, "A%=7 MODE=4\n") {
+		t.Log(out)
+		t.Error("The machine should be unchanged after a failed restore")
+	}
+	data, err = os.ReadFile(dataFile)
+	if err != nil || string(data) != "A" {
+		t.Errorf("The open files should be kept after a failed restore, the file has %q", data)
+	}
+}
+
+func TestSnapshotBadFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bad.snp")
+	err := os.WriteFile(file, []byte("not a snapshot"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := integrationTestBasic([]string{
+		"*RESTORE " + file,
+		"*RESTORE " + file + ".missing",
+	})
+
+	if !strings.Contains(out, "is not a bbz snapshot") {
+		t.Log(out)
+		t.Error("A bad snapshot should fail")
+	}
+	if !strings.Contains(out, "File not found") {
+		t.Log(out)
+		t.Error("A missing snapshot should fail")
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+	Sound system modelled after the MOS 1.20 sound driver and the SN76489 chip.
+
+	The MOS updates the sound channels every centisecond. We do the same,
+	rendering the centiseconds elapsed since the last update when the program
+	calls a sound related MOS function. When a channel queue is full, SOUND
+	waits; here the audio time is advanced instead of waiting.
+
+	The time is the time of the machine, the cycles executed at 2MHz, see
+	clock.go. The sound rendered with -sound-out doesn't depend on the host
+	speed nor on the time waiting for input. A live player needs the sound
+	in real time and uses the host clock.
+
+	Channel 0 is the noise generator, 1 to 3 the tone generators.
+
+	See:
+		BBC Microcomputer User Guide, SOUND and ENVELOPE
+		https://beebwiki.mdfs.net/OSWORD_%2607
+		https://beebwiki.mdfs.net/OSWORD_%2608
+		https://www.smspower.org/Development/SN76489
+*/
+
+const (
+	soundChannels      = 4
+	soundQueueSize     = 4 // Notes waiting on each channel, the playing one not included
+	soundEnvelopes     = 16
+	soundSampleRate    = 44100
+	soundSamplesPerCs  = soundSampleRate / 100
+	soundMaxBlockingCs = 60 * 100 * 10 // Don't wait more than 10 minutes for a free slot
+	soundInfinite      = -1
+
+	envelopeStepLength = 0
+	envelopePitchDelta = 1 // 3 sections, signed
+	envelopePitchSteps = 4 // 3 sections
+	envelopeAttack     = 7 // Attack, decay, sustain and release, signed
+	envelopeTargetA    = 11
+	envelopeTargetD    = 12
+	envelopeMaxAmp     = 126
+
+	phaseAttack  = 0
+	phaseDecay   = 1
+	phaseSustain = 2
+	phaseRelease = 3
+)
+
+type soundNote struct {
+	amplitude int8 // -15 to 0 or envelope 1 to 16
+	pitch     uint8
+	duration  uint8 // In 1/20 seconds, 255 is forever
+	hold      bool
+	sync      uint8
+}
+
+type soundChannel struct {
+	queue []soundNote
+
+	active    bool
+	note      soundNote
+	remaining int // centiseconds to the end of the duration
+	releasing bool
+
+	// Envelope
+	envelope     *[13]uint8
+	stepCounter  int
+	ampPhase     int
+	amp          int // 0 to 126
+	pitchSection int
+	pitchStep    int
+
+	pitch  int
+	volume int // 0 to 15
+
+	// Synthesis
+	phase      float64
+	noiseShift uint16
+}
+
+type soundSystem struct {
+	channels  [soundChannels]soundChannel
+	envelopes [soundEnvelopes][13]uint8
+	sink      audioSink
+
+	startTime  time.Time
+	renderedCs uint64 // Centiseconds rendered
+	advancedCs uint64 // Centiseconds advanced ahead of the clock
+	buffer     []int16
+
+	// Time of the machine, see clock.go. The host clock if nil.
+	clock func() time.Duration
+
+	// A live sink is fed from a goroutine even when the program is not calling the MOS
+	mutex    sync.Mutex
+	liveDone chan bool
+}
+
+func newSoundSystem() *soundSystem {
+	var s soundSystem
+	s.startTime = time.Now()
+	s.buffer = make([]int16, soundSamplesPerCs)
+	for i := range s.channels {
+		s.channels[i].noiseShift = 0x4000
+	}
+	return &s
+}
+
+// Render the sound in real time for a live sink
+func (s *soundSystem) startLive() {
+	// The player needs the sound in real time, the host clock is used
+	s.clock = nil
+	s.startTime = time.Now()
+	s.liveDone = make(chan bool)
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.liveDone:
+				return
+			case <-ticker.C:
+				s.mutex.Lock()
+				s.update()
+				s.mutex.Unlock()
+			}
+		}
+	}()
+}
+
+func (s *soundSystem) close() error {
+	if s.liveDone != nil {
+		close(s.liveDone)
+		s.liveDone = nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.update()
+
+	// Play the queued notes to the end
+	for i := 0; i < soundMaxBlockingCs && s.isBusy(); i++ {
+		s.tick()
+	}
+
+	var err error
+	if s.sink != nil {
+		err = s.sink.close()
+		s.sink = nil
+	}
+	return err
+}
+
+func (s *soundSystem) now() uint64 {
+	elapsed := time.Since(s.startTime)
+	if s.clock != nil {
+		elapsed = s.clock()
+	}
+	return uint64(elapsed.Milliseconds()/10) + s.advancedCs
+}
+
+// Render up to the current time
+func (s *soundSystem) update() {
+	now := s.now()
+	for s.renderedCs < now {
+		s.tick()
+	}
+}
+
+func (s *soundSystem) isBusy() bool {
+	for i := range s.channels {
+		c := &s.channels[i]
+		if len(c.queue) > 0 ||
+			(c.active && c.remaining > 0) ||
+			(c.active && c.releasing && c.volume > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *soundSystem) queueSound(channel uint16, amplitude int8, pitch uint8, duration uint8) bool {
+	/*
+		The channel parameter is &HSFN:
+			N: channel number 0 to 3
+			F: 1 to flush the channel queue and play the note now
+			S: number of other channels to synchronise with
+			H: 1 to hold, the previous note continues its release phase
+	*/
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.update()
+
+	c := &s.channels[channel&0x3]
+	note := soundNote{
+		amplitude: amplitude,
+		pitch:     pitch,
+		duration:  duration,
+		sync:      uint8(channel>>8) & 0x3,
+		hold:      (channel>>12)&0xf != 0,
+	}
+
+	if (channel>>4)&0xf != 0 {
+		c.flush()
+	}
+
+	for i := 0; len(c.queue) >= soundQueueSize; i++ {
+		if i == soundMaxBlockingCs {
+			// The channel queue is not progressing, the note is lost
+			return false
+		}
+		s.tick()
+		s.advancedCs++
+	}
+
+	c.queue = append(c.queue, note)
+	return true
+}
+
+// Empty the queue and stop the note playing on the channel
+func (s *soundSystem) flush(channel uint8) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.update()
+	s.channels[channel&0x3].flush()
+}
+
+// Notes that can be queued on the channel without waiting
+func (s *soundSystem) freeSlots(channel uint8) uint8 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.update()
+	return uint8(soundQueueSize - len(s.channels[channel&0x3].queue))
+}
+
+func (s *soundSystem) defineEnvelope(number uint8, params []uint8) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if number >= 1 && number <= soundEnvelopes {
+		copy(s.envelopes[number-1][:], params)
+	}
+}
+
+func (env *environment) soundEnabled() bool {
+	// OSBYTE &D2, any value other than 0 suppresses the sound
+	return env.mem.Peek(mosSoundSuppression) == 0
+}
+
+func (env *environment) bell() {
+	/*
+		VDU 7 plays the bell as configured with:
+			OSBYTE &D3: channel, 3 by default
+			OSBYTE &D4: amplitude or envelope, &90 by default
+			OSBYTE &D5: pitch, &65 by default
+			OSBYTE &D6: duration, 7 by default
+	*/
+	if !env.soundEnabled() {
+		return
+	}
+	channel := uint16(env.mem.Peek(mosBellChannel) & 0x07)
+	amplitude := bellAmplitude(env.mem.Peek(mosBellInfo))
+	pitch := env.mem.Peek(mosBellPitch)
+	duration := env.mem.Peek(mosBellDuration)
+	env.sound.queueSound(channel, amplitude, pitch, duration)
+
+	env.log(fmt.Sprintf("BELL(CHAN=%v,AMPL=%v,PITCH=%v,DUR=%v)", channel, amplitude, pitch, duration))
+}
+
+func bellAmplitude(info uint8) int8 {
+	/*
+		The bell info uses the bits 3 to 7 as stored on the MOS sound queue:
+			&00 to &78: envelopes 1 to 16
+			&80 to &F8: amplitudes, &90 is -15
+	*/
+	if info&0x80 == 0 {
+		return int8(info>>3) + 1
+	}
+	amplitude := int8(info)>>3 - 1
+	if amplitude < -15 {
+		amplitude = -15
+	}
+	return amplitude
+}
+
+func (s *soundSystem) tick() {
+	s.startNotes()
+
+	for i := range s.buffer {
+		s.buffer[i] = 0
+	}
+	for i := range s.channels {
+		s.render(i)
+	}
+	if s.sink != nil {
+		s.sink.write(s.buffer)
+	}
+
+	for i := range s.channels {
+		s.channels[i].advance()
+	}
+	s.renderedCs++
+}
+
+func (s *soundSystem) startNotes() {
+	var syncReady [soundChannels]uint8
+	for i := range s.channels {
+		c := &s.channels[i]
+		if !c.isFree() || len(c.queue) == 0 {
+			continue
+		}
+
+		note := c.queue[0]
+		if note.hold {
+			// The release phase of the previous note continues
+			c.queue = c.queue[1:]
+			c.note.duration = note.duration
+			c.remaining = durationCs(note.duration)
+			c.active = true
+			c.releasing = true
+			c.ampPhase = phaseRelease
+		} else if note.sync == 0 {
+			c.queue = c.queue[1:]
+			c.start(note, s.envelopes[:])
+		} else {
+			syncReady[note.sync]++
+		}
+	}
+
+	// Synchronised notes start together when all the channels are ready
+	for sync := uint8(1); sync <= 3; sync++ {
+		if syncReady[sync] < sync+1 {
+			continue
+		}
+		for i := range s.channels {
+			c := &s.channels[i]
+			if c.isFree() && len(c.queue) > 0 && !c.queue[0].hold && c.queue[0].sync == sync {
+				note := c.queue[0]
+				c.queue = c.queue[1:]
+				c.start(note, s.envelopes[:])
+			}
+		}
+	}
+}
+
+func durationCs(duration uint8) int {
+	if duration == 255 {
+		return soundInfinite
+	}
+	return int(duration) * 5
+}
+
+func (c *soundChannel) flush() {
+	c.queue = nil
+	c.active = false
+	c.volume = 0
+}
+
+func (c *soundChannel) isFree() bool {
+	// A note in the release phase is interrupted by the next note
+	return !c.active || (c.releasing && c.remaining == 0)
+}
+
+func (c *soundChannel) start(note soundNote, envelopes [][13]uint8) {
+	c.note = note
+	c.active = true
+	c.releasing = false
+	c.remaining = durationCs(note.duration)
+	c.pitch = int(note.pitch)
+	if note.amplitude > 0 {
+		c.envelope = &envelopes[(note.amplitude-1)%soundEnvelopes]
+		c.stepCounter = 0
+		c.ampPhase = phaseAttack
+		c.amp = 0
+		c.pitchSection = 0
+		c.pitchStep = 0
+		c.volume = 0
+	} else {
+		c.envelope = nil
+		c.volume = int(-note.amplitude)
+	}
+}
+
+func (c *soundChannel) advance() {
+	if !c.active {
+		return
+	}
+
+	if c.envelope != nil {
+		c.stepCounter++
+		stepLength := int(c.envelope[envelopeStepLength] & 0x7f)
+		if stepLength == 0 {
+			stepLength = 1
+		}
+		if c.stepCounter >= stepLength {
+			c.stepCounter = 0
+			c.envelopeStep()
+		}
+	}
+
+	if c.remaining > 0 {
+		c.remaining--
+	}
+	if c.remaining == 0 {
+		if c.envelope != nil && c.amp > 0 {
+			if !c.releasing {
+				c.releasing = true
+				c.ampPhase = phaseRelease
+			}
+		} else {
+			c.active = false
+			c.volume = 0
+		}
+	}
+}
+
+func (c *soundChannel) envelopeStep() {
+	e := c.envelope
+
+	// Pitch envelope, three sections
+	for tries := 0; tries < 3 && c.pitchStep >= int(e[envelopePitchSteps+c.pitchSection]); tries++ {
+		c.pitchStep = 0
+		c.pitchSection++
+		if c.pitchSection == 3 {
+			if e[envelopeStepLength]&0x80 != 0 {
+				// No auto repeat
+				c.pitchSection = 2
+				c.pitchStep = int(e[envelopePitchSteps+2])
+				break
+			}
+			c.pitchSection = 0
+		}
+	}
+	if c.pitchStep < int(e[envelopePitchSteps+c.pitchSection]) {
+		c.pitch = (c.pitch + int(int8(e[envelopePitchDelta+c.pitchSection]))) & 0xff
+		c.pitchStep++
+	}
+
+	// Amplitude envelope
+	delta := int(int8(e[envelopeAttack+c.ampPhase]))
+	switch c.ampPhase {
+	case phaseAttack, phaseDecay:
+		target := int(e[envelopeTargetA+c.ampPhase])
+		c.amp += delta
+		if (delta >= 0 && c.amp >= target) || (delta < 0 && c.amp <= target) {
+			c.amp = target
+			c.ampPhase++
+		}
+	case phaseSustain, phaseRelease:
+		c.amp += delta
+	}
+	if c.amp < 0 {
+		c.amp = 0
+	} else if c.amp > envelopeMaxAmp {
+		c.amp = envelopeMaxAmp
+	}
+
+	if c.ampPhase == phaseRelease && c.amp == 0 {
+		c.active = false
+	}
+	c.volume = c.amp / 8
+}
+
+func pitchFrequency(pitch int) float64 {
+	// Quarter semitones, 53 is middle C and 89 is A 440Hz
+	return 440 * math.Pow(2, float64(pitch-89)/48)
+}
+
+var volumeLevels [16]float64
+
+func init() {
+	// The SN76489 attenuates 2dB on each step
+	for i := 1; i < 16; i++ {
+		volumeLevels[i] = math.Pow(10, -float64(15-i)*2/20)
+	}
+}
+
+func (s *soundSystem) render(channel int) {
+	c := &s.channels[channel]
+	if !c.active || c.volume == 0 || s.sink == nil {
+		return
+	}
+	level := volumeLevels[c.volume] * 8000
+
+	if channel != 0 {
+		// Square wave tone
+		step := pitchFrequency(c.pitch) / soundSampleRate
+		for i := range s.buffer {
+			c.phase += step
+			c.phase -= math.Floor(c.phase)
+			if c.phase < 0.5 {
+				s.buffer[i] += int16(level)
+			} else {
+				s.buffer[i] -= int16(level)
+			}
+		}
+		return
+	}
+
+	/*
+		Noise, the pitch selects the type:
+			0 to 3: periodic noise
+			4 to 7: white noise
+		and the shift rate, high, medium, low or the frequency of channel 1.
+	*/
+	var rate float64
+	switch c.pitch & 3 {
+	case 0:
+		rate = 4000000.0 / 512
+	case 1:
+		rate = 4000000.0 / 1024
+	case 2:
+		rate = 4000000.0 / 2048
+	case 3:
+		rate = pitchFrequency(s.channels[1].pitch)
+	}
+	white := c.pitch&4 != 0
+	step := rate / soundSampleRate
+	for i := range s.buffer {
+		c.phase += step
+		for c.phase >= 1 {
+			c.phase--
+			var feedback uint16
+			if white {
+				feedback = (c.noiseShift ^ c.noiseShift>>1) & 1
+			} else {
+				feedback = c.noiseShift & 1
+			}
+			c.noiseShift = c.noiseShift>>1 | feedback<<14
+		}
+		if c.noiseShift&1 != 0 {
+			s.buffer[i] += int16(level)
+		} else {
+			s.buffer[i] -= int16(level)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Destination of the 16 bits mono PCM samples generated by the sound system
+type audioSink interface {
+	write(samples []int16)
+	close() error
+}
+
+/*
+WAV file sink. The sizes on the header are updated when the file is closed.
+The first write error is kept and returned by close().
+See http://soundfile.sapp.org/doc/WaveFormat/
+*/
+type wavSink struct {
+	file    *os.File
+	samples uint32
+	err     error
+}
+
+func newWavSink(filename string) (*wavSink, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var w wavSink
+	w.file = file
+	err = w.writeHeader()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &w, nil
+}
+
+func (w *wavSink) writeHeader() error {
+	dataSize := w.samples * 2
+	header := []interface{}{
+		[4]byte{'R', 'I', 'F', 'F'},
+		uint32(36 + dataSize),
+		[4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '},
+		uint32(16),              // Size of the fmt chunk
+		uint16(1),               // PCM
+		uint16(1),               // Mono
+		uint32(soundSampleRate), // Sample rate
+		uint32(soundSampleRate * 2),
+		uint16(2),  // Block align
+		uint16(16), // Bits per sample
+		[4]byte{'d', 'a', 't', 'a'},
+		dataSize,
+	}
+	for _, field := range header {
+		err := binary.Write(w.file, binary.LittleEndian, field)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *wavSink) write(samples []int16) {
+	if w.file == nil || w.err != nil {
+		return
+	}
+	w.err = binary.Write(w.file, binary.LittleEndian, samples)
+	w.samples += uint32(len(samples))
+}
+
+func (w *wavSink) close() error {
+	if w.file == nil {
+		return w.err
+	}
+	if w.err == nil {
+		_, w.err = w.file.Seek(0, io.SeekStart)
+	}
+	if w.err == nil {
+		w.err = w.writeHeader()
+	}
+	err := w.file.Close()
+	if w.err == nil {
+		w.err = err
+	}
+	w.file = nil
+	return w.err
+}
+
+// Raw PCM file sink, 16 bits signed little endian, mono
+type rawSink struct {
+	file *os.File
+	err  error
+}
+
+func newRawSink(filename string) (*rawSink, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &rawSink{file: file}, nil
+}
+
+func (r *rawSink) write(samples []int16) {
+	if r.file == nil || r.err != nil {
+		return
+	}
+	r.err = binary.Write(r.file, binary.LittleEndian, samples)
+}
+
+func (r *rawSink) close() error {
+	if r.file == nil {
+		return r.err
+	}
+	err := r.file.Close()
+	if r.err == nil {
+		r.err = err
+	}
+	r.file = nil
+	return r.err
+}
+
+/*
+Pipe sink, the samples are sent as raw PCM to the standard input of a host
+command that plays them, like aplay or pw-play.
+*/
+type pipeSink struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+var knownPlayers = map[string][]string{
+	"aplay":   {"aplay", "-q", "-t", "raw", "-f", "S16_LE", "-c", "1", "-r", fmt.Sprint(soundSampleRate)},
+	"pw-play": {"pw-play", "--format", "s16", "--channels", "1", "--rate", fmt.Sprint(soundSampleRate), "-"},
+	"paplay":  {"paplay", "--raw", "--format", "s16le", "--channels", "1", "--rate", fmt.Sprint(soundSampleRate)},
+}
+
+func newPipeSink(command string) (*pipeSink, error) {
+	args, ok := knownPlayers[command]
+	if !ok {
+		args = strings.Fields(command)
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty audio player command")
+	}
+
+	var p pipeSink
+	p.cmd = exec.Command(args[0], args[1:]...)
+	p.cmd.Stderr = os.Stderr
+	stdin, err := p.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	p.stdin = stdin
+	err = p.cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (p *pipeSink) write(samples []int16) {
+	if p.stdin == nil {
+		return
+	}
+	err := binary.Write(p.stdin, binary.LittleEndian, samples)
+	if err != nil {
+		// The player is gone, continue silently
+		p.stdin.Close()
+		p.stdin = nil
+	}
+}
+
+// The player errors are not reported, it may have been closed by the user
+func (p *pipeSink) close() error {
+	if p.stdin != nil {
+		p.stdin.Close()
+		p.stdin = nil
+	}
+	if p.cmd != nil {
+		p.cmd.Wait()
+		p.cmd = nil
+	}
+	return nil
+}
+
+// Null sink, the sound is generated and discarded
+type nullSink struct{}
+
+func (nullSink) write(samples []int16) {}
+func (nullSink) close() error          { return nil }
+
+// Sends the samples to several sinks
+type teeSink []audioSink
+
+func (t teeSink) write(samples []int16) {
+	for _, sink := range t {
+		sink.write(samples)
+	}
+}
+
+// Closes all the sinks and returns the first error
+func (t teeSink) close() error {
+	var first error
+	for _, sink := range t {
+		err := sink.close()
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Creates the file sink, WAV for the .wav extension and raw PCM otherwise
+func newFileSink(filename string) (audioSink, error) {
+	if strings.EqualFold(filepath.Ext(filename), ".wav") {
+		return newWavSink(filename)
+	}
+	return newRawSink(filename)
+}
+
+// Creates the live sink, null or a player command
+func newLiveSink(player string) (audioSink, error) {
+	if player == "null" {
+		return nullSink{}, nil
+	}
+	return newPipeSink(player)
+}
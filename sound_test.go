@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func integrationTestSound(t *testing.T, lines []string) []int16 {
+	filename := filepath.Join(t.TempDir(), "sound.wav")
+	sink, err := newWavSink(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var env *environment
+	integrationTestBasicWithSetup(lines, func(e *environment) {
+		env = e
+		env.sound.sink = sink
+	})
+	err = env.sound.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		t.Fatal("Not a WAV file")
+	}
+	samples := make([]int16, (len(data)-44)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(data[44+i*2:]))
+	}
+	return samples
+}
+
+func TestWavSinkWriteError(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "sound.wav")
+	sink, err := newWavSink(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is gone under the sink, the error is kept for close()
+	sink.file.Close()
+	sink.write(make([]int16, 100))
+	err = sink.close()
+	if err == nil {
+		t.Error("The write error is not reported")
+	}
+}
+
+// First sample playing, the sound starts when the program calls SOUND
+func soundStart(samples []int16) int {
+	for i, sample := range samples {
+		if sample != 0 {
+			return i
+		}
+	}
+	return len(samples)
+}
+
+func TestSoundQueue(t *testing.T) {
+	samples := integrationTestSound(t, []string{
+		"FOR I%=1 TO 8:SOUND 1,-15,53+I%*4,10:NEXT",
+	})
+
+	// Eight notes of half a second one after the other
+	start := soundStart(samples)
+	if len(samples)-start < 8*soundSampleRate/2 {
+		t.Errorf("The sound is too short, %v samples", len(samples)-start)
+	}
+	if start > 5*soundSamplesPerCs || samples[start+100] == 0 {
+		t.Error("The first note is not playing")
+	}
+}
+
+func TestSoundEnvelope(t *testing.T) {
+	samples := integrationTestSound(t, []string{
+		"ENVELOPE 1,1,0,0,0,0,0,0,126,-1,0,-1,126,0",
+		"SOUND 1,1,89,20",
+	})
+
+	// Immediate attack, decay for the 1 second duration and release until inaudible
+	start := soundStart(samples)
+	if start > 5*soundSamplesPerCs || samples[start+soundSamplesPerCs+10] == 0 {
+		t.Error("The attack is wrong")
+	}
+	length := len(samples) - start
+	if length < 115*soundSamplesPerCs || length > 128*soundSamplesPerCs {
+		t.Errorf("The sound has the wrong length, %v samples", length)
+	}
+}
+
+func TestSoundBell(t *testing.T) {
+	samples := integrationTestSound(t, []string{
+		"*FX213,89",
+		"VDU 7",
+	})
+
+	// The default bell lasts 7/20 seconds
+	if len(samples) < 35*soundSamplesPerCs {
+		t.Errorf("The bell is too short, %v samples", len(samples))
+	}
+	if samples[len(samples)-100] == 0 {
+		t.Error("The bell is not playing")
+	}
+}
+
+func TestSoundEmulatedTime(t *testing.T) {
+	lines := []string{
+		"SOUND 1,-15,53,5:FOR I%=1 TO 2000:NEXT:SOUND 2,-15,89,5",
+		"A=INKEY(10):SOUND 3,-15,101,5",
+	}
+	samples := integrationTestSound(t, lines)
+	again := integrationTestSound(t, lines)
+
+	// The sound follows the cycles executed, not the host clock
+	if len(samples) != len(again) {
+		t.Fatalf("The renders should be equal, %v and %v samples", len(samples), len(again))
+	}
+	for i := range samples {
+		if samples[i] != again[i] {
+			t.Fatalf("The renders differ on sample %v", i)
+		}
+	}
+}
+
+func TestSoundSuppressed(t *testing.T) {
+	samples := integrationTestSound(t, []string{
+		"*FX210,1",
+		"VDU 7",
+		"SOUND 1,-15,53,20",
+	})
+
+	for i, sample := range samples {
+		if sample != 0 {
+			t.Errorf("Sound with OSBYTE &D2 suppression, sample %v", i)
+			break
+		}
+	}
+}
+
+func TestSoundBuffers(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"PRINT ADVAL(-6)",
+		"FOR I%=1 TO 6:SOUND 1,-15,53,100:NEXT",
+		"PRINT ADVAL(-6)",
+		"*FX21,5",
+		"PRINT ADVAL(-6)",
+	})
+
+	if !strings.Contains(out, "PRINT ADVAL(-6)\n         4\n") {
+		t.Error("The empty channel should have 4 free slots")
+	}
+	if !strings.Contains(out, "NEXT\n>PRINT ADVAL(-6)\n         0\n") {
+		t.Error("The full channel should have no free slots")
+	}
+	if !strings.Contains(out, "*FX21,5\n>PRINT ADVAL(-6)\n         4\n") {
+		t.Error("The flushed channel should have 4 free slots")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Speed of the emulated CPU, set with -speed or *SPEED:
+		real       2MHz, as the BBC Micro
+		<n>x       a multiple of 2MHz, as 4x
+		<n>MHz     a frequency, as 8MHz
+		unlimited  as fast as possible, the default
+
+	The execution is throttled comparing the cycles executed with the host
+	time, every centisecond of the target speed. The MOS calls serviced by
+	bbz take no cycles on the CPU, the approximate cost of the MOS 1.20
+	routines is added instead. Disc access times are not modelled.
+
+	The MOS costs are added on every speed, unlimited included. They
+	advance the cycle count seen by the deterministic clock, the user VIA
+	timers and the MOS trace, as the MOS routines would on a BBC Micro.
+
+	The MOS calls taking long on the host, as waiting for a key, and the
+	stops on the monitor are pauses: the throttling restarts after them and
+	they are not counted for the effective speed shown by *SPEED.
+*/
+
+const (
+	speedUnlimited       = "unlimited"
+	speedUnlimitedCheck  = 20_000 // Cycles between checks without throttling
+	speedPauseThreshold  = 10 * time.Millisecond
+	mosCallDefaultCycles = 100
+)
+
+// Approximate cycles taken by the MOS 1.20 routines
+var mosCallCycles = map[uint16]uint64{
+	epWRCH:   250, // A char on mode 7, more on the graphics modes and on scroll
+	epRDCH:   60,
+	epBYTE:   120,
+	epWORD:   300,
+	epCLI:    2000,
+	epFILE:   3000,
+	epFIND:   2000,
+	epGBPB:   1000,
+	epARGS:   200,
+	epBGET:   150,
+	epBPUT:   150,
+	epGSINIT: 60,
+	epGSREAD: 40,
+	epSYSBRK: 150,
+}
+
+type speedControl struct {
+	env     *environment
+	setting string
+	hz      float64 // Target frequency, 0 if unlimited
+
+	// Throttling from the last sync point
+	syncCycles uint64
+	syncTime   time.Time
+	nextCheck  uint64
+
+	// Effective speed, without the pauses
+	runCycles  uint64
+	runTime    time.Duration
+	lastCycles uint64
+	lastTime   time.Time
+
+	mosStart time.Time
+}
+
+func newSpeedControl(env *environment) *speedControl {
+	var s speedControl
+	s.env = env
+	s.set(speedUnlimited)
+	return &s
+}
+
+func (s *speedControl) set(setting string) error {
+	hz, err := parseSpeed(setting)
+	if err != nil {
+		return err
+	}
+	s.setting = strings.ToLower(strings.TrimSpace(setting))
+	s.hz = hz
+	s.runCycles = 0
+	s.runTime = 0
+	s.pause()
+	return nil
+}
+
+func parseSpeed(setting string) (float64, error) {
+	text := strings.ToLower(strings.TrimSpace(setting))
+	factor := 0.0
+	switch {
+	case text == speedUnlimited:
+		return 0, nil
+	case text == "real":
+		return cpuFrequency, nil
+	case strings.HasSuffix(text, "x"):
+		text = strings.TrimSuffix(text, "x")
+		factor = cpuFrequency
+	case strings.HasSuffix(text, "mhz"):
+		text = strings.TrimSuffix(text, "mhz")
+		factor = 1_000_000
+	}
+	n, err := strconv.ParseFloat(text, 64)
+	if factor == 0 || err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad speed '%s', valid options are real, <n>x, <n>MHz and %s", setting, speedUnlimited)
+	}
+	return n * factor, nil
+}
+
+// Restart the throttling and the measure, the time since the last check is lost
+func (s *speedControl) pause() {
+	cycles := s.env.cycles()
+	now := time.Now()
+	s.syncCycles = cycles
+	s.syncTime = now
+	s.lastCycles = cycles
+	s.lastTime = now
+	s.nextCheck = cycles + s.checkInterval()
+}
+
+func (s *speedControl) checkInterval() uint64 {
+	if s.hz == 0 {
+		return speedUnlimitedCheck
+	}
+	return uint64(s.hz / 100)
+}
+
+// Called after each instruction
+func (s *speedControl) throttle() {
+	cycles := s.env.cycles()
+	if cycles < s.nextCheck {
+		return
+	}
+	s.nextCheck = cycles + s.checkInterval()
+
+	if s.hz != 0 {
+		target := time.Duration(float64(cycles-s.syncCycles) / s.hz * float64(time.Second))
+		ahead := target - time.Since(s.syncTime)
+		if ahead > 0 {
+			time.Sleep(ahead)
+		}
+	}
+
+	now := time.Now()
+	s.runCycles += cycles - s.lastCycles
+	s.runTime += now.Sub(s.lastTime)
+	s.lastCycles = cycles
+	s.lastTime = now
+}
+
+// Called before the MOS call is serviced
+func (s *speedControl) mosBegin() {
+	s.mosStart = time.Now()
+}
+
+// Called after the MOS call on the entry point is serviced, adds its cost
+func (s *speedControl) mosEnd(ep uint16) {
+	if time.Since(s.mosStart) > speedPauseThreshold {
+		s.pause()
+	}
+	cycles, ok := mosCallCycles[ep]
+	if !ok {
+		cycles = mosCallDefaultCycles
+	}
+	s.env.addCycles(int(cycles))
+}
+
+// Effective frequency in MHz
+func (s *speedControl) effectiveMHz() float64 {
+	if s.runTime == 0 {
+		return 0
+	}
+	return float64(s.runCycles) / s.runTime.Seconds() / 1_000_000
+}
+
+func (s *speedControl) status() string {
+	target := s.setting
+	if s.hz != 0 {
+		target = fmt.Sprintf("%s, %.2fMHz", s.setting, s.hz/1_000_000)
+	}
+	return fmt.Sprintf("Speed %s\nEffective %.2fMHz, %v cycles\n",
+		target, s.effectiveMHz(), s.env.cycles())
+}
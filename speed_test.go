@@ -0,0 +1,53 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseSpeed(t *testing.T) {
+	expected := map[string]float64{
+		"real":      2_000_000,
+		"4x":        8_000_000,
+		"0.5x":      1_000_000,
+		"8MHz":      8_000_000,
+		"unlimited": 0,
+	}
+	for setting, hz := range expected {
+		value, err := parseSpeed(setting)
+		if err != nil || value != hz {
+			t.Errorf("%s should be %v, got %v, %v", setting, hz, value, err)
+		}
+	}
+	for _, setting := range []string{"", "fast", "0x", "-2MHz"} {
+		_, err := parseSpeed(setting)
+		if err == nil {
+			t.Errorf("%s should fail", setting)
+		}
+	}
+}
+
+func TestSpeedReal(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"*SPEED real",
+		"FOR I%=1 TO 1000:NEXT",
+		"*SPEED",
+	})
+
+	if !strings.Contains(out, "Speed real, 2.00MHz\n") {
+		t.Log(out)
+		t.Fatal("*SPEED should show the speed")
+	}
+	m := regexp.MustCompile(`Effective ([0-9.]+)MHz`).FindStringSubmatch(out)
+	if m == nil {
+		t.Log(out)
+		t.Fatal("*SPEED should show the effective speed")
+	}
+	mhz, _ := strconv.ParseFloat(m[1], 64)
+	if mhz > 2.2 {
+		t.Log(out)
+		t.Errorf("The CPU should be throttled to 2MHz, got %vMHz", mhz)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	Symbol tables, loaded with -symbols. The names are used on the
+	disassembly, the CPU trace, the breakpoints, the monitor addresses and
+	the BRK reports. The MOS entry points and vectors are always named.
+
+	Formats:
+		VICE labels, as written by ld65 -Ln:   al C:1900 .main
+		BeebAsm -d symbol dump:                [{'symbols':{'main':6400L}}]
+		ca65 listings, as asm/firmware.lst:    001900  1  A9 41  main: lda #$41
+
+	See:
+		https://cc65.github.io/doc/ld65.html#ss3.2
+		https://github.com/stardot/beebasm
+*/
+
+type mosCall struct {
+	name       string
+	address    uint16 // On the jump table of the MOS, 0 if it has none
+	entryPoint uint16 // Where bbz services the call, 0 if it is not serviced
+}
+
+/*
+MOS calls, named on the symbols, the breakpoints, the MOS trace and the
+profiler. OSASCI, OSNEWL and OSWRCR end on OSWRCH and the non vectored
+calls are not serviced apart.
+*/
+var mosCalls = []mosCall{
+	{"OSFSC", 0, epFSC},
+	{"OSRDRM", 0xffb9, epRDRM},
+	{"VDUCHR", 0xffbc, epVDUCH},
+	{"OSEVEN", 0xffbf, 0},
+	{"GSINIT", 0xffc2, epGSINIT},
+	{"GSREAD", 0xffc5, epGSREAD},
+	{"NVRDCH", 0xffc8, 0},
+	{"NVWRCH", 0xffcb, 0},
+	{"OSFIND", 0xffce, epFIND},
+	{"OSGBPB", 0xffd1, epGBPB},
+	{"OSBPUT", 0xffd4, epBPUT},
+	{"OSBGET", 0xffd7, epBGET},
+	{"OSARGS", 0xffda, epARGS},
+	{"OSFILE", 0xffdd, epFILE},
+	{"OSRDCH", 0xffe0, epRDCH},
+	{"OSASCI", 0xffe3, 0},
+	{"OSNEWL", 0xffe7, 0},
+	{"OSWRCR", 0xffec, 0},
+	{"OSWRCH", 0xffee, epWRCH},
+	{"OSWORD", 0xfff1, epWORD},
+	{"OSBYTE", 0xfff4, epBYTE},
+	{"OSCLI", 0xfff7, epCLI},
+}
+
+// Entry point of a MOS call serviced by bbz, by name
+func mosEntryPoint(name string) (uint16, bool) {
+	for _, call := range mosCalls {
+		if call.name == name && call.entryPoint != 0 {
+			return call.entryPoint, true
+		}
+	}
+	return 0, false
+}
+
+// Address of a MOS call on the jump table, by name
+func mosCallAddress(name string) (uint16, bool) {
+	for _, call := range mosCalls {
+		if call.name == name && call.address != 0 {
+			return call.address, true
+		}
+	}
+	return 0, false
+}
+
+var mosVectorSymbols = map[uint16]string{
+	0x0200: "USERV", 0x0202: "BRKV", 0x0204: "IRQ1V", 0x0206: "IRQ2V",
+	0x0208: "CLIV", 0x020a: "BYTEV", 0x020c: "WORDV", 0x020e: "WRCHV",
+	0x0210: "RDCHV", 0x0212: "FILEV", 0x0214: "ARGSV", 0x0216: "BGETV",
+	0x0218: "BPUTV", 0x021a: "GBPBV", 0x021c: "FINDV", 0x021e: "FSCV",
+	0x0220: "EVNTV", 0x0222: "UPTV", 0x0224: "NETV", 0x0226: "VDUV",
+	0x0228: "KEYV", 0x022a: "INSV", 0x022c: "REMV", 0x022e: "CNPV",
+	0x0230: "IND1V", 0x0232: "IND2V", 0x0234: "IND3V",
+}
+
+// Max distance to the previous symbol to show an address as symbol+offset
+const symbolMaxOffset = 0x100
+
+var (
+	viceLabelRegexp    = regexp.MustCompile(`^al\s+(?:[A-Za-z]:)?([0-9A-Fa-f]+)\s+\.?(\S+)`)
+	beebasmSymbolRegex = regexp.MustCompile(`'([^']+)':\s*(\d+)L?`)
+	ca65ListingRegexp  = regexp.MustCompile(`^([0-9A-Fa-f]{6})  \d+  .{13}([A-Za-z_@][A-Za-z0-9_@]*):`)
+)
+
+type symbolTable struct {
+	byName    map[string]uint16
+	byAddress map[uint16]string
+	loaded    map[uint16]bool // Addresses with a symbol from a file
+	sorted    []uint16        // Addresses with a symbol, built on demand
+}
+
+func newSymbolTable() *symbolTable {
+	var s symbolTable
+	s.byName = make(map[string]uint16)
+	s.byAddress = make(map[uint16]string)
+	s.loaded = make(map[uint16]bool)
+	for _, call := range mosCalls {
+		if call.address != 0 {
+			s.add(call.name, call.address)
+		}
+	}
+	for address, name := range mosVectorSymbols {
+		s.add(name, address)
+	}
+	return &s
+}
+
+// Add a symbol, the last one added names the address
+func (s *symbolTable) add(name string, address uint16) {
+	s.byName[name] = address
+	s.byAddress[address] = name
+	s.sorted = nil
+}
+
+func (s *symbolTable) addLoaded(name string, address uint16) {
+	s.add(name, address)
+	s.loaded[address] = true
+}
+
+// Load symbol files separated by commas, as given on the command line
+func (s *symbolTable) loadFiles(filenames string) error {
+	for _, filename := range strings.Split(filenames, ",") {
+		filename = strings.TrimSpace(filename)
+		if filename == "" {
+			continue
+		}
+		err := s.load(filename)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	return nil
+}
+
+func (s *symbolTable) load(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if m := viceLabelRegexp.FindStringSubmatch(line); m != nil {
+			address, err := strconv.ParseUint(m[1], 16, 32)
+			if err == nil && address <= 0xffff {
+				s.addLoaded(m[2], uint16(address))
+				count++
+			}
+		} else if m := ca65ListingRegexp.FindStringSubmatch(line); m != nil {
+			address, _ := strconv.ParseUint(m[1], 16, 32)
+			if address <= 0xffff {
+				s.addLoaded(m[2], uint16(address))
+				count++
+			}
+		} else if strings.Contains(line, "'symbols'") {
+			for _, m := range beebasmSymbolRegex.FindAllStringSubmatch(line, -1) {
+				address, err := strconv.ParseUint(m[2], 10, 32)
+				if err == nil && m[1] != "symbols" && address <= 0xffff {
+					s.addLoaded(m[1], uint16(address))
+					count++
+				}
+			}
+		}
+	}
+
+	if count == 0 {
+		return errors.New("no symbols found")
+	}
+	return nil
+}
+
+/*
+Address of a symbol, the exact name is preferred to a case insensitive
+match. With several case insensitive matches, the first name in order wins.
+*/
+func (s *symbolTable) lookup(name string) (uint16, bool) {
+	if address, ok := s.byName[name]; ok {
+		return address, true
+	}
+	found := ""
+	for symbol := range s.byName {
+		if strings.EqualFold(symbol, name) && (found == "" || symbol < found) {
+			found = symbol
+		}
+	}
+	if found == "" {
+		return 0, false
+	}
+	return s.byName[found], true
+}
+
+func (s *symbolTable) lookupExact(name string) (uint16, bool) {
+	address, ok := s.byName[name]
+	return address, ok
+}
+
+func (s *symbolTable) name(address uint16) (string, bool) {
+	name, ok := s.byAddress[address]
+	return name, ok
+}
+
+// Symbol or hex number with the format given
+func (s *symbolTable) operand(address uint16, format string) string {
+	if name, ok := s.byAddress[address]; ok {
+		return name
+	}
+	return fmt.Sprintf(format, address)
+}
+
+// Address as "symbol" or "symbol+offset", empty if there is no symbol close
+func (s *symbolTable) describe(address uint16) string {
+	if name, ok := s.byAddress[address]; ok {
+		return name
+	}
+	i := s.after(address)
+	if i == 0 {
+		return ""
+	}
+	previous := s.sorted[i-1]
+	if address-previous >= symbolMaxOffset {
+		return ""
+	}
+	return fmt.Sprintf("%s+%X", s.byAddress[previous], address-previous)
+}
+
+/*
+Loaded symbol at or before the address, used to aggregate by routine. The
+MOS symbols are not used, the addresses before the first symbol are not on
+any routine.
+*/
+func (s *symbolTable) containing(address uint16) (string, bool) {
+	for i := s.after(address); i > 0; i-- {
+		previous := s.sorted[i-1]
+		if s.loaded[previous] {
+			return s.byAddress[previous], true
+		}
+	}
+	return "", false
+}
+
+// Index on the sorted addresses of the first symbol after the address
+func (s *symbolTable) after(address uint16) int {
+	if s.sorted == nil {
+		for a := range s.byAddress {
+			s.sorted = append(s.sorted, a)
+		}
+		sort.Slice(s.sorted, func(i, j int) bool { return s.sorted[i] < s.sorted[j] })
+	}
+	return sort.Search(len(s.sorted), func(i int) bool { return s.sorted[i] > address })
+}
+
+func (s *symbolTable) hasLoaded() bool {
+	return len(s.loaded) > 0
+}
+
+// Address as "&1234 (symbol+offset)" for reports
+func (s *symbolTable) location(address uint16) string {
+	description := s.describe(address)
+	if description == "" {
+		return fmt.Sprintf("&%04X", address)
+	}
+	return fmt.Sprintf("&%04X (%s)", address, description)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSymbolFormats(t *testing.T) {
+	dir := t.TempDir()
+	vice := filepath.Join(dir, "program.lbl")
+	beebasm := filepath.Join(dir, "program.sym")
+	err := os.WriteFile(vice, []byte("al C:1900 .main\nal 001903 .loop\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(beebasm, []byte("[{'symbols':{'data':112L,'data.end':127L}}]\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newSymbolTable()
+	err = s.loadFiles(vice + "," + beebasm + ",asm/firmware.lst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]uint16{
+		"main":     0x1900,
+		"loop":     0x1903,
+		"data":     0x70,
+		"data.end": 0x7f,
+		"epWRCH":   epWRCH,
+		"OSWRCH":   0xffee,
+		"osbyte":   0xfff4,
+	}
+	for name, address := range expected {
+		value, ok := s.lookup(name)
+		if !ok || value != address {
+			t.Errorf("%s should be &%04X, got &%04X", name, address, value)
+		}
+	}
+
+	if s.describe(0x1905) != "loop+2" {
+		t.Errorf("&1905 should be loop+2, got %s", s.describe(0x1905))
+	}
+	if s.location(0x5000) != "&5000" {
+		t.Errorf("&5000 has no symbol, got %s", s.location(0x5000))
+	}
+}
+
+func TestSymbolsOnMonitor(t *testing.T) {
+	symbols := filepath.Join(t.TempDir(), "program.lbl")
+	err := os.WriteFile(symbols, []byte("al C:0900 .main\nal C:0902 .done\nal C:0070 .result\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := integrationTestBasicWithSetup([]string{
+		"?&900=&85:?&901=&70:?&902=&60",
+		"*DEBUG",
+		"d main 2",
+		"b done",
+		"c",
+		"A%=42:CALL &900",
+		"c",
+		"PRINT ?&70",
+	}, func(env *environment) {
+		err := env.symbols.loadFiles(symbols)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if !strings.Contains(out, "main:\n0900  85 70     STA result\ndone:\n0902  60        RTS\n") {
+		t.Log(out)
+		t.Error("The disassembly should show the symbols")
+	}
+	if !strings.Contains(out, "Breakpoint done\nPC=0902") {
+		t.Log(out)
+		t.Error("The breakpoint on a symbol failed")
+	}
+	if !strings.Contains(out, "PRINT ?&70\n        42\n") {
+		t.Log(out)
+		t.Error("The program didn't run")
+	}
+}
+
+func TestSymbolsHexNames(t *testing.T) {
+	symbols := filepath.Join(t.TempDir(), "program.lbl")
+	err := os.WriteFile(symbols, []byte("al C:0900 .add\nal C:0910 .Loop\nal C:0920 .LOOP\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := integrationTestBasicWithSetup([]string{
+		"*DEBUG",
+		"d add 1",
+		"d &add 1",
+		"c",
+	}, func(env *environment) {
+		err := env.symbols.loadFiles(symbols)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			address, ok := env.symbols.lookup("loop")
+			if !ok || address != 0x920 {
+				t.Fatalf("loop should be LOOP, the first name in order, got &%04X", address)
+			}
+		}
+	})
+
+	if !strings.Contains(out, "dbg> d add 1\nadd:\n0900") {
+		t.Log(out)
+		t.Error("A symbol named as a hex number should be the symbol")
+	}
+	if !strings.Contains(out, "dbg> d &add 1\n0ADD") {
+		t.Log(out)
+		t.Error("A hex number with & should be the number")
+	}
+}
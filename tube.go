@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+)
+
+/*
+	Tube mode, the language runs on a 6502 second processor with 64K of RAM.
+
+	The CPU executes the language on the second processor memory. The MOS
+	calls are serviced by bbz as the I/O processor. The I/O processor memory
+	is only accessible with OSWORD 5 and 6, but the MOS variables and the
+	VDU variables on pages 2 and 3 are shared. Pages 4 to 7 are language
+	workspace on the second processor.
+
+	The language ROM is copied to the second processor memory on the
+	relocation address of the ROM header, that is how Hi-BASIC is loaded on
+	&B800. The client code uses the memory from &F800, the support code of
+	the firmware, as GSINIT and GSREAD, is there to stay available with a
+	language up to &F7FF. The sideways ROMs are not available on Tube mode,
+	the commands they would handle fail.
+
+	See:
+		https://beebwiki.mdfs.net/Tube
+		https://beebwiki.mdfs.net/Paged_ROM
+*/
+
+func (env *environment) enableTube() {
+	env.mem.tube = true
+	env.mem.ioData = make([]uint8, len(env.mem.data))
+	copy(env.mem.ioData, env.mem.data[:])
+	env.mem.data[mosTubePresence] = 0xff
+}
+
+func (env *environment) isTube() bool {
+	return env.mem.tube
+}
+
+/*
+If bit 5 of the ROM type is set, a 4 bytes relocation address follows the
+copyright string.
+*/
+func romRelocationAddress(rom []uint8) uint16 {
+	typeIndex := romTypeByte - romStartAddress
+	copyrightIndex := int(rom[romCopyrightOffsetPointer-romStartAddress]) + 1
+	if rom[typeIndex]&0x20 == 0 {
+		return romStartAddress
+	}
+
+	// Skip the copyright string
+	i := copyrightIndex
+	for i < len(rom) && rom[i] != 0 {
+		i++
+	}
+	i++
+	if i+1 >= len(rom) {
+		return romStartAddress
+	}
+	return uint16(rom[i]) + uint16(rom[i+1])<<8
+}
+
+// Copy the language to the second processor memory, returns the start address
+func (env *environment) tubeLoadLanguage(slot uint8) uint16 {
+	rom := env.mem.sideRom[slot]
+	start := romRelocationAddress(rom)
+
+	length := len(rom)
+	if int(start)+length > int(tubeClientStart) {
+		length = int(tubeClientStart) - int(start)
+	}
+	copy(env.mem.data[start:], rom[:length])
+	env.tubeLanguageEnd = start + uint16(length) - 1
+
+	env.log(fmt.Sprintf("TUBE(language slot %x loaded at 0x%04x-0x%04x)", slot, start, env.tubeLanguageEnd))
+	return start
+}
+
+// Top of the user memory on the second processor, the start of the language
+func (env *environment) tubeHimem() uint16 {
+	return env.tubeLanguageStart
+}
+
+// Addresses &FFFFxxxx are on the I/O processor on the Tube transfers
+func ioProcessorAddress(address uint32) bool {
+	return address>>16 == 0xffff
+}
+
+/*
+Data transfers of the filing system, as OSFILE and OSGBPB. With the Z80
+second processor the addresses not on the I/O processor are on the Z80
+memory.
+*/
+func (env *environment) peekTransfer(address uint32, length uint16) []uint8 {
+	if env.z80 != nil && !ioProcessorAddress(address) {
+		return env.z80.peekSlice(uint16(address), length)
+	}
+	return env.mem.peekSlice(uint16(address), length)
+}
+
+func (env *environment) pokeTransfer(address uint32, maxLength uint16, data []uint8) uint16 {
+	if env.z80 != nil && !ioProcessorAddress(address) {
+		return env.z80.pokeSlice(uint16(address), maxLength, data)
+	}
+	return env.mem.pokeSlice(uint16(address), maxLength, data)
+}
+
+// Runs the code loaded with *RUN, on the Z80 second processor for its addresses
+func (env *environment) runCode(address uint32) {
+	if env.z80 != nil && !ioProcessorAddress(address) {
+		env.z80.execute(address)
+		return
+	}
+	env.cpu.SetPC(uint16(address))
+}
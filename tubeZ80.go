@@ -0,0 +1,515 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+/*
+	Tube mode with a Z80 second processor, as the Acorn Z80 second processor
+	with 64K of RAM running the client ROM given with -z80.
+
+	The Z80 accesses the Tube registers on the I/O ports, the low 3 bits of
+	the port select the status or the data of R1 to R4. The 4K client ROM is
+	mapped on the low memory after a reset and on the NMI entry at &0066, an
+	opcode fetch from &8000 or above maps the RAM back. The writes always go
+	to the RAM.
+
+	bbz is the I/O processor and its MOS handlers serve the client. The 6502
+	waits on tubeHostIdle while the Z80 runs, the requests of the client are
+	decoded and the MOS is called on the 6502 with the control blocks and
+	strings copied to the I/O processor memory, the same path as the calls of
+	a language with the traces and the breakpoints. When the call returns to
+	tubeHostIdle the results are sent to the Z80. BRKV points to
+	tubeHostError to send the errors.
+
+	Protocol on R2, request of the client => reply of the host:
+		OSRDCH   &00                        => Cy A
+		OSCLI    &02 string &0D             => &7F, or &80 to execute code
+		OSBYTE   &04 X A                    => X                (A < &80)
+		OSBYTE   &06 X Y A                  => Cy Y X           (A >= &80)
+		OSWORD   &08 A in_len block out_len => block
+		OSWORD0  &0A block                  => &FF, or &7F string &0D
+		OSARGS   &0C Y block A              => A block
+		OSBGET   &0E Y                      => Cy A
+		OSBPUT   &10 Y A                    => &7F
+		OSFIND   &12 &00 Y                  => &7F
+		OSFIND   &12 A string &0D           => A
+		OSFILE   &14 block string &0D A     => A block
+		OSGBPB   &16 block A                => block Cy A
+	The blocks are sent from the last byte to the first and Cy is on bit 7.
+	OSWRCH is sent on R1. The host sends on R1 the escape state as &80 plus
+	the escape flag shifted right, on R4 &FF followed on R2 by &00, the error
+	number, the message and &00 for the errors and on R4 &04, the claimant,
+	the address from the high byte and a sync byte before the &80 of the code
+	to execute. The host sends &7F on R2 after a reset, there is no language
+	to copy.
+
+	The data of OSFILE, OSGBPB and OSWORD &7F for the addresses below
+	&FFFF0000 are copied directly to the Z80 memory, as done by a Tube
+	transfer, R3 is not used.
+
+	See:
+		https://mdfs.net/Software/Tube/Protocol
+		https://beebwiki.mdfs.net/Tube
+*/
+
+const (
+	// Flags of the Tube, set by the host
+	tubeFlagQ uint8 = 0x01 // Host IRQ from R4
+	tubeFlagI uint8 = 0x02 // Parasite IRQ from R1
+	tubeFlagJ uint8 = 0x04 // Parasite IRQ from R4
+	tubeFlagM uint8 = 0x08 // Parasite NMI from R3
+	tubeFlagV uint8 = 0x10 // Two bytes on R3
+	tubeFlagP uint8 = 0x20 // Parasite reset
+
+	tubeStatusData    uint8 = 0x80 // Data available for the parasite
+	tubeStatusNotFull uint8 = 0x40 // The parasite can write
+
+	tubeReplyDone    uint8 = 0x7f
+	tubeReplyExecute uint8 = 0x80
+	tubeReplyEscape  uint8 = 0xff
+	tubeError        uint8 = 0xff
+	tubeTransferExec uint8 = 4
+	tubeClaimantID   uint8 = 0x3f // The client does not use it
+
+	// Z80 instructions run before giving control back to RunMOS
+	tubeZ80Slice = 1000
+	// The Z80 runs at 6MHz, three times the 2MHz of the 6502 cycles
+	z80CyclesPer6502Cycle = 3
+)
+
+// Request of the client serviced by calling the MOS on the 6502
+type tubeCall struct {
+	name    string // MOS call on the jump table
+	a, x, y uint8
+	reply   func(a, x, y, p uint8) // Sends the results to the client
+}
+
+type tubeZ80 struct {
+	env *environment
+	cpu *z80
+
+	ram       []uint8
+	rom       []uint8
+	romMapped bool
+	flags     uint8
+
+	toParasite [4][]uint8 // Data of R1 to R4 waiting to be read by the client
+	request    []uint8    // Request being received on R2
+	calls      []*tubeCall
+	pending    *tubeCall // Call running on the 6502
+
+	executeAddress uint32 // Code to run after OSCLI, addressNull if none
+	escape         uint8  // Escape state sent to the client
+	tStates        uint64 // Not yet counted on the 6502 cycles
+}
+
+func newTubeZ80(env *environment, romFilename string) (*tubeZ80, error) {
+	rom, err := os.ReadFile(romFilename)
+	if err != nil {
+		return nil, err
+	}
+	if len(rom) == 0 || len(rom) > z80RomSize {
+		return nil, fmt.Errorf("the Z80 client ROM must have up to %v bytes", z80RomSize)
+	}
+
+	var t tubeZ80
+	t.env = env
+	t.rom = rom
+	t.ram = make([]uint8, 0x10000)
+	t.cpu = newZ80(&t)
+	return &t, nil
+}
+
+func (env *environment) enableTubeZ80(romFilename string) error {
+	t, err := newTubeZ80(env, romFilename)
+	if err != nil {
+		return err
+	}
+	env.z80 = t
+	env.mem.data[mosTubePresence] = 0xff
+	return nil
+}
+
+// Resets the client and parks the 6502 waiting for its requests
+func (t *tubeZ80) reset() {
+	env := t.env
+	t.cpu.reset()
+	t.romMapped = true
+	t.flags = tubeFlagI | tubeFlagJ | tubeFlagM
+	t.toParasite = [4][]uint8{}
+	t.request = nil
+	t.calls = nil
+	t.pending = nil
+	t.executeAddress = addressNull
+	t.escape = 0
+
+	// JMP tubeHostIdle, the host waits there
+	env.mem.Poke(tubeHostIdle, 0x4c)
+	env.mem.pokeWord(tubeHostIdle+1, tubeHostIdle)
+	env.mem.pokeWord(vectorBRK, tubeHostError)
+	t.park()
+
+	// No language to copy
+	t.send(1, tubeReplyDone)
+}
+
+func (t *tubeZ80) park() {
+	_, x, y, p := t.env.cpu.GetAXYP()
+	t.env.cpu.SetAXYP(0, x, y, p)
+	t.env.cpu.SetPC(tubeHostIdle)
+	err := t.env.setSP(0xff)
+	if err != nil {
+		t.env.notImplemented(fmt.Sprintf("TUBE(%v)", err))
+	}
+}
+
+/*
+Runs the second processor while the 6502 is on tubeHostIdle. Returns false
+when the 6502 has to run, with a MOS call for the client or the code of
+the I/O processor it calls.
+*/
+func (t *tubeZ80) host(pc uint16) bool {
+	switch pc {
+	case tubeHostIdle:
+		if t.pending != nil {
+			a, x, y, p := t.env.cpu.GetAXYP()
+			reply := t.pending.reply
+			t.pending = nil
+			reply(a, x, y, p)
+		}
+	case tubeHostError:
+		t.pending = nil
+		t.sendError()
+		t.park()
+	default:
+		return false
+	}
+
+	t.updateEscape()
+	for i := 0; i < tubeZ80Slice && len(t.calls) == 0; i++ {
+		t.tStates += uint64(t.cpu.step())
+	}
+	t.env.addCycles(int(t.tStates / z80CyclesPer6502Cycle))
+	t.tStates %= z80CyclesPer6502Cycle
+
+	if len(t.calls) > 0 {
+		t.call(t.calls[0])
+		t.calls = t.calls[1:]
+	}
+	return true
+}
+
+// Calls the MOS on the 6502, it returns to tubeHostIdle
+func (t *tubeZ80) call(c *tubeCall) {
+	env := t.env
+	address, _ := mosCallAddress(c.name)
+	_, _, _, p := env.cpu.GetAXYP()
+	env.cpu.SetAXYP(c.a, c.x, c.y, p)
+
+	_, sp := env.cpu.GetPCAndSP()
+	ret := tubeHostIdle - 1 // RTS adds one
+	env.mem.Poke(0x100+uint16(sp), uint8(ret>>8))
+	env.mem.Poke(0x100+uint16(sp-1), uint8(ret))
+	env.cpu.SetPC(address)
+	t.pending = c
+	err := env.setSP(sp - 2)
+	if err != nil {
+		env.notImplemented(fmt.Sprintf("TUBE(%v)", err))
+	}
+}
+
+func (t *tubeZ80) send(register int, data ...uint8) {
+	t.toParasite[register] = append(t.toParasite[register], data...)
+}
+
+// The error left by the BRK handler on &FD and &FE
+func (t *tubeZ80) sendError() {
+	mem := t.env.mem
+	address := mem.peekWord(zpErrorPointer)
+	t.send(3, tubeError)
+	t.send(1, 0x00, mem.Peek(address))
+	t.send(1, []uint8(mem.peekString(address+1, 0))...)
+	t.send(1, 0x00)
+}
+
+func (t *tubeZ80) updateEscape() {
+	escape := t.env.mem.Peek(zpEscapeFlag) & 0x80
+	if escape != t.escape {
+		t.escape = escape
+		t.send(0, 0x80|escape>>1)
+	}
+}
+
+// Code to run on the second processor after OSCLI, as *RUN
+func (t *tubeZ80) execute(address uint32) {
+	t.executeAddress = address
+}
+
+// Client requests
+
+func (t *tubeZ80) receiveR1(value uint8) {
+	t.calls = append(t.calls, &tubeCall{
+		name:  "OSWRCH",
+		a:     value,
+		reply: func(a, x, y, p uint8) {},
+	})
+}
+
+func (t *tubeZ80) receiveR2(value uint8) {
+	t.request = append(t.request, value)
+	if tubeRequestComplete(t.request) {
+		c := t.decode(t.request)
+		t.request = nil
+		if c != nil {
+			t.calls = append(t.calls, c)
+		}
+	}
+}
+
+func tubeRequestComplete(r []uint8) bool {
+	n := len(r)
+	switch r[0] {
+	case 0x02: // OSCLI
+		return r[n-1] == 0x0d
+	case 0x04: // OSBYTE
+		return n == 3
+	case 0x06: // OSBYTE
+		return n == 4
+	case 0x08: // OSWORD
+		return n >= 3 && n == 4+int(r[2])
+	case 0x0a: // OSWORD 0
+		return n == 6
+	case 0x0c: // OSARGS
+		return n == 7
+	case 0x0e: // OSBGET
+		return n == 2
+	case 0x10: // OSBPUT
+		return n == 3
+	case 0x12: // OSFIND
+		if n < 3 {
+			return false
+		}
+		return r[1] == 0 || r[n-1] == 0x0d
+	case 0x14: // OSFILE
+		return n >= 19 && r[n-2] == 0x0d
+	case 0x16: // OSGBPB
+		return n == 15
+	}
+	return true
+}
+
+// Copies a block sent from the last byte to the first to the I/O processor memory
+func (t *tubeZ80) pokeBlock(address uint16, reversed []uint8) {
+	for i, v := range reversed {
+		t.env.mem.Poke(address+uint16(len(reversed)-1-i), v)
+	}
+}
+
+// Sends a block from the last byte to the first
+func (t *tubeZ80) sendBlock(address uint16, length int) {
+	for i := length - 1; i >= 0; i-- {
+		t.send(1, t.env.mem.Peek(address+uint16(i)))
+	}
+}
+
+func (t *tubeZ80) pokeString(s []uint8) {
+	for i, v := range s {
+		t.env.mem.Poke(tubeHostString+uint16(i), v)
+	}
+}
+
+func tubeCarry(p uint8) uint8 {
+	return (p & 1) << 7
+}
+
+func (t *tubeZ80) decode(r []uint8) *tubeCall {
+	xy := func(address uint16) (uint8, uint8) {
+		return uint8(address), uint8(address >> 8)
+	}
+	x, y := xy(tubeHostBlock)
+	sx, sy := xy(tubeHostString)
+
+	switch r[0] {
+	case 0x00:
+		return &tubeCall{name: "OSRDCH", reply: func(a, x, y, p uint8) {
+			t.send(1, tubeCarry(p), a)
+		}}
+
+	case 0x02:
+		t.pokeString(r[1:])
+		return &tubeCall{name: "OSCLI", x: sx, y: sy, reply: func(a, x, y, p uint8) {
+			if t.executeAddress == addressNull {
+				t.send(1, tubeReplyDone)
+				return
+			}
+			address := t.executeAddress
+			t.executeAddress = addressNull
+			t.send(3, tubeTransferExec, tubeClaimantID,
+				uint8(address>>24), uint8(address>>16), uint8(address>>8), uint8(address), 0x00)
+			t.send(1, tubeReplyExecute)
+		}}
+
+	case 0x04:
+		return &tubeCall{name: "OSBYTE", a: r[2], x: r[1], reply: func(a, x, y, p uint8) {
+			t.send(1, x)
+		}}
+
+	case 0x06:
+		return &tubeCall{name: "OSBYTE", a: r[3], x: r[1], y: r[2], reply: func(a, x, y, p uint8) {
+			t.send(1, tubeCarry(p), y, x)
+		}}
+
+	case 0x08:
+		inLength := int(r[2])
+		outLength := int(r[3+inLength])
+		t.pokeBlock(tubeHostBlock, r[3:3+inLength])
+		return &tubeCall{name: "OSWORD", a: r[1], x: x, y: y, reply: func(a, x, y, p uint8) {
+			t.sendBlock(tubeHostBlock, outLength)
+		}}
+
+	case 0x0a:
+		// The line is read on the I/O processor memory
+		t.pokeBlock(tubeHostBlock, r[1:6])
+		t.env.mem.pokeWord(tubeHostBlock, tubeHostString)
+		return &tubeCall{name: "OSWORD", a: 0, x: x, y: y, reply: func(a, x, y, p uint8) {
+			if p&1 != 0 {
+				t.send(1, tubeReplyEscape)
+				return
+			}
+			t.send(1, tubeReplyDone)
+			t.send(1, []uint8(t.env.mem.peekString(tubeHostString, 0x0d))...)
+			t.send(1, 0x0d)
+		}}
+
+	case 0x0c:
+		// The control block on zero page
+		t.pokeBlock(0x0000, r[2:6])
+		return &tubeCall{name: "OSARGS", a: r[6], x: 0x00, y: r[1], reply: func(a, x, y, p uint8) {
+			t.send(1, a)
+			t.sendBlock(0x0000, 4)
+		}}
+
+	case 0x0e:
+		return &tubeCall{name: "OSBGET", y: r[1], reply: func(a, x, y, p uint8) {
+			t.send(1, tubeCarry(p), a)
+		}}
+
+	case 0x10:
+		return &tubeCall{name: "OSBPUT", a: r[2], y: r[1], reply: func(a, x, y, p uint8) {
+			t.send(1, tubeReplyDone)
+		}}
+
+	case 0x12:
+		if r[1] == 0 {
+			return &tubeCall{name: "OSFIND", a: 0, y: r[2], reply: func(a, x, y, p uint8) {
+				t.send(1, tubeReplyDone)
+			}}
+		}
+		t.pokeString(r[2:])
+		return &tubeCall{name: "OSFIND", a: r[1], x: sx, y: sy, reply: func(a, x, y, p uint8) {
+			t.send(1, a)
+		}}
+
+	case 0x14:
+		// The block without the filename address, then the filename
+		n := len(r)
+		t.pokeBlock(tubeHostBlock+2, r[1:17])
+		t.env.mem.pokeWord(tubeHostBlock, tubeHostString)
+		t.pokeString(r[17 : n-1])
+		return &tubeCall{name: "OSFILE", a: r[n-1], x: x, y: y, reply: func(a, x, y, p uint8) {
+			t.send(1, a)
+			t.sendBlock(tubeHostBlock+2, 16)
+		}}
+
+	case 0x16:
+		t.pokeBlock(tubeHostBlock, r[1:14])
+		return &tubeCall{name: "OSGBPB", a: r[14], x: x, y: y, reply: func(a, x, y, p uint8) {
+			t.sendBlock(tubeHostBlock, 13)
+			t.send(1, tubeCarry(p), a)
+		}}
+	}
+
+	t.env.notImplemented(fmt.Sprintf("TUBE(request=0x%02x)", r[0]))
+	return nil
+}
+
+// Z80 bus
+
+func (t *tubeZ80) fetch(address uint16) uint8 {
+	if address >= 0x8000 {
+		t.romMapped = false
+	} else if address == 0x0066 {
+		t.romMapped = true
+	}
+	return t.read(address)
+}
+
+func (t *tubeZ80) read(address uint16) uint8 {
+	if t.romMapped && int(address) < len(t.rom) {
+		return t.rom[address]
+	}
+	return t.ram[address]
+}
+
+func (t *tubeZ80) write(address uint16, value uint8) {
+	t.ram[address] = value
+}
+
+func (t *tubeZ80) in(port uint16) uint8 {
+	register := int(port&7) >> 1
+	if port&1 == 0 {
+		// Status
+		status := tubeStatusNotFull
+		if len(t.toParasite[register]) > 0 {
+			status |= tubeStatusData
+		}
+		if register == 0 {
+			status |= t.flags
+		}
+		return status
+	}
+
+	// Data, 0 if there is none
+	queue := t.toParasite[register]
+	if len(queue) == 0 {
+		return 0
+	}
+	value := queue[0]
+	t.toParasite[register] = queue[1:]
+	return value
+}
+
+func (t *tubeZ80) out(port uint16, value uint8) {
+	switch port & 7 {
+	case 1:
+		t.receiveR1(value)
+	case 3:
+		t.receiveR2(value)
+	}
+	// R3 is not used for the transfers and the host ignores R4
+}
+
+func (t *tubeZ80) interrupt() bool {
+	return (t.flags&tubeFlagI != 0 && len(t.toParasite[0]) > 0) ||
+		(t.flags&tubeFlagJ != 0 && len(t.toParasite[3]) > 0)
+}
+
+// Transfers to the Z80 memory
+
+func (t *tubeZ80) peekSlice(address uint16, length uint16) []uint8 {
+	data := make([]uint8, length)
+	for i := range data {
+		data[i] = t.ram[address+uint16(i)]
+	}
+	return data
+}
+
+func (t *tubeZ80) pokeSlice(address uint16, maxLength uint16, data []uint8) uint16 {
+	var i uint16
+	for i = 0; i < maxLength && i < uint16(len(data)); i++ {
+		t.ram[address+i] = data[i]
+	}
+	return i
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Minimal assembler for the Z80 client of the tests, with labels
+type z80TestAsm struct {
+	code   []uint8
+	labels map[string]int
+	fixups []z80TestFixup
+}
+
+type z80TestFixup struct {
+	position int
+	label    string
+	relative bool
+}
+
+func newZ80TestAsm() *z80TestAsm {
+	return &z80TestAsm{labels: make(map[string]int)}
+}
+
+func (a *z80TestAsm) emit(data ...uint8) {
+	a.code = append(a.code, data...)
+}
+
+func (a *z80TestAsm) label(name string) {
+	a.labels[name] = len(a.code)
+}
+
+// Opcode followed by the address of a label
+func (a *z80TestAsm) address(opcode uint8, label string) {
+	a.emit(opcode)
+	a.fixups = append(a.fixups, z80TestFixup{len(a.code), label, false})
+	a.emit(0, 0)
+}
+
+// Opcode followed by the displacement to a label
+func (a *z80TestAsm) jr(opcode uint8, label string) {
+	a.emit(opcode)
+	a.fixups = append(a.fixups, z80TestFixup{len(a.code), label, true})
+	a.emit(0)
+}
+
+func (a *z80TestAsm) assemble(t *testing.T) []uint8 {
+	for _, f := range a.fixups {
+		target, ok := a.labels[f.label]
+		if !ok {
+			t.Fatalf("Label %v not defined", f.label)
+		}
+		if f.relative {
+			a.code[f.position] = uint8(target - f.position - 1)
+		} else {
+			a.code[f.position] = uint8(target)
+			a.code[f.position+1] = uint8(target >> 8)
+		}
+	}
+	return a.code
+}
+
+/*
+Client that talks to the host with the requests of the Tube protocol. It
+keeps the results on &9000.
+*/
+func z80TestClient(t *testing.T, saveFilename string) []uint8 {
+	a := newZ80TestAsm()
+	a.emit(0x31, 0x00, 0xf0) // LD SP,&F000
+
+	// The host sends &7F after the reset
+	a.address(0xcd, "readR2")  // CALL readR2
+	a.emit(0x32, 0x00, 0x90)   // LD (&9000),A
+	a.address(0x21, "hello")   // LD HL,hello
+	a.address(0xcd, "printR1") // CALL printR1
+
+	// OSBYTE &82
+	a.emit(0x3e, 0x06)        // LD A,6
+	a.address(0xcd, "sendR2") // CALL sendR2
+	a.emit(0x3e, 0x00)        // LD A,0
+	a.address(0xcd, "sendR2") // CALL sendR2
+	a.address(0xcd, "sendR2") // CALL sendR2
+	a.emit(0x3e, 0x82)        // LD A,&82
+	a.address(0xcd, "sendR2") // CALL sendR2
+	a.address(0xcd, "readR2") // CALL readR2
+	a.address(0xcd, "readR2") // CALL readR2
+	a.emit(0x32, 0x01, 0x90)  // LD (&9001),A
+	a.address(0xcd, "readR2") // CALL readR2
+	a.emit(0x32, 0x02, 0x90)  // LD (&9002),A
+
+	// OSCLI to save the results so far from the Z80 memory
+	a.emit(0x3e, 0x02)            // LD A,2
+	a.address(0xcd, "sendR2")     // CALL sendR2
+	a.address(0x21, "save")       // LD HL,save
+	a.address(0xcd, "sendString") // CALL sendString
+	a.address(0xcd, "readR2")     // CALL readR2
+	a.emit(0x32, 0x03, 0x90)      // LD (&9003),A
+
+	// OSWORD &7F reading the track 1 sector 2 to &A000
+	a.address(0x21, "osword")    // LD HL,osword
+	a.emit(0x06, 15)             // LD B,15
+	a.address(0xcd, "sendBytes") // CALL sendBytes
+	a.address(0xcd, "readR2")    // CALL readR2
+	a.emit(0x32, 0x04, 0x90)     // LD (&9004),A
+	a.emit(0x06, 10)             // LD B,10
+	a.label("skip")
+	a.address(0xcd, "readR2") // skip: CALL readR2
+	a.jr(0x10, "skip")        // DJNZ skip
+
+	// OSCLI with an error
+	a.emit(0x3e, 0x02)            // LD A,2
+	a.address(0xcd, "sendR2")     // CALL sendR2
+	a.address(0x21, "bad")        // LD HL,bad
+	a.address(0xcd, "sendString") // CALL sendString
+	a.label("waitR4")
+	a.emit(0xdb, 0x06)        // waitR4: IN A,(6)
+	a.emit(0xe6, 0x80)        // AND &80
+	a.jr(0x28, "waitR4")      // JR Z,waitR4
+	a.emit(0xdb, 0x07)        // IN A,(7)
+	a.emit(0x32, 0x05, 0x90)  // LD (&9005),A
+	a.emit(0x21, 0x06, 0x90)  // LD HL,&9006
+	a.address(0xcd, "readR2") // CALL readR2
+	a.emit(0x77, 0x23)        // LD (HL),A: INC HL
+	a.label("error")
+	a.address(0xcd, "readR2") // error: CALL readR2
+	a.emit(0x77, 0x23)        // LD (HL),A: INC HL
+	a.emit(0xb7)              // OR A
+	a.jr(0x20, "error")       // JR NZ,error
+
+	// OSCLI to end
+	a.emit(0x3e, 0x02)            // LD A,2
+	a.address(0xcd, "sendR2")     // CALL sendR2
+	a.address(0x21, "quit")       // LD HL,quit
+	a.address(0xcd, "sendString") // CALL sendString
+	a.label("hang")
+	a.jr(0x18, "hang") // hang: JR hang
+
+	a.label("sendR2")
+	a.emit(0xf5) // sendR2: PUSH AF
+	a.label("sendR2wait")
+	a.emit(0xdb, 0x02)       // IN A,(2)
+	a.emit(0xe6, 0x40)       // AND &40
+	a.jr(0x28, "sendR2wait") // JR Z,sendR2wait
+	a.emit(0xf1)             // POP AF
+	a.emit(0xd3, 0x03)       // OUT (3),A
+	a.emit(0xc9)             // RET
+
+	a.label("readR2")
+	a.emit(0xdb, 0x02)   // readR2: IN A,(2)
+	a.emit(0xe6, 0x80)   // AND &80
+	a.jr(0x28, "readR2") // JR Z,readR2
+	a.emit(0xdb, 0x03)   // IN A,(3)
+	a.emit(0xc9)         // RET
+
+	a.label("printR1")
+	a.emit(0x7e, 0xb7)    // printR1: LD A,(HL): OR A
+	a.emit(0xc8)          // RET Z
+	a.emit(0xd3, 0x01)    // OUT (1),A
+	a.emit(0x23)          // INC HL
+	a.jr(0x18, "printR1") // JR printR1
+
+	a.label("sendString")
+	a.emit(0x7e)              // sendString: LD A,(HL)
+	a.address(0xcd, "sendR2") // CALL sendR2
+	a.emit(0xfe, 0x0d)        // CP &0D
+	a.emit(0xc8)              // RET Z
+	a.emit(0x23)              // INC HL
+	a.jr(0x18, "sendString")  // JR sendString
+
+	a.label("sendBytes")
+	a.emit(0x7e)              // sendBytes: LD A,(HL)
+	a.address(0xcd, "sendR2") // CALL sendR2
+	a.emit(0x23)              // INC HL
+	a.jr(0x10, "sendBytes")   // DJNZ sendBytes
+	a.emit(0xc9)              // RET
+
+	a.label("hello")
+	a.emit([]uint8("Hello from the Z80\r\n\x00")...)
+	a.label("save")
+	a.emit([]uint8("SAVE " + saveFilename + " 9000 9004\r")...)
+	a.label("bad")
+	a.emit([]uint8("NOSUCHCOMMAND\r")...)
+	a.label("quit")
+	a.emit([]uint8("QUIT\r")...)
+	a.label("osword")
+	// OSWORD &7F with the block from the last byte to the first
+	a.emit(0x08, 0x7f, 11)
+	a.emit(0x00, 0x21, 0x02, 0x01, 0x53, 0x03, 0x00, 0x00, 0xa0, 0x00, 0x00)
+	a.emit(11)
+
+	return a.assemble(t)
+}
+
+func TestTubeZ80(t *testing.T) {
+	dir := t.TempDir()
+	saveFilename := filepath.Join(dir, "RESULTS")
+	romFilename := filepath.Join(dir, "client.rom")
+	err := os.WriteFile(romFilename, z80TestClient(t, saveFilename), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The sector 2 of the track 1 has a text
+	disc := make([]uint8, 2*discTrackSize)
+	copy(disc[discTrackSize+2*discSectorSize:], "Sector read")
+	discFilename := filepath.Join(dir, "disc.ssd")
+	err = os.WriteFile(discFilename, disc, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var z *tubeZ80
+	out := integrationTestBasicWithSetup([]string{}, func(env *environment) {
+		err := env.enableTubeZ80(romFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = env.attachDisc(0, discFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z = env.z80
+	})
+
+	if !strings.Contains(out, "Hello from the Z80") {
+		t.Log(out)
+		t.Error("The client should print with OSWRCH on R1")
+	}
+
+	results := z.ram[0x9000:]
+	if results[0] != 0x7f {
+		t.Errorf("The host sent 0x%02x after the reset and should send 0x7f", results[0])
+	}
+	if results[1] != 0 || results[2] != 0 {
+		t.Error("OSBYTE &82 should return &0000 for the second processor")
+	}
+	if results[3] != 0x7f {
+		t.Errorf("OSCLI returned 0x%02x and should return 0x7f", results[3])
+	}
+	saved, err := os.ReadFile(saveFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(saved) != "\x7f\x00\x00\x00" {
+		t.Errorf("The file saved from the Z80 memory has %q", saved)
+	}
+
+	if results[4] != disc8271Ok {
+		t.Errorf("OSWORD &7F returned 0x%02x", results[4])
+	}
+	if !strings.HasPrefix(string(z.ram[0xa000:]), "Sector read") {
+		t.Error("OSWORD &7F should read the sector to the Z80 memory")
+	}
+
+	if results[5] != tubeError || results[6] != 0 || results[7] != 254 {
+		t.Errorf("The error is sent with 0x%02x, 0x%02x, %v", results[5], results[6], results[7])
+	}
+	if !strings.HasPrefix(string(results[8:]), "Bad command\x00") {
+		t.Errorf("The error message is %q", results[8:20])
+	}
+}
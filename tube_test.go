@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func integrationTestTube(lines []string) string {
+	return integrationTestBasicWithSetup(lines, func(env *environment) {
+		env.enableTube()
+	})
+}
+
+func TestTubeMemory(t *testing.T) {
+	out := integrationTestTube([]string{
+		"PRINT ~PAGE,~HIMEM",
+		"MODE 0:PRINT ~HIMEM",
+		"A%=&82:PRINT ~(USR(&FFF4) AND &FFFF00)",
+	})
+
+	if !strings.Contains(out, "PRINT ~PAGE,~HIMEM\n       800      8000\n") {
+		t.Error("The second processor memory is wrong")
+	}
+	if !strings.Contains(out, "MODE 0:PRINT ~HIMEM\n      8000\n") {
+		t.Error("The screen mode should not change HIMEM")
+	}
+	if !strings.Contains(out, "FFF4) AND &FFFF00)\n         0\n") {
+		t.Error("The high order address should be &0000")
+	}
+}
+
+func TestTubeIOMemory(t *testing.T) {
+	out := integrationTestTube([]string{
+		"DIM B% 5:B%!0=&3000:B%!2=&FFFF:B%?4=42",
+		"A%=6:X%=B% MOD 256:Y%=B% DIV 256:CALL &FFF1",
+		"B%?4=0:A%=5:CALL &FFF1",
+		"PRINT B%?4, ?&3000",
+	})
+
+	if !strings.Contains(out, "PRINT B%?4, ?&3000\n        42         0\n") {
+		t.Error("The I/O processor memory should be separate")
+	}
+}
+
+func TestTubeLanguageWorkspace(t *testing.T) {
+	// Pages 4 to 7 are language workspace, only pages 2 and 3 are shared
+	out := integrationTestTube([]string{
+		"?&500=42:DIM B% 5:B%!0=&500:B%!2=&FFFF",
+		"A%=5:X%=B% MOD 256:Y%=B% DIV 256:CALL &FFF1",
+		"PRINT B%?4, ?&500",
+	})
+
+	if !strings.Contains(out, "PRINT B%?4, ?&500\n         0        42\n") {
+		t.Errorf("The language workspace should not be shared: %q", out)
+	}
+}
+
+func TestTubeRelocation(t *testing.T) {
+	// A language relocated to &B800 up to &F7FF that jumps to its relocated
+	// entry and reads a string at &F700 with GSINIT and GSREAD
+	rom := make([]uint8, 0x4000)
+	code := []uint8{
+		0xa9, 'H', // LDA #'H'
+		0x20, 0xee, 0xff, // JSR OSWRCH
+		0xa9, 0x00, // LDA #&00
+		0x85, 0xf2, // STA &F2
+		0xa9, 0xf7, // LDA #&F7
+		0x85, 0xf3, // STA &F3
+		0xa0, 0x00, // LDY #0
+		0x18,             // CLC
+		0x20, 0xc2, 0xff, // JSR GSINIT
+		0x20, 0xc5, 0xff, // JSR GSREAD
+		0x20, 0xee, 0xff, // JSR OSWRCH
+		0x20, 0xe0, 0xff, // JSR OSRDCH
+		0x4c, 0x00, 0xb8, // JMP &B800
+	}
+	copy(rom[0x40:], code)
+	copy(rom[0x3f00:], "\"I\"\r")
+	copy(rom, []uint8{0x4c, 0x40, 0xb8}) // Language entry
+	rom[6] = 0x60                        // Language with relocation address
+	header := "HI\x00(C)\x00\x00\xb8\x00\x00"
+	rom[7] = uint8(9 + 2) // Copyright offset
+	copy(rom[9:], header)
+
+	filename := filepath.Join(t.TempDir(), "hi.rom")
+	err := os.WriteFile(filename, rom, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := integrationTestBasicWithSetup([]string{"A", "B"}, func(env *environment) {
+		env.mem.loadRom(filename, 0xf)
+		env.enableTube()
+	})
+	if !strings.Contains(out, "HIA\nHIB\nHI") {
+		t.Errorf("The language should run relocated: %q", out)
+	}
+}
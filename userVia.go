@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	User VIA, the 6522 at &FE60 with port B on the user port connector and
+	port A on the printer port.
+
+	Port B, the data direction register, the timers and the CB1 and CB2
+	lines are emulated. The interrupt flags are updated, but no IRQ is sent
+	to the CPU. The shift register is just a register. The timers run at
+	1MHz, half the CPU clock.
+
+	The user port can be connected to a host file, named pipe or socket. The
+	changes on the port are sent as text lines:
+		PB=a5     levels of the port B pins, hex
+		DDRB=ff   data direction register, hex
+		CB2=1     CB2 level, when set as output
+	The same kind of lines can be received to set the levels of the input
+	pins, PB=xx, and of the CB1 and CB2 lines, CB1=0 or CB2=1.
+
+	See:
+		https://beebwiki.mdfs.net/User_port
+		http://archive.6502.org/datasheets/rockwell_r6522_via.pdf
+*/
+
+const (
+	viaORB  = 0x0
+	viaORA  = 0x1
+	viaDDRB = 0x2
+	viaDDRA = 0x3
+	viaT1CL = 0x4
+	viaT1CH = 0x5
+	viaT1LL = 0x6
+	viaT1LH = 0x7
+	viaT2CL = 0x8
+	viaT2CH = 0x9
+	viaSR   = 0xa
+	viaACR  = 0xb
+	viaPCR  = 0xc
+	viaIFR  = 0xd
+	viaIER  = 0xe
+	viaORAN = 0xf // ORA without handshake
+
+	viaIntCA2 = 0x01
+	viaIntCA1 = 0x02
+	viaIntSR  = 0x04
+	viaIntCB2 = 0x08
+	viaIntCB1 = 0x10
+	viaIntT2  = 0x20
+	viaIntT1  = 0x40
+	viaIntIRQ = 0x80
+)
+
+type userVia struct {
+	mutex  sync.Mutex
+	cycles func() uint64
+
+	orb, ora   uint8
+	ddrb, ddra uint8
+	pinsB      uint8 // Levels driven from outside on the port B pins
+	cb1, cb2   bool
+	sr         uint8
+	acr, pcr   uint8
+	ifr, ier   uint8
+
+	t1Counter, t1Latch uint16
+	t1Armed            bool
+	t2Counter, t2Latch uint16
+	t2Armed            bool
+	lastCycles         uint64
+
+	link      io.Writer
+	linkClose []io.Closer
+	lastSent  string
+}
+
+func newUserVia(cycles func() uint64) *userVia {
+	var v userVia
+	v.cycles = cycles
+	v.pinsB = 0xff // Pull ups
+	v.cb1 = true
+	v.cb2 = true
+	v.t1Latch = 0xffff
+	v.t1Counter = 0xffff
+	v.t2Counter = 0xffff
+	return &v
+}
+
+func (v *userVia) peek(address uint16) uint8 {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.updateTimers()
+
+	switch address & 0xf {
+	case viaORB:
+		v.clearPortBFlags()
+		return v.orb&v.ddrb | v.pinsB&^v.ddrb
+	case viaORA:
+		v.ifr &^= viaIntCA1 | viaIntCA2
+		return v.ora&v.ddra | ^v.ddra
+	case viaORAN:
+		return v.ora&v.ddra | ^v.ddra
+	case viaDDRB:
+		return v.ddrb
+	case viaDDRA:
+		return v.ddra
+	case viaT1CL:
+		v.ifr &^= viaIntT1
+		return uint8(v.t1Counter)
+	case viaT1CH:
+		return uint8(v.t1Counter >> 8)
+	case viaT1LL:
+		return uint8(v.t1Latch)
+	case viaT1LH:
+		return uint8(v.t1Latch >> 8)
+	case viaT2CL:
+		v.ifr &^= viaIntT2
+		return uint8(v.t2Counter)
+	case viaT2CH:
+		return uint8(v.t2Counter >> 8)
+	case viaSR:
+		v.ifr &^= viaIntSR
+		return v.sr
+	case viaACR:
+		return v.acr
+	case viaPCR:
+		return v.pcr
+	case viaIFR:
+		return v.interruptFlags()
+	default: // viaIER
+		return v.ier | 0x80
+	}
+}
+
+func (v *userVia) poke(address uint16, value uint8) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.updateTimers()
+
+	switch address & 0xf {
+	case viaORB:
+		v.clearPortBFlags()
+		v.orb = value
+		v.sendPortB()
+	case viaORA:
+		v.ifr &^= viaIntCA1 | viaIntCA2
+		v.ora = value
+	case viaORAN:
+		v.ora = value
+	case viaDDRB:
+		v.ddrb = value
+		v.send(fmt.Sprintf("DDRB=%02x", v.ddrb))
+		v.sendPortB()
+	case viaDDRA:
+		v.ddra = value
+	case viaT1CL, viaT1LL:
+		v.t1Latch = v.t1Latch&0xff00 | uint16(value)
+	case viaT1CH:
+		v.t1Latch = v.t1Latch&0x00ff | uint16(value)<<8
+		v.t1Counter = v.t1Latch
+		v.t1Armed = true
+		v.ifr &^= viaIntT1
+	case viaT1LH:
+		v.t1Latch = v.t1Latch&0x00ff | uint16(value)<<8
+		v.ifr &^= viaIntT1
+	case viaT2CL:
+		v.t2Latch = v.t2Latch&0xff00 | uint16(value)
+	case viaT2CH:
+		v.t2Counter = v.t2Latch&0x00ff | uint16(value)<<8
+		v.t2Armed = true
+		v.ifr &^= viaIntT2
+	case viaSR:
+		v.ifr &^= viaIntSR
+		v.sr = value
+	case viaACR:
+		v.acr = value
+	case viaPCR:
+		v.pcr = value
+		v.sendCB2()
+	case viaIFR:
+		v.ifr &^= value & 0x7f
+	default: // viaIER
+		if value&0x80 != 0 {
+			v.ier |= value & 0x7f
+		} else {
+			v.ier &^= value & 0x7f
+		}
+	}
+}
+
+func (v *userVia) interruptFlags() uint8 {
+	flags := v.ifr & 0x7f
+	if flags&v.ier != 0 {
+		flags |= viaIntIRQ
+	}
+	return flags
+}
+
+func (v *userVia) clearPortBFlags() {
+	v.ifr &^= viaIntCB1
+	// CB2 in independent interrupt input mode is not cleared by port B accesses
+	cb2Mode := v.pcr >> 5
+	if cb2Mode != 1 && cb2Mode != 3 {
+		v.ifr &^= viaIntCB2
+	}
+}
+
+func (v *userVia) updateTimers() {
+	now := v.cycles()
+	elapsed := (now - v.lastCycles) / 2 // The VIA runs at 1MHz
+	v.lastCycles += elapsed * 2
+	if elapsed == 0 {
+		return
+	}
+
+	// Timer 1, reloads from the latch, one shot or free running
+	if elapsed <= uint64(v.t1Counter) {
+		v.t1Counter -= uint16(elapsed)
+	} else {
+		period := uint64(v.t1Latch) + 2
+		remaining := (elapsed - uint64(v.t1Counter) - 1) % period
+		v.t1Counter = uint16(uint64(v.t1Latch) + 1 - remaining)
+		if v.t1Armed {
+			v.ifr |= viaIntT1
+			if v.acr&0x40 == 0 {
+				v.t1Armed = false // One shot
+			}
+		}
+	}
+
+	// Timer 2, one shot. It counts PB6 pulses instead if ACR bit 5 is set
+	if v.acr&0x20 == 0 {
+		if elapsed > uint64(v.t2Counter) && v.t2Armed {
+			v.ifr |= viaIntT2
+			v.t2Armed = false
+		}
+		v.t2Counter -= uint16(elapsed)
+	}
+}
+
+// Changes on the lines from the host
+func (v *userVia) setInput(line string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	name, value, found := strings.Cut(strings.TrimSpace(line), "=")
+	if !found {
+		return
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(value), 16, 8)
+	if err != nil {
+		return
+	}
+	switch strings.ToUpper(strings.TrimSpace(name)) {
+	case "PB":
+		if v.pinsB&0x40 != 0 && n&0x40 == 0 && v.acr&0x20 != 0 {
+			// Pulse counting on PB6 with timer 2
+			if v.t2Counter == 0 && v.t2Armed {
+				v.ifr |= viaIntT2
+				v.t2Armed = false
+			}
+			v.t2Counter--
+		}
+		v.pinsB = uint8(n)
+	case "CB1":
+		level := n != 0
+		// PCR bit 4 selects the active edge, 0 negative and 1 positive
+		if level != v.cb1 && level == (v.pcr&0x10 != 0) {
+			v.ifr |= viaIntCB1
+		}
+		v.cb1 = level
+	case "CB2":
+		level := n != 0
+		if v.pcr&0x80 == 0 {
+			// Input mode, PCR bit 6 selects the active edge
+			if level != v.cb2 && level == (v.pcr&0x40 != 0) {
+				v.ifr |= viaIntCB2
+			}
+			v.cb2 = level
+		}
+	}
+}
+
+func (v *userVia) sendPortB() {
+	v.send(fmt.Sprintf("PB=%02x", v.orb&v.ddrb|v.pinsB&^v.ddrb))
+}
+
+func (v *userVia) sendCB2() {
+	// Manual output modes, 110 low and 111 high
+	switch v.pcr >> 5 {
+	case 6:
+		v.send("CB2=0")
+	case 7:
+		v.send("CB2=1")
+	}
+}
+
+func (v *userVia) send(line string) {
+	if v.link == nil || line == v.lastSent {
+		return
+	}
+	v.lastSent = line
+	fmt.Fprintln(v.link, line)
+}
+
+/*
+Connect the user port to the host. The output can be a file, a named pipe,
+"tcp:host:port" or "unix:path". The sockets are bidirectional, for files
+and pipes the input can be set separately.
+*/
+func (v *userVia) connect(output string, input string) error {
+	var reader io.Reader
+	switch {
+	case strings.HasPrefix(output, "tcp:"), strings.HasPrefix(output, "unix:"):
+		network, address, _ := strings.Cut(output, ":")
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return err
+		}
+		v.link = conn
+		v.linkClose = append(v.linkClose, conn)
+		reader = conn
+	case output != "":
+		file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		v.link = file
+		v.linkClose = append(v.linkClose, file)
+	}
+
+	if input != "" {
+		file, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		v.linkClose = append(v.linkClose, file)
+		reader = file
+	}
+
+	if reader != nil {
+		go func() {
+			scanner := bufio.NewScanner(reader)
+			for scanner.Scan() {
+				v.setInput(scanner.Text())
+			}
+		}()
+	}
+	return nil
+}
+
+func (v *userVia) close() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for _, c := range v.linkClose {
+		c.Close()
+	}
+	v.linkClose = nil
+	v.link = nil
+}
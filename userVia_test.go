@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUserViaPortB(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"PRINT ~?&FE60",
+		"?&FE62=&F0:?&FE60=&A5",
+		"PRINT ~?&FE60",
+	})
+
+	if !strings.Contains(out, "PRINT ~?&FE60\n        FF\n") {
+		t.Error("The input pins should be pulled up")
+	}
+	if !strings.Contains(out, "?&FE60=&A5\n>PRINT ~?&FE60\n        AF\n") {
+		t.Error("The output pins should be the output register")
+	}
+}
+
+func TestUserViaTimer(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"?&FE6B=0:?&FE68=255:?&FE69=255",
+		"PRINT ?&FE6D AND &20",
+		"FOR I%=1 TO 2000:NEXT",
+		"PRINT ?&FE6D AND &20",
+		"A%=?&FE68",
+		"PRINT ?&FE6D AND &20",
+	})
+
+	if !strings.Contains(out, "?&FE69=255\n>PRINT ?&FE6D AND &20\n         0\n") {
+		t.Error("The timer 2 should not have expired")
+	}
+	if !strings.Contains(out, "NEXT\n>PRINT ?&FE6D AND &20\n        32\n") {
+		t.Error("The timer 2 should have expired")
+	}
+	if !strings.Contains(out, "A%=?&FE68\n>PRINT ?&FE6D AND &20\n         0\n") {
+		t.Error("Reading the timer 2 should clear the flag")
+	}
+}
+
+func TestUserViaLink(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "userport.txt")
+
+	var env *environment
+	out := integrationTestBasicWithSetup([]string{
+		"?&FE62=&0F:?&FE60=&03",
+		"PRINT ~?&FE60",
+	}, func(e *environment) {
+		env = e
+		err := env.userVia.connect(filename, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.userVia.setInput("PB=50")
+	})
+	env.userVia.close()
+
+	if !strings.Contains(out, "PRINT ~?&FE60\n        53\n") {
+		t.Error("The input pins should be set from the host")
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "DDRB=0f\nPB=50\nPB=53\n" {
+		t.Errorf("Wrong user port output: %q", string(data))
+	}
+}
@@ -1,20 +1,44 @@
 package main
 
-import "fmt"
-
 type vdu struct {
-	env   *environment
-	queue []uint8
-	mode  uint8
+	env    *environment
+	queue  []uint8
+	mode   uint8
+	shadow bool // The screen is on the shadow memory, see vduScreen.go
+
+	// Cursor and windows, see vduVariables.go
+	cursorX             uint8
+	cursorY             uint8
+	textWindow          [4]uint8 // left, bottom, right, top
+	graphWindow         [4]int16 // left, bottom, right, top
+	graphOrigin         [2]int16
+	graphCursor         [2]int16
+	oldGraphCursor      [2]int16
+	graphPlotMode       uint8
+	graphBackPlotMode   uint8
+	cursorStartRegister uint8
 
-	// Mode 0-6
-	textColour  uint8
-	graphColour uint8
+	// Mode 0-6, see vduColours.go
+	textColour      uint8
+	textBackground  uint8
+	graphColour     uint8
+	graphBackground uint8
+	palette         [16]uint8
+	font            [256][8]uint8 // See vduFont.go
 
-	// Mode 7
-	m7fgColour uint8
-	m7bgColour uint8
-	m7Flash    bool
+	// Mode 7, see vduMode7.go
+	m7fgColour      uint8
+	m7bgColour      uint8
+	m7Flash         bool
+	m7Graphics      bool  // Graphics or alphanumerics
+	m7Separated     bool  // Separated or contiguous graphics
+	m7Conceal       bool  // Conceal display
+	m7Hold          bool  // Hold graphics
+	m7HeldChar      uint8 // Last graphics char for hold graphics, 0 if none
+	m7HeldSeparated bool
+	m7DoubleHeight  bool
+	m7RowDouble     bool // The current row has double height chars
+	m7BottomRow     bool // The current row is the bottom half of a double height row
 
 	// Toogles
 	printer  bool // VDU2 and VDU3
@@ -30,8 +54,7 @@ func newVdu(env *environment) *vdu {
 	argsNeeded[1] = 1
 	argsNeeded[17] = 1
 	argsNeeded[18] = 2
-	argsNeeded[19] = 3
-	argsNeeded[20] = 4
+	argsNeeded[19] = 5
 	argsNeeded[22] = 1
 	argsNeeded[23] = 9
 	argsNeeded[24] = 8
@@ -45,10 +68,31 @@ func newVdu(env *environment) *vdu {
 	// Mode 7 on startup
 	v.mode = 7
 	v.m7fgColour = 7 // white
+	v.cursorStartRegister = 0x72
+	v.resetWindows()
+	v.resetColours()
+	v.font = bbcFont
 
 	return &v
 }
 
+func (v *vdu) pagedLineFeed() {
+	/*
+		In paged mode the output stops when the lines written since the
+		last keyboard input would scroll out of the text window. We can't
+		detect the SHIFT key alone on the host, we wait for a keypress.
+	*/
+	count := v.env.mem.Peek(mosPagedLineCount)
+	if int(count) >= v.textWindowHeight()-1 {
+		_, stop := v.env.readChar()
+		if stop {
+			v.env.stop = true
+		}
+		count = 0
+	}
+	v.env.mem.Poke(mosPagedLineCount, count+1)
+}
+
 func (v *vdu) clearQueue() {
 	v.queue = nil
 }
@@ -141,7 +185,7 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 		   keyboard as CTRL G, causes the computer to make a short ‘beep’. This code is
 		   not normally passed to the printer.
 		*/
-		out = string(cmd)
+		v.env.bell()
 	case 8:
 		/*
 		   8 This code (VDU8 or CTRL H) moves the text cursor one space to the left. If the
@@ -149,12 +193,14 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 		   line. It does not delete characters – unlike VDU127.
 		*/
 		out = string(cmd)
+		v.cursorLeft()
 	case 9:
 		/*
 		   9 This code (VDU9 or CTRL I or TAB) moves the cursor forward one character
 		   position.
 		*/
 		out = "\x1b[C"
+		v.cursorRight()
 	case 10:
 		/*
 		   This statement (VDU10 or CTRL J) will move the cursor down one line. If the
@@ -162,13 +208,19 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 		   moved up one line.
 		*/
 		//out = "\x1b[B" // Not the normal \n, here we need \r\n
+		if v.paged {
+			v.pagedLineFeed()
+		}
 		out = v.mode7ResetCode() + string(cmd)
+		v.mode7NextRow()
+		v.cursorDown()
 	case 11:
 		/*
 		   This code (VDU11 or CTRL K) moves the text cursor up one line. If the cursor
 		   is at the top of the screen then the whole display will move down a line.
 		*/
 		out = "\x1b[A"
+		v.cursorUp()
 	case 12:
 		/*
 		   This code clears the screen – or at least the text area of the screen. The screen
@@ -176,7 +228,8 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 		   statement CLS has exactly the same effect as VDU12, or CTRL L. This code also
 		   moves the text cursor to the top left of the text window.
 		*/
-		out = v.mode7ResetCode() + "\x1b[2J\x1b[H"
+		out = v.mode7ResetCode() + "\x1b[2J" + v.cursorHome()
+		v.mode7FirstRow()
 	case 13:
 		/*
 		   This code is produced by the RETURN key. However, its effect on the screen
@@ -185,6 +238,7 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 		   course).
 		*/
 		out = v.mode7ResetCode() + string(cmd)
+		v.cursorX = v.textWindow[0]
 	case 14:
 		/*
 		   This code makes the screen display wait at the bottom of each page. It is
@@ -195,6 +249,7 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 		   of a page both the shift lock and caps lock lights will be illuminated.
 		*/
 		v.paged = true
+		v.env.mem.Poke(mosPagedLineCount, 0)
 	case 15:
 		/*
 		   This code causes the computer to leave paged mode.
@@ -216,7 +271,7 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 		   by one number which determines the new colour. See the BASIC keyword
 		   COLOUR for more details.
 		*/
-		v.textColour = q[0]
+		out = v.setTextColour(q[0])
 	case 18:
 		/*
 			This code allows the definition of the graphics foreground and background
@@ -234,7 +289,7 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 			number of colours available). If the byte is less than 128 then it defines the
 			graphics foreground colour (modulo the number of colours available).
 		*/
-		v.graphColour = q[0]
+		v.setGraphicsColour(q[0], q[1])
 	case 19:
 		/*
 			This code is used to select the actual colour that is to be displayed for each
@@ -255,7 +310,7 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 			We say that logical colours are reduced modulo the number of colours available in
 			any particular MODE.
 		*/
-		// TODO
+		out = v.setPalette(q[0], q[1])
 	case 20:
 		/*
 			This code (VDU20 or CTRL T) resets text and graphics foreground logical
@@ -287,7 +342,7 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 					14=Flashing cyan/red
 					15=Flashing white/black353
 		*/
-		// TODO: non mode 7 colours
+		out = v.resetColours()
 	case 21:
 		/*
 			This code behaves in two different ways. If entered at the keyboard (as CTRL
@@ -303,9 +358,23 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 			This VDU code is used to change MODE. It is followed by one number which is
 			the new MODE. Thus VDU22,7 is exactly equivalent to MODE 7 (except that it
 			does not change HIMEM).
+			Modes 128 to 135 are the same modes with the screen on the shadow memory.
 		*/
-		v.mode = q[0]
 		out = v.mode7ResetCode()
+		if v.mode != 7 {
+			out += "\x1b[0m"
+		}
+		v.mode = q[0] & 7
+		v.setShadow(v.isShadowMode(q[0]))
+		v.resetWindows()
+		v.resetColours()
+		v.graphCursor = [2]int16{0, 0}
+		if v.mode == 7 {
+			v.cursorStartRegister = 0x72
+		} else {
+			v.cursorStartRegister = 0x67
+		}
+		v.mode7FirstRow()
 	case 23:
 		/*
 			This code is used to reprogram displayed characters. The ASCII code assigns
@@ -317,7 +386,7 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 			can redefine any character that is displayed, but extra memory must be set aside
 			if this is done.
 		*/
-		// TODO: user defined characters
+		out = v.vdu23(q)
 	case 24:
 		/*
 		   This code enables the user to define the graphics window – that is, the area of
@@ -331,7 +400,8 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 		   in the VDU statement sends the number as a two byte pair with low byte first
 		   followed by the high byte.
 		*/
-		// TODO: graphic window
+		v.setGraphicsWindow(int16(q[0])+int16(q[1])<<8, int16(q[2])+int16(q[3])<<8,
+			int16(q[4])+int16(q[5])<<8, int16(q[6])+int16(q[7])<<8)
 	case 25:
 		/*
 		   This VDU code is identical to the BASIC PLOT statement. Only those writing
@@ -346,7 +416,8 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 		   The above is completely equivalent to
 		   		VDU 25,4,100,0,244,1
 		*/
-		// TODO: graphic plot
+		// TODO: graphic plot, only the graphics cursor is updated
+		v.plot(q[0], int16(q[1])+int16(q[2])<<8, int16(q[3])+int16(q[4])<<8)
 	case 26:
 		/*
 		   The code VDU26 CTRL Z) returns both the graphics and text windows to
@@ -355,8 +426,10 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 		   sets the graphics origin to the bottom left of the screen. In this state it is possible
 		   to write text and to draw graphics anywhere on the screen.
 		*/
-		out = v.mode7ResetCode() + "\x1b[H"
-		// TODO: graphics reset
+		v.resetWindows()
+		v.graphCursor = [2]int16{0, 0}
+		out = v.mode7ResetCode() + v.cursorHome()
+		v.mode7FirstRow()
 	case 27:
 		/*
 		   This code does nothing.
@@ -377,7 +450,7 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 			   Note that the units are character positions and the maximum values will depend
 			   on the MODE in use.
 		*/
-		// TODO: text window
+		v.setTextWindow(q[0], q[1], q[2], q[3])
 	case 29:
 		/*
 		   This code is used to move the graphics origin. The statement VDU29 is
@@ -389,13 +462,14 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 		   colons. See the entry for VDU24 if you require an explanation of the trailing
 		   semi-colons. Note also that the graphics cursor is not affected by VDU29.
 		*/
-		// TODO: graphics origin
+		v.graphOrigin = [2]int16{int16(q[0]) + int16(q[1])<<8, int16(q[2]) + int16(q[3])<<8}
 	case 30:
 		/*
 		   This code (VDU30 or CTRL ^) moves the text cursor to the top left of the text
 		   area.
 		*/
-		out = v.mode7ResetCode() + "\x1b[H"
+		out = v.mode7ResetCode() + v.cursorHome()
+		v.mode7FirstRow()
 	case 31:
 		/*
 		   The code VDU31 enables the text cursor to be moved to any character position
@@ -408,7 +482,7 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 		   both X and Y are measured from the edges of the current text window not the
 		   edges of the screen.
 		*/
-		// TODO: move text cursor
+		out = v.moveCursor(q[0], q[1])
 	case 127:
 		/*
 		   127 This code moves the text cursor back one character and deletes the
@@ -416,43 +490,17 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 		   key.
 		*/
 		out = "\x1b[D \x1b[D"
+		v.cursorLeft()
 
 	default:
+		v.cursorRight()
 		if v.mode == 7 {
-			/*
-				The order of colors is: black, red, green, yellow, blue, magenta,
-				cyan and white for mmode 7 and for ANSI.
-				Red is:
-				 - 129 as control code
-				 . 1 as m7fgColour and m7bgColour
-				 . 31 as ANSI fg color
-				 - 41 as ANSI bg color
-			*/
-			switch {
-			case 129 <= cmd && cmd <= 135: // Text colors
-				v.m7fgColour = cmd - 129 + 1
-				out = fmt.Sprintf("\x1b[%vm ", v.m7fgColour+30)
-			case cmd == 136: // Flash
-				v.m7Flash = true
-				out = "\x1b[5m "
-			case cmd == 137: // Steady (not flash)
-				v.m7Flash = false
-				out = "\x1b[25m "
-			case cmd == 156: // Black background
-				v.m7bgColour = 0
-				out = fmt.Sprintf("\x1b[%vm ", v.m7bgColour+40)
-			case cmd == 157: // New background
-				v.m7bgColour = v.m7fgColour
-				out = fmt.Sprintf("\x1b[%vm ", v.m7bgColour+40)
-			case 128 <= cmd && cmd <= 159: // Rest
-				out = " "
-			default:
-				out = adjustAsciiMode7(cmd)
-			}
-
+			out = v.writeMode7(cmd)
 		} else {
 			// Modes 0 to 6
 			switch {
+			case v.isCharRedefined(cmd):
+				out = v.glyph(cmd)
 			case 32 <= cmd && cmd <= 126:
 				/*
 				   32-126 These codes generate the full set of letters and numbers in the ASCII set.
@@ -481,30 +529,12 @@ func (v *vdu) writeInternal(cmd uint8, q []uint8) {
 	if out != "" && !v.ignore {
 		v.env.con.write(out)
 	}
-}
 
-func (v *vdu) mode7ResetCode() string {
-	if v.mode != 7 {
-		return ""
-	}
-	out := ""
-	if v.m7fgColour != 7 /* white */ {
-		out += "\x1b[37m"
-		v.m7fgColour = 7
-	}
-	if v.m7bgColour != 0 /* black */ {
-		out += "\x1b[40m"
-		v.m7bgColour = 0
-	}
-	if v.m7Flash {
-		out += "\x1b[25m"
-		v.m7Flash = false
+	if cmd < 32 || cmd == 127 {
+		v.updateVariables()
+	} else {
+		v.updateCursorVariables()
 	}
-	return out
-}
-
-func (v *vdu) mode7Reset() {
-	v.env.con.write(v.mode7ResetCode())
 }
 
 func adjustAscii(ch uint8) string {
@@ -519,36 +549,3 @@ func adjustAscii(ch uint8) string {
 
 	return string(ch)
 }
-
-func adjustAsciiMode7(ch uint8) string {
-	// Some chars are different from standard ASCII
-	// See: http://beebwiki.mdfs.net/ASCII
-
-	// Commented out to allow non-ASCII latin 1 characters
-	// ch = ch & 0x7f
-
-	switch ch {
-	case '[':
-		return "←"
-	case '\\':
-		return "½"
-	case ']':
-		return "→"
-	case '^':
-		return "↑"
-	case '_':
-		return "–"
-	case '`':
-		return "£"
-	case '{':
-		return "¼"
-	case '|':
-		return "‖"
-	case '}':
-		return "¾"
-	case '~':
-		return "÷"
-	}
-
-	return string(ch)
-}
@@ -0,0 +1,86 @@
+package main
+
+import "fmt"
+
+/*
+	Logical to physical colour mapping for modes 0 to 6. The ANSI order of
+	colours is the same as the BBC Micro physical colours 0 to 7. The physical
+	colours 8 to 15 flash between the colour c-8 and its complement; on the
+	terminal they are shown as the first colour blinking.
+
+	See:
+		https://beebwiki.mdfs.net/VDU_19
+		https://beebwiki.mdfs.net/VDU_20
+*/
+
+var defaultPalettes = map[uint8][]uint8{
+	2:  {0, 7},
+	4:  {0, 1, 3, 7},
+	16: {0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+}
+
+func (v *vdu) resetColours() string {
+	colours := v.modeInfo().colours
+	copy(v.palette[:], defaultPalettes[colours])
+	v.textColour = colours - 1
+	v.textBackground = 0
+	v.graphColour = colours - 1
+	v.graphBackground = 0
+
+	if v.mode == 7 {
+		return ""
+	}
+	return v.textColourCode()
+}
+
+func (v *vdu) setTextColour(colour uint8) string {
+	colours := v.modeInfo().colours
+	if colour < 128 {
+		v.textColour = colour % colours
+	} else {
+		v.textBackground = (colour - 128) % colours
+	}
+
+	if v.mode == 7 {
+		return ""
+	}
+	return v.textColourCode()
+}
+
+func (v *vdu) setGraphicsColour(plotMode uint8, colour uint8) {
+	colours := v.modeInfo().colours
+	if colour < 128 {
+		v.graphColour = colour % colours
+		v.graphPlotMode = plotMode
+	} else {
+		v.graphBackground = (colour - 128) % colours
+		v.graphBackPlotMode = plotMode
+	}
+}
+
+func (v *vdu) setPalette(logical uint8, physical uint8) string {
+	logical = logical % v.modeInfo().colours
+	v.palette[logical] = physical & 0xf
+
+	if v.mode == 7 ||
+		(logical != v.textColour && logical != v.textBackground) {
+		return ""
+	}
+	return v.textColourCode()
+}
+
+func (v *vdu) textColourCode() string {
+	fg := v.palette[v.textColour]
+	bg := v.palette[v.textBackground]
+
+	if fg == 7 && bg == 0 {
+		// The default colours are the terminal defaults
+		return "\x1b[0m"
+	}
+
+	blink := 25
+	if fg >= 8 || bg >= 8 {
+		blink = 5
+	}
+	return fmt.Sprintf("\x1b[%v;%v;%vm", blink, fg&7+30, bg&7+40)
+}
@@ -0,0 +1,202 @@
+package main
+
+/*
+	Character definitions, 8 rows of 8 pixels for each char. They are used
+	by VDU 23 and OSWORD &0A, and to render the redefined chars on modes 0 to
+	6. The terminal can't show the pixels, the glyph is approximated by the
+	2x3 Unicode sextant with the same shape.
+
+	See:
+		https://beebwiki.mdfs.net/VDU_23
+		https://beebwiki.mdfs.net/OSWORD_%260A
+*/
+
+// Font of the MOS 1.20, chars 32 to 127. The rest are undefined.
+var bbcFont = [256][8]uint8{
+	32:  {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // space
+	33:  {0x18, 0x18, 0x18, 0x18, 0x18, 0x00, 0x18, 0x00}, // !
+	34:  {0x6c, 0x6c, 0x6c, 0x00, 0x00, 0x00, 0x00, 0x00}, // "
+	35:  {0x36, 0x36, 0x7f, 0x36, 0x7f, 0x36, 0x36, 0x00}, // #
+	36:  {0x0c, 0x3f, 0x68, 0x3e, 0x0b, 0x7e, 0x18, 0x00}, // $
+	37:  {0x60, 0x66, 0x0c, 0x18, 0x30, 0x66, 0x06, 0x00}, // %
+	38:  {0x38, 0x6c, 0x6c, 0x38, 0x6d, 0x66, 0x3b, 0x00}, // &
+	39:  {0x0c, 0x18, 0x30, 0x00, 0x00, 0x00, 0x00, 0x00}, // '
+	40:  {0x0c, 0x18, 0x30, 0x30, 0x30, 0x18, 0x0c, 0x00}, // (
+	41:  {0x30, 0x18, 0x0c, 0x0c, 0x0c, 0x18, 0x30, 0x00}, // )
+	42:  {0x00, 0x18, 0x7e, 0x3c, 0x7e, 0x18, 0x00, 0x00}, // *
+	43:  {0x00, 0x18, 0x18, 0x7e, 0x18, 0x18, 0x00, 0x00}, // +
+	44:  {0x00, 0x00, 0x00, 0x00, 0x00, 0x18, 0x18, 0x30}, // ,
+	45:  {0x00, 0x00, 0x00, 0x7e, 0x00, 0x00, 0x00, 0x00}, // -
+	46:  {0x00, 0x00, 0x00, 0x00, 0x00, 0x18, 0x18, 0x00}, // .
+	47:  {0x00, 0x06, 0x0c, 0x18, 0x30, 0x60, 0x00, 0x00}, // /
+	48:  {0x3c, 0x66, 0x6e, 0x7e, 0x76, 0x66, 0x3c, 0x00}, // 0
+	49:  {0x18, 0x38, 0x18, 0x18, 0x18, 0x18, 0x7e, 0x00}, // 1
+	50:  {0x3c, 0x66, 0x06, 0x0c, 0x18, 0x30, 0x7e, 0x00}, // 2
+	51:  {0x3c, 0x66, 0x06, 0x1c, 0x06, 0x66, 0x3c, 0x00}, // 3
+	52:  {0x0c, 0x1c, 0x3c, 0x6c, 0x7e, 0x0c, 0x0c, 0x00}, // 4
+	53:  {0x7e, 0x60, 0x7c, 0x06, 0x06, 0x66, 0x3c, 0x00}, // 5
+	54:  {0x1c, 0x30, 0x60, 0x7c, 0x66, 0x66, 0x3c, 0x00}, // 6
+	55:  {0x7e, 0x06, 0x0c, 0x18, 0x30, 0x30, 0x30, 0x00}, // 7
+	56:  {0x3c, 0x66, 0x66, 0x3c, 0x66, 0x66, 0x3c, 0x00}, // 8
+	57:  {0x3c, 0x66, 0x66, 0x3e, 0x06, 0x0c, 0x38, 0x00}, // 9
+	58:  {0x00, 0x00, 0x18, 0x18, 0x00, 0x18, 0x18, 0x00}, // :
+	59:  {0x00, 0x00, 0x18, 0x18, 0x00, 0x18, 0x18, 0x30}, // ;
+	60:  {0x0c, 0x18, 0x30, 0x60, 0x30, 0x18, 0x0c, 0x00}, // <
+	61:  {0x00, 0x00, 0x7e, 0x00, 0x7e, 0x00, 0x00, 0x00}, // =
+	62:  {0x30, 0x18, 0x0c, 0x06, 0x0c, 0x18, 0x30, 0x00}, // >
+	63:  {0x3c, 0x66, 0x0c, 0x18, 0x18, 0x00, 0x18, 0x00}, // ?
+	64:  {0x3c, 0x66, 0x6e, 0x6a, 0x6e, 0x60, 0x3c, 0x00}, // @
+	65:  {0x3c, 0x66, 0x66, 0x7e, 0x66, 0x66, 0x66, 0x00}, // A
+	66:  {0x7c, 0x66, 0x66, 0x7c, 0x66, 0x66, 0x7c, 0x00}, // B
+	67:  {0x3c, 0x66, 0x60, 0x60, 0x60, 0x66, 0x3c, 0x00}, // C
+	68:  {0x78, 0x6c, 0x66, 0x66, 0x66, 0x6c, 0x78, 0x00}, // D
+	69:  {0x7e, 0x60, 0x60, 0x7c, 0x60, 0x60, 0x7e, 0x00}, // E
+	70:  {0x7e, 0x60, 0x60, 0x7c, 0x60, 0x60, 0x60, 0x00}, // F
+	71:  {0x3c, 0x66, 0x60, 0x6e, 0x66, 0x66, 0x3c, 0x00}, // G
+	72:  {0x66, 0x66, 0x66, 0x7e, 0x66, 0x66, 0x66, 0x00}, // H
+	73:  {0x7e, 0x18, 0x18, 0x18, 0x18, 0x18, 0x7e, 0x00}, // I
+	74:  {0x3e, 0x0c, 0x0c, 0x0c, 0x0c, 0x6c, 0x38, 0x00}, // J
+	75:  {0x66, 0x6c, 0x78, 0x70, 0x78, 0x6c, 0x66, 0x00}, // K
+	76:  {0x60, 0x60, 0x60, 0x60, 0x60, 0x60, 0x7e, 0x00}, // L
+	77:  {0x63, 0x77, 0x7f, 0x6b, 0x6b, 0x63, 0x63, 0x00}, // M
+	78:  {0x66, 0x66, 0x76, 0x7e, 0x6e, 0x66, 0x66, 0x00}, // N
+	79:  {0x3c, 0x66, 0x66, 0x66, 0x66, 0x66, 0x3c, 0x00}, // O
+	80:  {0x7c, 0x66, 0x66, 0x7c, 0x60, 0x60, 0x60, 0x00}, // P
+	81:  {0x3c, 0x66, 0x66, 0x66, 0x6a, 0x6c, 0x36, 0x00}, // Q
+	82:  {0x7c, 0x66, 0x66, 0x7c, 0x6c, 0x66, 0x66, 0x00}, // R
+	83:  {0x3c, 0x66, 0x60, 0x3c, 0x06, 0x66, 0x3c, 0x00}, // S
+	84:  {0x7e, 0x18, 0x18, 0x18, 0x18, 0x18, 0x18, 0x00}, // T
+	85:  {0x66, 0x66, 0x66, 0x66, 0x66, 0x66, 0x3c, 0x00}, // U
+	86:  {0x66, 0x66, 0x66, 0x66, 0x66, 0x3c, 0x18, 0x00}, // V
+	87:  {0x63, 0x63, 0x6b, 0x6b, 0x7f, 0x77, 0x63, 0x00}, // W
+	88:  {0x66, 0x66, 0x3c, 0x18, 0x3c, 0x66, 0x66, 0x00}, // X
+	89:  {0x66, 0x66, 0x66, 0x3c, 0x18, 0x18, 0x18, 0x00}, // Y
+	90:  {0x7e, 0x06, 0x0c, 0x18, 0x30, 0x60, 0x7e, 0x00}, // Z
+	91:  {0x7c, 0x60, 0x60, 0x60, 0x60, 0x60, 0x7c, 0x00}, // [
+	92:  {0x00, 0x60, 0x30, 0x18, 0x0c, 0x06, 0x00, 0x00}, // \
+	93:  {0x3e, 0x06, 0x06, 0x06, 0x06, 0x06, 0x3e, 0x00}, // ]
+	94:  {0x18, 0x3c, 0x66, 0x42, 0x00, 0x00, 0x00, 0x00}, // ^
+	95:  {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff}, // _
+	96:  {0x1c, 0x36, 0x30, 0x7c, 0x30, 0x30, 0x7e, 0x00}, // £
+	97:  {0x00, 0x00, 0x3c, 0x06, 0x3e, 0x66, 0x3e, 0x00}, // a
+	98:  {0x60, 0x60, 0x7c, 0x66, 0x66, 0x66, 0x7c, 0x00}, // b
+	99:  {0x00, 0x00, 0x3c, 0x66, 0x60, 0x66, 0x3c, 0x00}, // c
+	100: {0x06, 0x06, 0x3e, 0x66, 0x66, 0x66, 0x3e, 0x00}, // d
+	101: {0x00, 0x00, 0x3c, 0x66, 0x7e, 0x60, 0x3c, 0x00}, // e
+	102: {0x1c, 0x30, 0x30, 0x7c, 0x30, 0x30, 0x30, 0x00}, // f
+	103: {0x00, 0x00, 0x3e, 0x66, 0x66, 0x3e, 0x06, 0x3c}, // g
+	104: {0x60, 0x60, 0x7c, 0x66, 0x66, 0x66, 0x66, 0x00}, // h
+	105: {0x18, 0x00, 0x38, 0x18, 0x18, 0x18, 0x3c, 0x00}, // i
+	106: {0x18, 0x00, 0x38, 0x18, 0x18, 0x18, 0x18, 0x70}, // j
+	107: {0x60, 0x60, 0x66, 0x6c, 0x78, 0x6c, 0x66, 0x00}, // k
+	108: {0x38, 0x18, 0x18, 0x18, 0x18, 0x18, 0x3c, 0x00}, // l
+	109: {0x00, 0x00, 0x36, 0x7f, 0x6b, 0x6b, 0x63, 0x00}, // m
+	110: {0x00, 0x00, 0x7c, 0x66, 0x66, 0x66, 0x66, 0x00}, // n
+	111: {0x00, 0x00, 0x3c, 0x66, 0x66, 0x66, 0x3c, 0x00}, // o
+	112: {0x00, 0x00, 0x7c, 0x66, 0x66, 0x7c, 0x60, 0x60}, // p
+	113: {0x00, 0x00, 0x3e, 0x66, 0x66, 0x3e, 0x06, 0x07}, // q
+	114: {0x00, 0x00, 0x6c, 0x76, 0x60, 0x60, 0x60, 0x00}, // r
+	115: {0x00, 0x00, 0x3e, 0x60, 0x3c, 0x06, 0x7c, 0x00}, // s
+	116: {0x30, 0x30, 0x7c, 0x30, 0x30, 0x30, 0x1c, 0x00}, // t
+	117: {0x00, 0x00, 0x66, 0x66, 0x66, 0x66, 0x3e, 0x00}, // u
+	118: {0x00, 0x00, 0x66, 0x66, 0x66, 0x3c, 0x18, 0x00}, // v
+	119: {0x00, 0x00, 0x63, 0x6b, 0x6b, 0x7f, 0x36, 0x00}, // w
+	120: {0x00, 0x00, 0x66, 0x3c, 0x18, 0x3c, 0x66, 0x00}, // x
+	121: {0x00, 0x00, 0x66, 0x66, 0x66, 0x3e, 0x06, 0x3c}, // y
+	122: {0x00, 0x00, 0x7e, 0x0c, 0x18, 0x30, 0x7e, 0x00}, // z
+	123: {0x0c, 0x18, 0x18, 0x70, 0x18, 0x18, 0x0c, 0x00}, // {
+	124: {0x18, 0x18, 0x18, 0x00, 0x18, 0x18, 0x18, 0x00}, // |
+	125: {0x30, 0x18, 0x18, 0x0e, 0x18, 0x18, 0x30, 0x00}, // }
+	126: {0x31, 0x6b, 0x46, 0x00, 0x00, 0x00, 0x00, 0x00}, // ~
+	127: {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, // delete
+}
+
+func (v *vdu) defineChar(ch uint8, definition []uint8) {
+	copy(v.font[ch][:], definition)
+	if ch >= 224 {
+		// Keep a copy on the soft character area, as on the BBC Micro
+		for i, b := range definition {
+			v.env.mem.pokeIO(mosSoftFont+uint16(ch-224)*8+uint16(i), b)
+		}
+	}
+}
+
+func (v *vdu) vdu23(q []uint8) string {
+	switch q[0] {
+	case 0:
+		/*
+			VDU 23,0,R,X,0,0,0,0,0,0 writes X on the 6845 CRTC register R.
+			The only one meaningful here is the cursor start register R10,
+			bits 5 and 6 are the cursor display mode:
+				00 steady
+				01 no cursor
+				10 fast blink
+				11 slow blink
+		*/
+		if q[1] == 10 {
+			v.cursorStartRegister = q[2]
+			switch (q[2] >> 5) & 3 {
+			case 0:
+				return "\x1b[?25h\x1b[2 q"
+			case 1:
+				return "\x1b[?25l"
+			default:
+				return "\x1b[?25h\x1b[1 q"
+			}
+		}
+	case 1:
+		/*
+			VDU 23,1,N,0,0,0,0,0,0,0 turns the cursor off with N=0 and on
+			with N=1.
+		*/
+		switch q[1] {
+		case 0:
+			return "\x1b[?25l"
+		case 1:
+			return "\x1b[?25h"
+		}
+	default:
+		if q[0] >= 32 {
+			v.defineChar(q[0], q[1:9])
+		}
+		// Codes 2 to 31 are graphics patterns and other extensions, ignored
+	}
+	return ""
+}
+
+func (v *vdu) isCharRedefined(ch uint8) bool {
+	return v.font[ch] != bbcFont[ch]
+}
+
+func (v *vdu) glyph(ch uint8) string {
+	return sextantGlyph(v.font[ch])
+}
+
+func sextantGlyph(bitmap [8]uint8) string {
+	/*
+		Each sextant is a 4x3, 4x3 or 4x2 block of pixels. It is set when at
+		least a quarter of the pixels are set. The bits are in the teletext
+		mosaics order.
+	*/
+	rows := [4]int{0, 3, 6, 8}
+	bits := [6]uint8{0x01, 0x02, 0x04, 0x08, 0x10, 0x40}
+	mosaic := uint8(0x20)
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 2; c++ {
+			count := 0
+			for y := rows[r]; y < rows[r+1]; y++ {
+				line := bitmap[y] << (4 * c)
+				for x := 0; x < 4; x++ {
+					if line&(0x80>>x) != 0 {
+						count++
+					}
+				}
+			}
+			total := 4 * (rows[r+1] - rows[r])
+			if count*4 >= total {
+				mosaic |= bits[r*2+c]
+			}
+		}
+	}
+	return string(mosaicRune(mosaic, false))
+}
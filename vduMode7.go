@@ -0,0 +1,240 @@
+package main
+
+import "fmt"
+
+/*
+	Mode 7 teletext rendering, following the SAA5050 rules. The control codes
+	128 to 159 use a character cell and change the attributes for the rest of
+	the row. Some take effect on the cell of the control code (set-at) and the
+	others from the next cell (set-after).
+
+	See:
+		https://beebwiki.mdfs.net/Teletext
+		https://en.wikipedia.org/wiki/Teletext_character_set
+		https://vt100.net/docs/vt100-ug/chapter3.html#DECDHL
+
+	The order of colors is: black, red, green, yellow, blue, magenta,
+	cyan and white for mode 7 and for ANSI.
+	Red is:
+	 - 129 as alphanumeric control code
+	 - 145 as graphics control code
+	 . 1 as m7fgColour and m7bgColour
+	 . 31 as ANSI fg color
+	 - 41 as ANSI bg color
+*/
+
+func (v *vdu) writeMode7(cmd uint8) string {
+	if 128 <= cmd && cmd <= 159 {
+		return v.writeMode7Control(cmd)
+	}
+
+	if v.m7Graphics && isMosaic(cmd) {
+		v.m7HeldChar = cmd
+		v.m7HeldSeparated = v.m7Separated
+		return string(mosaicRune(cmd, v.m7Separated))
+	}
+
+	return adjustAsciiMode7(cmd)
+}
+
+func (v *vdu) writeMode7Control(cmd uint8) string {
+	setAt := ""
+	setAfter := ""
+
+	switch {
+	case 129 <= cmd && cmd <= 135: // Alphanumeric colors
+		v.m7fgColour = cmd - 129 + 1
+		setAfter = fmt.Sprintf("\x1b[%vm", v.m7fgColour+30)
+		v.mode7SetGraphics(false)
+		setAfter += v.mode7Reveal()
+	case cmd == 136: // Flash
+		v.m7Flash = true
+		setAfter = "\x1b[5m"
+	case cmd == 137: // Steady (not flash)
+		v.m7Flash = false
+		setAt = "\x1b[25m"
+	case cmd == 140: // Normal height
+		if v.m7DoubleHeight {
+			v.m7DoubleHeight = false
+			v.m7HeldChar = 0
+		}
+	case cmd == 141: // Double height
+		if !v.m7DoubleHeight {
+			v.m7DoubleHeight = true
+			v.m7HeldChar = 0
+		}
+		if !v.m7RowDouble {
+			// The DEC line attributes apply to the full terminal line
+			v.m7RowDouble = true
+			if v.m7BottomRow {
+				setAfter = "\x1b#4"
+			} else {
+				setAfter = "\x1b#3"
+			}
+		}
+	case 145 <= cmd && cmd <= 151: // Graphics colors
+		v.m7fgColour = cmd - 145 + 1
+		setAfter = fmt.Sprintf("\x1b[%vm", v.m7fgColour+30)
+		v.mode7SetGraphics(true)
+		setAfter += v.mode7Reveal()
+	case cmd == 152: // Conceal
+		if !v.m7Conceal {
+			v.m7Conceal = true
+			setAt = "\x1b[8m"
+		}
+	case cmd == 153: // Contiguous graphics
+		v.m7Separated = false
+	case cmd == 154: // Separated graphics
+		v.m7Separated = true
+	case cmd == 156: // Black background
+		v.m7bgColour = 0
+		setAt = fmt.Sprintf("\x1b[%vm", v.m7bgColour+40)
+	case cmd == 157: // New background
+		v.m7bgColour = v.m7fgColour
+		setAt = fmt.Sprintf("\x1b[%vm", v.m7bgColour+40)
+	case cmd == 158: // Hold graphics
+		v.m7Hold = true
+	}
+
+	// The control code cell is a space, or the held graphics char
+	cell := " "
+	if v.m7Hold && v.m7HeldChar != 0 {
+		cell = string(mosaicRune(v.m7HeldChar, v.m7HeldSeparated))
+	}
+	if cmd == 159 { // Release graphics
+		v.m7Hold = false
+	}
+
+	return setAt + cell + setAfter
+}
+
+func (v *vdu) mode7SetGraphics(graphics bool) {
+	if v.m7Graphics != graphics {
+		// A change between alphanumerics and graphics clears the held char
+		v.m7Graphics = graphics
+		v.m7HeldChar = 0
+	}
+}
+
+func (v *vdu) mode7Reveal() string {
+	if !v.m7Conceal {
+		return ""
+	}
+	v.m7Conceal = false
+	return "\x1b[28m"
+}
+
+func (v *vdu) mode7ResetCode() string {
+	if v.mode != 7 {
+		return ""
+	}
+	out := ""
+	if v.m7fgColour != 7 /* white */ {
+		out += "\x1b[37m"
+		v.m7fgColour = 7
+	}
+	if v.m7bgColour != 0 /* black */ {
+		out += "\x1b[40m"
+		v.m7bgColour = 0
+	}
+	if v.m7Flash {
+		out += "\x1b[25m"
+		v.m7Flash = false
+	}
+	out += v.mode7Reveal()
+	v.m7Graphics = false
+	v.m7Separated = false
+	v.m7Hold = false
+	v.m7HeldChar = 0
+	v.m7DoubleHeight = false
+	return out
+}
+
+func (v *vdu) mode7Reset() {
+	v.env.con.write(v.mode7ResetCode())
+}
+
+func (v *vdu) mode7NextRow() {
+	// The row after a row with double height chars shows the bottom halves
+	v.m7BottomRow = v.m7RowDouble && !v.m7BottomRow
+	v.m7RowDouble = false
+}
+
+func (v *vdu) mode7FirstRow() {
+	v.m7BottomRow = false
+	v.m7RowDouble = false
+}
+
+func isMosaic(ch uint8) bool {
+	// Codes &40 to &5F are displayed as alphanumerics even in graphics mode
+	ch = ch & 0x7f
+	return ch >= 0x20 && (ch < 0x40 || ch >= 0x60)
+}
+
+func mosaicRune(ch uint8, separated bool) rune {
+	/*
+		Bits 0 to 4 and 6 of the char are the six cells of the 2x3 block,
+		left to right and top to bottom. That is the same order used in the
+		Unicode sextant characters.
+	*/
+	cells := rune(ch&0x1f | (ch&0x40)>>1)
+	if cells == 0 {
+		return ' '
+	}
+
+	if separated {
+		// Unicode 16 "SEPARATED BLOCK SEXTANT" characters
+		return 0x1ce50 + cells
+	}
+
+	// Some combinations already existed as block elements and are skipped
+	switch cells {
+	case 0x15:
+		return '▌'
+	case 0x2a:
+		return '▐'
+	case 0x3f:
+		return '█'
+	}
+	r := 0x1fb00 + cells - 1
+	if cells > 0x15 {
+		r--
+	}
+	if cells > 0x2a {
+		r--
+	}
+	return r
+}
+
+func adjustAsciiMode7(ch uint8) string {
+	// Some chars are different from standard ASCII
+	// See: http://beebwiki.mdfs.net/ASCII
+
+	// Commented out to allow non-ASCII latin 1 characters
+	// ch = ch & 0x7f
+
+	switch ch {
+	case '[':
+		return "←"
+	case '\\':
+		return "½"
+	case ']':
+		return "→"
+	case '^':
+		return "↑"
+	case '_':
+		return "–"
+	case '`':
+		return "£"
+	case '{':
+		return "¼"
+	case '|':
+		return "‖"
+	case '}':
+		return "¾"
+	case '~':
+		return "÷"
+	}
+
+	return string(ch)
+}
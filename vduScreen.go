@@ -0,0 +1,103 @@
+package main
+
+import "fmt"
+
+/*
+	Screen memory. The VDU drivers write to the terminal and don't fill the
+	screen memory, but the bytes written by the programs on the screen memory
+	are shown on the terminal on the character cell changed.
+
+	On mode 7 the byte is shown as a character, the control codes are shown
+	as spaces and the mosaics are not tracked. On modes 0 to 6 the eight
+	lines of the character cell are shown as the closest Unicode sextant, a
+	pixel is set if it is not colour 0. The hardware scrolling is ignored,
+	the screen starts at the beginning of the screen memory.
+
+	With a shadow mode, MODE 128 to 135 or after OSBYTE &72 with X=0, the
+	screen is on the shadow memory and HIMEM is &8000.
+
+	See:
+		https://beebwiki.mdfs.net/Screen_memory_layout
+		https://beebwiki.mdfs.net/OSBYTE_%2672
+*/
+
+// The screen of the mode is on the shadow memory, bit 7 of the mode selects it
+func (v *vdu) isShadowMode(mode uint8) bool {
+	switch v.env.mem.Peek(mosShadowState) {
+	case 0:
+		return true
+	case 1:
+		return mode&0x80 != 0
+	default:
+		return false // Never use shadow memory
+	}
+}
+
+func (v *vdu) setShadow(shadow bool) {
+	mem := v.env.mem
+	v.shadow = shadow
+	if shadow {
+		mem.allocShadow()
+	}
+	mem.shadowVdu = shadow
+	mem.shadowDisplay = shadow
+}
+
+func (v *vdu) screenChanged(address uint16) {
+	if v.ignore {
+		return
+	}
+
+	info := v.modeInfo()
+	offset := address - info.screenStart
+	row := offset / info.bytesPerRow
+	column := (offset % info.bytesPerRow) / uint16(info.bytesPerChar)
+	if row >= uint16(info.rows) {
+		// Modes 3 and 6 have unused memory after the last row
+		return
+	}
+
+	out := ""
+	if v.mode == 7 {
+		ch := v.env.mem.peekScreen(address) & 0x7f
+		if ch < 0x20 {
+			out = " "
+		} else {
+			out = adjustAsciiMode7(ch)
+		}
+	} else {
+		cell := info.screenStart + row*info.bytesPerRow + column*uint16(info.bytesPerChar)
+		out = sextantGlyph(v.cellBitmap(cell))
+	}
+
+	// Save the cursor, write on the cell and restore the cursor
+	v.env.con.write(fmt.Sprintf("\x1b7\x1b[%v;%vH%s\x1b8", row+1, column+1, out))
+}
+
+/*
+Pixels of a character cell as a 1 bit per pixel bitmap. Each group of eight
+bytes are the eight lines of the cell, with 1, 2 or 4 groups depending on
+the colours. The bits of a pixel are interleaved on the byte.
+*/
+func (v *vdu) cellBitmap(cell uint16) [8]uint8 {
+	info := v.modeInfo()
+	ppb := int(info.pixelsPerByte)
+	groups := int(info.bytesPerChar) / 8
+
+	var bitmap [8]uint8
+	for y := 0; y < 8; y++ {
+		for g := 0; g < groups; g++ {
+			b := v.env.mem.peekScreen(cell + uint16(g*8+y))
+			for p := 0; p < ppb; p++ {
+				mask := uint8(0)
+				for bit := 7 - p; bit >= 0; bit -= ppb {
+					mask |= 1 << bit
+				}
+				if b&mask != 0 {
+					bitmap[y] |= 0x80 >> (g*ppb + p)
+				}
+			}
+		}
+	}
+	return bitmap
+}
@@ -0,0 +1,244 @@
+package main
+
+import "fmt"
+
+/*
+	Screen geometry, text cursor and windows. The state is kept on the VDU
+	variables area at &300-&37F as the MOS does, to be read by OSBYTE &A0 or
+	directly by the programs.
+
+	See:
+		https://beebwiki.mdfs.net/MODE
+		https://beebwiki.mdfs.net/OSBYTE_%26A0
+		The Advanced User Guide for the BBC Microcomputer, chapter 20
+*/
+
+type modeInfo struct {
+	colours       uint8
+	columns       uint8
+	rows          uint8
+	screenStart   uint16 // HIMEM for the mode
+	bytesPerChar  uint8
+	bytesPerRow   uint16
+	pixelsPerByte uint8
+	memoryMapType uint8
+}
+
+var modeInfos = [8]modeInfo{
+	{2, 80, 32, 0x3000, 8, 640, 8, 0},   // Mode 0
+	{4, 40, 32, 0x3000, 16, 640, 4, 0},  // Mode 1
+	{16, 20, 32, 0x3000, 32, 640, 2, 0}, // Mode 2
+	{2, 80, 25, 0x4000, 8, 640, 8, 1},   // Mode 3
+	{2, 40, 32, 0x5800, 8, 320, 8, 2},   // Mode 4
+	{4, 20, 32, 0x5800, 16, 320, 4, 2},  // Mode 5
+	{2, 40, 25, 0x6000, 8, 320, 8, 3},   // Mode 6
+	{16, 40, 25, 0x7c00, 1, 40, 1, 4},   // Mode 7, teletext colours are not using the palette
+}
+
+// Byte patterns for the logical colours, &357 to &35A
+var colourBytes = map[uint8][]uint8{
+	2:  {0x00, 0xff},
+	4:  {0x00, 0x0f, 0xf0, 0xff},
+	16: {0x00, 0x03, 0x0c, 0x0f, 0x30, 0x33, 0x3c, 0x3f, 0xc0, 0xc3, 0xcc, 0xcf, 0xf0, 0xf3, 0xfc, 0xff},
+}
+
+const (
+	vduStatusPrinter    uint8 = 0x01
+	vduStatusPaged      uint8 = 0x04
+	vduStatusTextWindow uint8 = 0x08
+	vduStatusShadow     uint8 = 0x10
+	vduStatusVDU5       uint8 = 0x20
+	vduStatusDisabled   uint8 = 0x80
+)
+
+func (v *vdu) modeInfo() *modeInfo {
+	return &modeInfos[v.mode&7]
+}
+
+func (v *vdu) textWindowHeight() int {
+	return int(v.textWindow[1]) - int(v.textWindow[3]) + 1
+}
+
+func (v *vdu) resetWindows() {
+	info := v.modeInfo()
+	v.textWindow = [4]uint8{0, info.rows - 1, info.columns - 1, 0}
+	v.graphWindow = [4]int16{0, 0, 1279, 1023}
+	v.graphOrigin = [2]int16{0, 0}
+	v.cursorX = 0
+	v.cursorY = 0
+}
+
+func (v *vdu) setTextWindow(left uint8, bottom uint8, right uint8, top uint8) {
+	info := v.modeInfo()
+	if left > right || right >= info.columns || top > bottom || bottom >= info.rows {
+		// Invalid window, ignored
+		return
+	}
+	v.textWindow = [4]uint8{left, bottom, right, top}
+	if v.cursorX < left || v.cursorX > right || v.cursorY < top || v.cursorY > bottom {
+		v.cursorX = left
+		v.cursorY = top
+	}
+}
+
+func (v *vdu) setGraphicsWindow(left int16, bottom int16, right int16, top int16) {
+	if left >= right || bottom >= top {
+		// Invalid window, ignored
+		return
+	}
+	v.graphWindow = [4]int16{left, bottom, right, top}
+}
+
+func (v *vdu) plot(k uint8, x int16, y int16) {
+	if k&4 == 0 {
+		// Relative to the graphics cursor
+		x += v.graphCursor[0]
+		y += v.graphCursor[1]
+	}
+	v.oldGraphCursor = v.graphCursor
+	v.graphCursor = [2]int16{x, y}
+}
+
+func (v *vdu) cursorHome() string {
+	v.cursorX = v.textWindow[0]
+	v.cursorY = v.textWindow[3]
+	return v.cursorPositionCode()
+}
+
+func (v *vdu) moveCursor(x uint8, y uint8) string {
+	x += v.textWindow[0]
+	y += v.textWindow[3]
+	if x > v.textWindow[2] || y > v.textWindow[1] {
+		// Outside of the text window, ignored
+		return ""
+	}
+	v.cursorX = x
+	v.cursorY = y
+	return v.cursorPositionCode()
+}
+
+func (v *vdu) cursorPositionCode() string {
+	if v.cursorX == 0 && v.cursorY == 0 {
+		return "\x1b[H"
+	}
+	return fmt.Sprintf("\x1b[%v;%vH", v.cursorY+1, v.cursorX+1)
+}
+
+func (v *vdu) cursorRight() {
+	v.cursorX++
+	if v.cursorX > v.textWindow[2] {
+		v.cursorX = v.textWindow[0]
+		v.cursorDown()
+	}
+}
+
+func (v *vdu) cursorLeft() {
+	if v.cursorX > v.textWindow[0] {
+		v.cursorX--
+	} else {
+		v.cursorX = v.textWindow[2]
+		v.cursorUp()
+	}
+}
+
+func (v *vdu) cursorDown() {
+	// At the bottom the window scrolls, the cursor stays
+	if v.cursorY < v.textWindow[1] {
+		v.cursorY++
+	}
+}
+
+func (v *vdu) cursorUp() {
+	if v.cursorY > v.textWindow[3] {
+		v.cursorY--
+	}
+}
+
+func (v *vdu) inputEcho(line string) {
+	// The line entered is echoed, followed by a new line
+	for range line {
+		v.cursorRight()
+	}
+	v.cursorX = v.textWindow[0]
+	v.cursorDown()
+	v.updateCursorVariables()
+}
+
+func (v *vdu) status() uint8 {
+	status := uint8(0)
+	if v.printer {
+		status |= vduStatusPrinter
+	}
+	if v.paged {
+		status |= vduStatusPaged
+	}
+	info := v.modeInfo()
+	if v.textWindow != [4]uint8{0, info.rows - 1, info.columns - 1, 0} {
+		status |= vduStatusTextWindow
+	}
+	if v.shadow {
+		status |= vduStatusShadow
+	}
+	if v.textOnGr {
+		status |= vduStatusVDU5
+	}
+	if v.ignore {
+		status |= vduStatusDisabled
+	}
+	return status
+}
+
+func (v *vdu) updateCursorVariables() {
+	mem := v.env.mem
+	info := v.modeInfo()
+
+	mem.Poke(vduTextCursorX, v.cursorX)
+	mem.Poke(vduTextCursorY, v.cursorY)
+	mem.Poke(vduInputCursorX, v.cursorX)
+	mem.Poke(vduInputCursorY, v.cursorY)
+	mem.pokeWord(vduCursorAddress, info.screenStart+
+		uint16(v.cursorY)*info.bytesPerRow+
+		uint16(v.cursorX)*uint16(info.bytesPerChar))
+}
+
+func (v *vdu) updateVariables() {
+	mem := v.env.mem
+	info := v.modeInfo()
+
+	for i := 0; i < 4; i++ {
+		mem.pokeWord(vduGraphicsWindow+uint16(i)*2, uint16(v.graphWindow[i]))
+		mem.Poke(vduTextWindow+uint16(i), v.textWindow[i])
+	}
+	for i := 0; i < 2; i++ {
+		mem.pokeWord(vduGraphicsOrigin+uint16(i)*2, uint16(v.graphOrigin[i]))
+		mem.pokeWord(vduGraphicsCursor+uint16(i)*2, uint16(v.graphCursor[i]))
+		mem.pokeWord(vduOldGraphicsCursor+uint16(i)*2, uint16(v.oldGraphCursor[i]))
+	}
+
+	width := uint16(v.textWindow[2]-v.textWindow[0]+1) * uint16(info.bytesPerChar)
+	mem.pokeWord(vduTextWindowWidth, width)
+	mem.Poke(vduScreenBottomHigh, uint8(info.screenStart>>8))
+	mem.Poke(vduBytesPerChar, info.bytesPerChar)
+	mem.pokeWord(vduScreenTopLeft, info.screenStart)
+	mem.pokeWord(vduBytesPerRow, info.bytesPerRow)
+	mem.Poke(vduScreenSizeHigh, uint8((0x8000-info.screenStart)>>8))
+	mem.Poke(vduMode, v.mode)
+	mem.Poke(vduMemoryMapType, info.memoryMapType)
+
+	bytes := colourBytes[info.colours]
+	mem.Poke(vduTextColour, bytes[v.textColour])
+	mem.Poke(vduTextBackground, bytes[v.textBackground])
+	mem.Poke(vduGraphicsColour, bytes[v.graphColour])
+	mem.Poke(vduGraphicsBackground, bytes[v.graphBackground])
+	mem.Poke(vduGraphicsPlotMode, v.graphPlotMode)
+	mem.Poke(vduGraphicsBackPlotMode, v.graphBackPlotMode)
+	mem.Poke(vduCursorStartRegister, v.cursorStartRegister)
+	mem.Poke(vduColoursMinusOne, info.colours-1)
+	mem.Poke(vduPixelsPerByteMinusOne, info.pixelsPerByte-1)
+	mem.pokeSlice(vduPalette, 16, v.palette[:])
+
+	mem.Poke(zpVduStatus, v.status())
+	mem.screenStart = info.screenStart
+
+	v.updateCursorVariables()
+}
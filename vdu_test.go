@@ -0,0 +1,176 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMode7Mosaics(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"VDU 145,32,53,255,106,65,154,255",
+	})
+
+	if !strings.Contains(out, " \x1b[31m ▌█▐A \U0001CE8F") {
+		t.Log(out)
+		t.Error("Mode 7 mosaics failed")
+	}
+}
+
+func TestMode7HoldGraphics(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"VDU 151,158,255,147,13,10",
+	})
+
+	if !strings.Contains(out, " \x1b[37m ██\x1b[33m") {
+		t.Log(out)
+		t.Error("Mode 7 hold graphics failed")
+	}
+}
+
+func TestMode7DoubleHeight(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"VDU 141,72,13,10,141,72,13,10",
+	})
+
+	if !strings.Contains(out, " \x1b#3H") || !strings.Contains(out, " \x1b#4H") {
+		t.Log(out)
+		t.Error("Mode 7 double height failed")
+	}
+}
+
+func TestColourPalette(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"MODE 1:COLOUR 1:COLOUR 130:PRINT \"A\"",
+		"VDU 19,1,4;0;19,2,9;0;",
+		"VDU 20",
+	})
+
+	if !strings.Contains(out, "\x1b[25;31;43mA") {
+		t.Log(out)
+		t.Error("COLOUR failed")
+	}
+	if !strings.Contains(out, "\x1b[25;34;43m\x1b[5;34;41m") {
+		t.Log(out)
+		t.Error("VDU 19 failed")
+	}
+	if !strings.Contains(out, "VDU 20\n\x1b[0m") {
+		t.Log(out)
+		t.Error("VDU 20 failed")
+	}
+}
+
+func TestUserDefinedChars(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"MODE 4:VDU 23,224,255,255,255,255,0,0,0,0,224",
+		"VDU 23,225,240,240,240,240,240,240,240,240,225",
+		"DIM B% 9:?B%=65:A%=10:X%=B%:Y%=B% DIV 256:CALL &FFF1:PRINT B%?1;\",\";B%?4",
+		"VDU 23,1,0;0;0;0;",
+	})
+
+	if !strings.Contains(out, "\U0001FB0E>") || !strings.Contains(out, "▌>") {
+		t.Log(out)
+		t.Error("User defined chars failed")
+	}
+	if !strings.Contains(out, "60,126") {
+		t.Log(out)
+		t.Error("OSWORD &0A failed")
+	}
+	if !strings.Contains(out, "\x1b[?25l") {
+		t.Log(out)
+		t.Error("Cursor off failed")
+	}
+}
+
+func TestPagedMode(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"VDU 28,0,9,39,0:VDU 14:FOR I%=1 TO 30:PRINT I%:NEXT",
+		"SHIFT",
+		"VDU 15:VDU 26",
+	})
+
+	// The text window has 10 lines, the output waits when it is full
+	if !strings.Contains(out, " 10SHIFT\n") {
+		t.Log(out)
+		t.Error("Paged mode failed")
+	}
+}
+
+func TestVduVariables(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"MODE 7:A%=&A0:X%=9:PRINT ~(USR(&FFF4) AND &FFFF00)",
+		"A%=&85:X%=0:PRINT ~(USR(&FFF4) AND &FFFF00)",
+		"PRINT ~HIMEM",
+		"VDU 28,5,20,30,10,31,3,4:PRINT POS;\",\";VPOS:VDU 26",
+		"A%=&75:VDU 14:PRINT ~(USR(&FFF4) AND &FF00):VDU 15",
+	})
+
+	if !strings.Contains(out, "271800") {
+		t.Log(out)
+		t.Error("OSBYTE &A0 failed")
+	}
+	if !strings.Contains(out, "300000") {
+		t.Log(out)
+		t.Error("OSBYTE &85 failed")
+	}
+	if !strings.Contains(out, "7C00") {
+		t.Log(out)
+		t.Error("HIMEM failed")
+	}
+	// The cursor is at 3,4 inside the window, that is column 9 and row 15 of the screen
+	if !strings.Contains(out, "\x1b[15;9H         3,4\n") {
+		t.Log(out)
+		t.Error("POS and VPOS failed")
+	}
+	if !strings.Contains(out, "\n       400\n") {
+		t.Log(out)
+		t.Error("OSBYTE &75 failed")
+	}
+}
+
+func TestScreenMemory(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"?&7C2A=65",
+		"MODE 4:?&5980=&FF:?&5981=&FF:?&5982=&FF:?&5983=&FF",
+	})
+
+	if !strings.Contains(out, "\x1b7\x1b[2;3HA\x1b8") {
+		t.Log(out)
+		t.Error("Mode 7 screen memory write failed")
+	}
+	if !strings.Contains(out, "\x1b7\x1b[2;9H🬎\x1b8") {
+		t.Log(out)
+		t.Error("Mode 4 screen memory write failed")
+	}
+}
+
+func TestShadowHimem(t *testing.T) {
+	out := integrationTestBasic([]string{
+		"MODE 0:PRINT ~HIMEM",
+		"MODE 128:PRINT ~HIMEM",
+		"A%=&75:PRINT ~(USR(&FFF4) AND &1000)",
+		"?&3000=&FF:MODE 7",
+		"*FX 114,0",
+		"MODE 7:PRINT ~HIMEM",
+	})
+
+	if !strings.Contains(out, "MODE 0:PRINT ~HIMEM\n      3000\n") {
+		t.Log(out)
+		t.Error("HIMEM without shadow failed")
+	}
+	if !strings.Contains(out, "MODE 128:PRINT ~HIMEM\n\x1b[0m      8000\n") {
+		t.Log(out)
+		t.Error("HIMEM for MODE 128 failed")
+	}
+	if !strings.Contains(out, "AND &1000)\n      1000\n") {
+		t.Log(out)
+		t.Error("The VDU status should have the shadow bit")
+	}
+	if strings.Contains(out, "\x1b[1;1H") {
+		t.Log(out)
+		t.Error("Writes on main memory should not be shown with a shadow screen")
+	}
+	if !strings.Contains(out, "MODE 7:PRINT ~HIMEM\n      8000\n") {
+		t.Log(out)
+		t.Error("HIMEM after OSBYTE &72 failed")
+	}
+}
@@ -0,0 +1,1088 @@
+package main
+
+/*
+	Z80 processor, used as the Tube second processor.
+
+	All the documented instructions are implemented, with the undocumented
+	IXH, IXL, IYH and IYL registers, SLL, the DDCB and FDCB copies to the
+	registers and the flags on bits 3 and 5. The T-states are counted per
+	instruction without the wait states.
+
+	See:
+		http://www.z80.info/decoding.htm
+		http://www.z80.info/zip/z80-documented.pdf
+*/
+
+// Memory and I/O ports seen by the Z80
+type z80Bus interface {
+	fetch(address uint16) uint8 // Opcode fetch, the M1 cycle
+	read(address uint16) uint8
+	write(address uint16, value uint8)
+	in(port uint16) uint8
+	out(port uint16, value uint8)
+	interrupt() bool // Level of the INT line
+}
+
+const (
+	z80FlagC  uint8 = 0x01
+	z80FlagN  uint8 = 0x02
+	z80FlagPV uint8 = 0x04
+	z80Flag3  uint8 = 0x08
+	z80FlagH  uint8 = 0x10
+	z80Flag5  uint8 = 0x20
+	z80FlagZ  uint8 = 0x40
+	z80FlagS  uint8 = 0x80
+
+	z80Flags35 = z80Flag3 | z80Flag5
+)
+
+// Prefix in effect for HL on the instruction being executed
+const (
+	z80IndexHL = iota
+	z80IndexIX
+	z80IndexIY
+)
+
+type z80 struct {
+	bus z80Bus
+
+	a, f, b, c, d, e, h, l         uint8
+	a2, f2, b2, c2, d2, e2, h2, l2 uint8
+	ix, iy, sp, pc                 uint16
+	i, r                           uint8
+	iff1, iff2                     bool
+	im                             uint8
+	halted                         bool
+
+	nmiPending bool
+	eiDelay    bool // The interrupts are accepted after the instruction following EI
+	index      int
+	t          int // T-states of the instruction being executed
+	cycles     uint64
+}
+
+// Sign, zero, bits 3 and 5 and parity of the values
+var z80SZ53P [256]uint8
+
+func init() {
+	for i := 0; i < 256; i++ {
+		v := uint8(i)
+		flags := v & (z80FlagS | z80Flags35)
+		if v == 0 {
+			flags |= z80FlagZ
+		}
+		parity := v
+		parity ^= parity >> 4
+		parity ^= parity >> 2
+		parity ^= parity >> 1
+		if parity&1 == 0 {
+			flags |= z80FlagPV
+		}
+		z80SZ53P[i] = flags
+	}
+}
+
+func newZ80(bus z80Bus) *z80 {
+	var z z80
+	z.bus = bus
+	z.reset()
+	return &z
+}
+
+func (z *z80) reset() {
+	z.pc = 0
+	z.i = 0
+	z.r = 0
+	z.iff1 = false
+	z.iff2 = false
+	z.im = 0
+	z.halted = false
+	z.nmiPending = false
+	z.eiDelay = false
+	z.sp = 0xffff
+	z.a = 0xff
+	z.f = 0xff
+}
+
+// Requests a non maskable interrupt, it is served before the next instruction
+func (z *z80) nmi() {
+	z.nmiPending = true
+}
+
+// Executes an instruction or accepts an interrupt, returns the T-states used
+func (z *z80) step() int {
+	z.t = 0
+	if z.nmiPending {
+		z.nmiPending = false
+		z.halted = false
+		z.iff1 = false
+		z.incR()
+		z.push(z.pc)
+		z.pc = 0x0066
+		z.t = 11
+	} else if z.iff1 && !z.eiDelay && z.bus.interrupt() {
+		z.acceptInterrupt()
+	} else {
+		z.eiDelay = false
+		if z.halted {
+			// HALT executes NOPs until an interrupt
+			z.incR()
+			z.t = 4
+		} else {
+			z.index = z80IndexHL
+			z.execute(z.fetchOpcode())
+		}
+	}
+	z.cycles += uint64(z.t)
+	return z.t
+}
+
+func (z *z80) acceptInterrupt() {
+	z.halted = false
+	z.iff1 = false
+	z.iff2 = false
+	z.incR()
+	z.push(z.pc)
+	switch z.im {
+	case 2:
+		// The data bus is floating on the Tube, the vector low byte is &FF
+		z.pc = z.readWord(uint16(z.i)<<8 | 0xff)
+		z.t = 19
+	default:
+		// On mode 0 the &FF on the data bus is RST &38, as on mode 1
+		z.pc = 0x0038
+		z.t = 13
+	}
+}
+
+func (z *z80) incR() {
+	z.r = z.r&0x80 | (z.r+1)&0x7f
+}
+
+func (z *z80) fetchOpcode() uint8 {
+	z.incR()
+	op := z.bus.fetch(z.pc)
+	z.pc++
+	return op
+}
+
+func (z *z80) fetchByte() uint8 {
+	v := z.bus.read(z.pc)
+	z.pc++
+	return v
+}
+
+func (z *z80) fetchWord() uint16 {
+	lo := z.fetchByte()
+	hi := z.fetchByte()
+	return uint16(lo) | uint16(hi)<<8
+}
+
+func (z *z80) readWord(address uint16) uint16 {
+	return uint16(z.bus.read(address)) | uint16(z.bus.read(address+1))<<8
+}
+
+func (z *z80) writeWord(address uint16, value uint16) {
+	z.bus.write(address, uint8(value))
+	z.bus.write(address+1, uint8(value>>8))
+}
+
+func (z *z80) push(value uint16) {
+	z.sp--
+	z.bus.write(z.sp, uint8(value>>8))
+	z.sp--
+	z.bus.write(z.sp, uint8(value))
+}
+
+func (z *z80) pop() uint16 {
+	lo := z.bus.read(z.sp)
+	z.sp++
+	hi := z.bus.read(z.sp)
+	z.sp++
+	return uint16(lo) | uint16(hi)<<8
+}
+
+// Register pairs
+
+func (z *z80) bc() uint16 { return uint16(z.b)<<8 | uint16(z.c) }
+func (z *z80) de() uint16 { return uint16(z.d)<<8 | uint16(z.e) }
+func (z *z80) hl() uint16 { return uint16(z.h)<<8 | uint16(z.l) }
+func (z *z80) af() uint16 { return uint16(z.a)<<8 | uint16(z.f) }
+
+func (z *z80) setBC(v uint16) { z.b, z.c = uint8(v>>8), uint8(v) }
+func (z *z80) setDE(v uint16) { z.d, z.e = uint8(v>>8), uint8(v) }
+func (z *z80) setHL(v uint16) { z.h, z.l = uint8(v>>8), uint8(v) }
+func (z *z80) setAF(v uint16) { z.a, z.f = uint8(v>>8), uint8(v) }
+
+// HL, IX or IY depending on the prefix
+func (z *z80) indexReg() uint16 {
+	switch z.index {
+	case z80IndexIX:
+		return z.ix
+	case z80IndexIY:
+		return z.iy
+	}
+	return z.hl()
+}
+
+func (z *z80) setIndexReg(v uint16) {
+	switch z.index {
+	case z80IndexIX:
+		z.ix = v
+	case z80IndexIY:
+		z.iy = v
+	default:
+		z.setHL(v)
+	}
+}
+
+// Register pair by the 2 bits p of the opcode, with SP or AF for 3
+func (z *z80) rp(p uint8) uint16 {
+	switch p {
+	case 0:
+		return z.bc()
+	case 1:
+		return z.de()
+	case 2:
+		return z.indexReg()
+	}
+	return z.sp
+}
+
+func (z *z80) setRP(p uint8, v uint16) {
+	switch p {
+	case 0:
+		z.setBC(v)
+	case 1:
+		z.setDE(v)
+	case 2:
+		z.setIndexReg(v)
+	default:
+		z.sp = v
+	}
+}
+
+func (z *z80) rp2(p uint8) uint16 {
+	if p == 3 {
+		return z.af()
+	}
+	return z.rp(p)
+}
+
+func (z *z80) setRP2(p uint8, v uint16) {
+	if p == 3 {
+		z.setAF(v)
+	} else {
+		z.setRP(p, v)
+	}
+}
+
+/*
+8 bits register by the 3 bits of the opcode, 6 is the memory operand and is
+not handled here. With a prefix H and L are the halves of IX or IY, unless
+the instruction also uses the memory operand.
+*/
+func (z *z80) reg(r uint8, indexed bool) uint8 {
+	switch r {
+	case 0:
+		return z.b
+	case 1:
+		return z.c
+	case 2:
+		return z.d
+	case 3:
+		return z.e
+	case 4:
+		if indexed && z.index != z80IndexHL {
+			return uint8(z.indexReg() >> 8)
+		}
+		return z.h
+	case 5:
+		if indexed && z.index != z80IndexHL {
+			return uint8(z.indexReg())
+		}
+		return z.l
+	}
+	return z.a
+}
+
+func (z *z80) setReg(r uint8, v uint8, indexed bool) {
+	switch r {
+	case 0:
+		z.b = v
+	case 1:
+		z.c = v
+	case 2:
+		z.d = v
+	case 3:
+		z.e = v
+	case 4:
+		if indexed && z.index != z80IndexHL {
+			z.setIndexReg(z.indexReg()&0x00ff | uint16(v)<<8)
+		} else {
+			z.h = v
+		}
+	case 5:
+		if indexed && z.index != z80IndexHL {
+			z.setIndexReg(z.indexReg()&0xff00 | uint16(v))
+		} else {
+			z.l = v
+		}
+	default:
+		z.a = v
+	}
+}
+
+// Address of the memory operand, (HL), (IX+d) or (IY+d). Reads the displacement.
+func (z *z80) memOperand() uint16 {
+	if z.index == z80IndexHL {
+		return z.hl()
+	}
+	d := int8(z.fetchByte())
+	z.t += 8
+	return z.indexReg() + uint16(d)
+}
+
+func (z *z80) condition(cc uint8) bool {
+	switch cc {
+	case 0:
+		return z.f&z80FlagZ == 0
+	case 1:
+		return z.f&z80FlagZ != 0
+	case 2:
+		return z.f&z80FlagC == 0
+	case 3:
+		return z.f&z80FlagC != 0
+	case 4:
+		return z.f&z80FlagPV == 0
+	case 5:
+		return z.f&z80FlagPV != 0
+	case 6:
+		return z.f&z80FlagS == 0
+	}
+	return z.f&z80FlagS != 0
+}
+
+func (z *z80) execute(op uint8) {
+	x, y, r := op>>6, (op>>3)&7, op&7
+	p, q := y>>1, y&1
+
+	switch x {
+	case 0:
+		switch r {
+		case 0:
+			switch y {
+			case 0: // NOP
+				z.t += 4
+			case 1: // EX AF,AF'
+				z.a, z.a2 = z.a2, z.a
+				z.f, z.f2 = z.f2, z.f
+				z.t += 4
+			case 2: // DJNZ d
+				d := int8(z.fetchByte())
+				z.b--
+				if z.b != 0 {
+					z.pc += uint16(d)
+					z.t += 13
+				} else {
+					z.t += 8
+				}
+			default: // JR d and JR cc,d
+				d := int8(z.fetchByte())
+				if y == 3 || z.condition(y-4) {
+					z.pc += uint16(d)
+					z.t += 12
+				} else {
+					z.t += 7
+				}
+			}
+
+		case 1:
+			if q == 0 { // LD rp,nn
+				z.setRP(p, z.fetchWord())
+				z.t += 10
+			} else { // ADD HL,rp
+				z.setIndexReg(z.add16(z.indexReg(), z.rp(p)))
+				z.t += 11
+			}
+
+		case 2:
+			switch y {
+			case 0: // LD (BC),A
+				z.bus.write(z.bc(), z.a)
+				z.t += 7
+			case 1: // LD A,(BC)
+				z.a = z.bus.read(z.bc())
+				z.t += 7
+			case 2: // LD (DE),A
+				z.bus.write(z.de(), z.a)
+				z.t += 7
+			case 3: // LD A,(DE)
+				z.a = z.bus.read(z.de())
+				z.t += 7
+			case 4: // LD (nn),HL
+				z.writeWord(z.fetchWord(), z.indexReg())
+				z.t += 16
+			case 5: // LD HL,(nn)
+				z.setIndexReg(z.readWord(z.fetchWord()))
+				z.t += 16
+			case 6: // LD (nn),A
+				z.bus.write(z.fetchWord(), z.a)
+				z.t += 13
+			case 7: // LD A,(nn)
+				z.a = z.bus.read(z.fetchWord())
+				z.t += 13
+			}
+
+		case 3: // INC rp and DEC rp
+			if q == 0 {
+				z.setRP(p, z.rp(p)+1)
+			} else {
+				z.setRP(p, z.rp(p)-1)
+			}
+			z.t += 6
+
+		case 4, 5: // INC r and DEC r
+			var v uint8
+			var address uint16
+			if y == 6 {
+				address = z.memOperand()
+				v = z.bus.read(address)
+				z.t += 7
+			} else {
+				v = z.reg(y, true)
+			}
+			if r == 4 {
+				v = z.inc8(v)
+			} else {
+				v = z.dec8(v)
+			}
+			if y == 6 {
+				z.bus.write(address, v)
+			} else {
+				z.setReg(y, v, true)
+			}
+			z.t += 4
+
+		case 6: // LD r,n
+			if y == 6 {
+				address := z.memOperand()
+				if z.index != z80IndexHL {
+					z.t -= 3 // The displacement and the value are read together
+				}
+				z.bus.write(address, z.fetchByte())
+				z.t += 10
+			} else {
+				z.setReg(y, z.fetchByte(), true)
+				z.t += 7
+			}
+
+		case 7:
+			z.accumulatorOp(y)
+			z.t += 4
+		}
+
+	case 1:
+		if op == 0x76 { // HALT
+			z.halted = true
+			z.t += 4
+		} else if y == 6 { // LD (HL),r
+			z.bus.write(z.memOperand(), z.reg(r, false))
+			z.t += 7
+		} else if r == 6 { // LD r,(HL)
+			z.setReg(y, z.bus.read(z.memOperand()), false)
+			z.t += 7
+		} else { // LD r,r
+			z.setReg(y, z.reg(r, true), true)
+			z.t += 4
+		}
+
+	case 2: // ALU A,r
+		if r == 6 {
+			z.alu(y, z.bus.read(z.memOperand()))
+			z.t += 7
+		} else {
+			z.alu(y, z.reg(r, true))
+			z.t += 4
+		}
+
+	case 3:
+		z.executeX3(y, r, p, q)
+	}
+}
+
+func (z *z80) executeX3(y uint8, r uint8, p uint8, q uint8) {
+	switch r {
+	case 0: // RET cc
+		if z.condition(y) {
+			z.pc = z.pop()
+			z.t += 11
+		} else {
+			z.t += 5
+		}
+
+	case 1:
+		if q == 0 { // POP rp2
+			z.setRP2(p, z.pop())
+			z.t += 10
+			return
+		}
+		switch p {
+		case 0: // RET
+			z.pc = z.pop()
+			z.t += 10
+		case 1: // EXX
+			z.b, z.b2 = z.b2, z.b
+			z.c, z.c2 = z.c2, z.c
+			z.d, z.d2 = z.d2, z.d
+			z.e, z.e2 = z.e2, z.e
+			z.h, z.h2 = z.h2, z.h
+			z.l, z.l2 = z.l2, z.l
+			z.t += 4
+		case 2: // JP (HL)
+			z.pc = z.indexReg()
+			z.t += 4
+		case 3: // LD SP,HL
+			z.sp = z.indexReg()
+			z.t += 6
+		}
+
+	case 2: // JP cc,nn
+		address := z.fetchWord()
+		if z.condition(y) {
+			z.pc = address
+		}
+		z.t += 10
+
+	case 3:
+		switch y {
+		case 0: // JP nn
+			z.pc = z.fetchWord()
+			z.t += 10
+		case 1:
+			z.executeCB()
+		case 2: // OUT (n),A
+			n := z.fetchByte()
+			z.bus.out(uint16(z.a)<<8|uint16(n), z.a)
+			z.t += 11
+		case 3: // IN A,(n)
+			n := z.fetchByte()
+			z.a = z.bus.in(uint16(z.a)<<8 | uint16(n))
+			z.t += 11
+		case 4: // EX (SP),HL
+			v := z.readWord(z.sp)
+			z.writeWord(z.sp, z.indexReg())
+			z.setIndexReg(v)
+			z.t += 19
+		case 5: // EX DE,HL, not affected by the prefixes
+			z.d, z.h = z.h, z.d
+			z.e, z.l = z.l, z.e
+			z.t += 4
+		case 6: // DI
+			z.iff1 = false
+			z.iff2 = false
+			z.t += 4
+		case 7: // EI
+			z.iff1 = true
+			z.iff2 = true
+			z.eiDelay = true
+			z.t += 4
+		}
+
+	case 4: // CALL cc,nn
+		address := z.fetchWord()
+		if z.condition(y) {
+			z.push(z.pc)
+			z.pc = address
+			z.t += 17
+		} else {
+			z.t += 10
+		}
+
+	case 5:
+		if q == 0 { // PUSH rp2
+			z.push(z.rp2(p))
+			z.t += 11
+			return
+		}
+		switch p {
+		case 0: // CALL nn
+			address := z.fetchWord()
+			z.push(z.pc)
+			z.pc = address
+			z.t += 17
+		case 1: // DD prefix
+			z.index = z80IndexIX
+			z.t += 4
+			z.execute(z.fetchOpcode())
+		case 2:
+			z.executeED()
+		case 3: // FD prefix
+			z.index = z80IndexIY
+			z.t += 4
+			z.execute(z.fetchOpcode())
+		}
+
+	case 6: // ALU A,n
+		z.alu(y, z.fetchByte())
+		z.t += 7
+
+	case 7: // RST
+		z.push(z.pc)
+		z.pc = uint16(y) * 8
+		z.t += 11
+	}
+}
+
+func (z *z80) executeCB() {
+	var address uint16
+	var op uint8
+	indexed := z.index != z80IndexHL
+	if indexed {
+		// DDCB d op, the displacement comes before the opcode
+		address = z.indexReg() + uint16(int8(z.fetchByte()))
+		op = z.fetchByte()
+		z.t += 4
+	} else {
+		op = z.fetchOpcode()
+	}
+	x, y, r := op>>6, (op>>3)&7, op&7
+
+	var v uint8
+	if indexed || r == 6 {
+		if !indexed {
+			address = z.hl()
+		}
+		v = z.bus.read(address)
+	} else {
+		v = z.reg(r, false)
+	}
+
+	switch x {
+	case 0:
+		v = z.rotate(y, v)
+	case 1: // BIT
+		flags := z.f&z80FlagC | z80FlagH | z80SZ53P[v&(1<<y)]&^z80Flags35
+		if indexed || r == 6 {
+			flags |= uint8(address>>8) & z80Flags35
+		} else {
+			flags |= v & z80Flags35
+		}
+		z.f = flags
+		if indexed || r == 6 {
+			z.t += 12
+		} else {
+			z.t += 8
+		}
+		return
+	case 2: // RES
+		v &^= 1 << y
+	case 3: // SET
+		v |= 1 << y
+	}
+
+	if indexed || r == 6 {
+		z.bus.write(address, v)
+		z.t += 15
+		if indexed && r != 6 {
+			// Undocumented, the result is also copied to a register
+			z.setReg(r, v, false)
+		}
+	} else {
+		z.setReg(r, v, false)
+		z.t += 8
+	}
+}
+
+func (z *z80) executeED() {
+	op := z.fetchOpcode()
+	z.index = z80IndexHL // The ED instructions ignore the DD and FD prefixes
+	x, y, r := op>>6, (op>>3)&7, op&7
+	p, q := y>>1, y&1
+
+	if x == 2 && r <= 3 && y >= 4 {
+		z.blockInstruction(y, r)
+		return
+	}
+	if x != 1 {
+		// Invalid, it works as two NOPs
+		z.t += 8
+		return
+	}
+
+	switch r {
+	case 0: // IN r,(C)
+		v := z.bus.in(z.bc())
+		z.f = z.f&z80FlagC | z80SZ53P[v]
+		if y != 6 {
+			z.setReg(y, v, false)
+		}
+		z.t += 12
+
+	case 1: // OUT (C),r
+		v := uint8(0)
+		if y != 6 {
+			v = z.reg(y, false)
+		}
+		z.bus.out(z.bc(), v)
+		z.t += 12
+
+	case 2:
+		if q == 0 { // SBC HL,rp
+			z.setHL(z.sbc16(z.hl(), z.rp(p)))
+		} else { // ADC HL,rp
+			z.setHL(z.adc16(z.hl(), z.rp(p)))
+		}
+		z.t += 15
+
+	case 3:
+		address := z.fetchWord()
+		if q == 0 { // LD (nn),rp
+			z.writeWord(address, z.rp(p))
+		} else { // LD rp,(nn)
+			z.setRP(p, z.readWord(address))
+		}
+		z.t += 20
+
+	case 4: // NEG
+		v := z.a
+		z.a = 0
+		z.alu(2, v)
+		z.t += 8
+
+	case 5: // RETN and RETI
+		z.pc = z.pop()
+		z.iff1 = z.iff2
+		z.t += 14
+
+	case 6: // IM
+		switch y & 3 {
+		case 0, 1:
+			z.im = 0
+		case 2:
+			z.im = 1
+		case 3:
+			z.im = 2
+		}
+		z.t += 8
+
+	case 7:
+		switch y {
+		case 0: // LD I,A
+			z.i = z.a
+			z.t += 9
+		case 1: // LD R,A
+			z.r = z.a
+			z.t += 9
+		case 2, 3: // LD A,I and LD A,R
+			if y == 2 {
+				z.a = z.i
+			} else {
+				z.a = z.r
+			}
+			z.f = z.f&z80FlagC | z80SZ53P[z.a]&^z80FlagPV
+			if z.iff2 {
+				z.f |= z80FlagPV
+			}
+			z.t += 9
+		case 4: // RRD
+			address := z.hl()
+			v := z.bus.read(address)
+			z.bus.write(address, z.a<<4|v>>4)
+			z.a = z.a&0xf0 | v&0x0f
+			z.f = z.f&z80FlagC | z80SZ53P[z.a]
+			z.t += 18
+		case 5: // RLD
+			address := z.hl()
+			v := z.bus.read(address)
+			z.bus.write(address, v<<4|z.a&0x0f)
+			z.a = z.a&0xf0 | v>>4
+			z.f = z.f&z80FlagC | z80SZ53P[z.a]
+			z.t += 18
+		default: // NOP
+			z.t += 8
+		}
+	}
+}
+
+// LDI, CPI, INI, OUTI and their decrementing and repeating versions
+func (z *z80) blockInstruction(y uint8, r uint8) {
+	decrement := y&1 == 1
+	repeat := y >= 6
+	step := uint16(1)
+	if decrement {
+		step = 0xffff
+	}
+
+	z.t += 16
+	again := false
+	switch r {
+	case 0: // LDI
+		v := z.bus.read(z.hl())
+		z.bus.write(z.de(), v)
+		z.setHL(z.hl() + step)
+		z.setDE(z.de() + step)
+		z.setBC(z.bc() - 1)
+		n := v + z.a
+		z.f = z.f&(z80FlagS|z80FlagZ|z80FlagC) | n&z80Flag3 | (n<<4)&z80Flag5
+		if z.bc() != 0 {
+			z.f |= z80FlagPV
+			again = true
+		}
+
+	case 1: // CPI
+		v := z.bus.read(z.hl())
+		result := z.a - v
+		halfCarry := (z.a^v^result)&0x10 != 0
+		z.setHL(z.hl() + step)
+		z.setBC(z.bc() - 1)
+		z.f = z.f&z80FlagC | z80FlagN | result&z80FlagS
+		if result == 0 {
+			z.f |= z80FlagZ
+		}
+		n := result
+		if halfCarry {
+			z.f |= z80FlagH
+			n--
+		}
+		z.f |= n&z80Flag3 | (n<<4)&z80Flag5
+		if z.bc() != 0 {
+			z.f |= z80FlagPV
+			again = result != 0
+		}
+
+	case 2: // INI
+		v := z.bus.in(z.bc())
+		z.bus.write(z.hl(), v)
+		z.setHL(z.hl() + step)
+		z.b--
+		z.f = z80SZ53P[z.b]&^z80FlagPV | z80FlagN
+		again = z.b != 0
+
+	case 3: // OUTI
+		v := z.bus.read(z.hl())
+		z.b--
+		z.bus.out(z.bc(), v)
+		z.setHL(z.hl() + step)
+		z.f = z80SZ53P[z.b]&^z80FlagPV | z80FlagN
+		again = z.b != 0
+	}
+
+	if repeat && again {
+		z.pc -= 2
+		z.t += 5
+	}
+}
+
+func (z *z80) accumulatorOp(y uint8) {
+	switch y {
+	case 0: // RLCA
+		z.a = z.a<<1 | z.a>>7
+		z.f = z.f&(z80FlagS|z80FlagZ|z80FlagPV) | z.a&(z80FlagC|z80Flags35)
+	case 1: // RRCA
+		carry := z.a & 1
+		z.a = z.a>>1 | z.a<<7
+		z.f = z.f&(z80FlagS|z80FlagZ|z80FlagPV) | carry | z.a&z80Flags35
+	case 2: // RLA
+		carry := z.a >> 7
+		z.a = z.a<<1 | z.f&z80FlagC
+		z.f = z.f&(z80FlagS|z80FlagZ|z80FlagPV) | carry | z.a&z80Flags35
+	case 3: // RRA
+		carry := z.a & 1
+		z.a = z.a>>1 | (z.f&z80FlagC)<<7
+		z.f = z.f&(z80FlagS|z80FlagZ|z80FlagPV) | carry | z.a&z80Flags35
+	case 4: // DAA
+		z.daa()
+	case 5: // CPL
+		z.a = ^z.a
+		z.f = z.f&(z80FlagS|z80FlagZ|z80FlagPV|z80FlagC) | z80FlagH | z80FlagN | z.a&z80Flags35
+	case 6: // SCF
+		z.f = z.f&(z80FlagS|z80FlagZ|z80FlagPV) | z80FlagC | z.a&z80Flags35
+	case 7: // CCF
+		flags := z.f&(z80FlagS|z80FlagZ|z80FlagPV) | z.a&z80Flags35
+		if z.f&z80FlagC != 0 {
+			flags |= z80FlagH
+		} else {
+			flags |= z80FlagC
+		}
+		z.f = flags
+	}
+}
+
+func (z *z80) daa() {
+	correction := uint8(0)
+	carry := z.f & z80FlagC
+	if z.f&z80FlagH != 0 || z.a&0x0f > 9 {
+		correction |= 0x06
+	}
+	if carry != 0 || z.a > 0x99 {
+		correction |= 0x60
+		carry = z80FlagC
+	}
+	var result uint8
+	if z.f&z80FlagN != 0 {
+		result = z.a - correction
+	} else {
+		result = z.a + correction
+	}
+	z.f = z.f&z80FlagN | carry | (z.a^result)&z80FlagH | z80SZ53P[result]
+	z.a = result
+}
+
+// ADD, ADC, SUB, SBC, AND, XOR, OR and CP on the accumulator
+func (z *z80) alu(op uint8, v uint8) {
+	switch op {
+	case 0, 1: // ADD and ADC
+		carry := uint16(0)
+		if op == 1 {
+			carry = uint16(z.f & z80FlagC)
+		}
+		sum := uint16(z.a) + uint16(v) + carry
+		result := uint8(sum)
+		z.f = z80SZ53P[result]&^z80FlagPV | (z.a^v^result)&z80FlagH
+		if (z.a^v)&0x80 == 0 && (z.a^result)&0x80 != 0 {
+			z.f |= z80FlagPV
+		}
+		if sum > 0xff {
+			z.f |= z80FlagC
+		}
+		z.a = result
+	case 2, 3, 7: // SUB, SBC and CP
+		carry := uint16(0)
+		if op == 3 {
+			carry = uint16(z.f & z80FlagC)
+		}
+		diff := uint16(z.a) - uint16(v) - carry
+		result := uint8(diff)
+		z.f = z80SZ53P[result]&^z80FlagPV | z80FlagN | (z.a^v^result)&z80FlagH
+		if (z.a^v)&0x80 != 0 && (z.a^result)&0x80 != 0 {
+			z.f |= z80FlagPV
+		}
+		if diff > 0xff {
+			z.f |= z80FlagC
+		}
+		if op == 7 {
+			// CP takes the bits 3 and 5 from the operand
+			z.f = z.f&^z80Flags35 | v&z80Flags35
+		} else {
+			z.a = result
+		}
+	case 4: // AND
+		z.a &= v
+		z.f = z80SZ53P[z.a] | z80FlagH
+	case 5: // XOR
+		z.a ^= v
+		z.f = z80SZ53P[z.a]
+	case 6: // OR
+		z.a |= v
+		z.f = z80SZ53P[z.a]
+	}
+}
+
+func (z *z80) inc8(v uint8) uint8 {
+	result := v + 1
+	z.f = z.f&z80FlagC | z80SZ53P[result]&^z80FlagPV
+	if v == 0x7f {
+		z.f |= z80FlagPV
+	}
+	if v&0x0f == 0x0f {
+		z.f |= z80FlagH
+	}
+	return result
+}
+
+func (z *z80) dec8(v uint8) uint8 {
+	result := v - 1
+	z.f = z.f&z80FlagC | z80SZ53P[result]&^z80FlagPV | z80FlagN
+	if v == 0x80 {
+		z.f |= z80FlagPV
+	}
+	if v&0x0f == 0 {
+		z.f |= z80FlagH
+	}
+	return result
+}
+
+// RLC, RRC, RL, RR, SLA, SRA, SLL and SRL
+func (z *z80) rotate(op uint8, v uint8) uint8 {
+	var carry uint8
+	switch op {
+	case 0: // RLC
+		carry = v >> 7
+		v = v<<1 | carry
+	case 1: // RRC
+		carry = v & 1
+		v = v>>1 | carry<<7
+	case 2: // RL
+		carry = v >> 7
+		v = v<<1 | z.f&z80FlagC
+	case 3: // RR
+		carry = v & 1
+		v = v>>1 | (z.f&z80FlagC)<<7
+	case 4: // SLA
+		carry = v >> 7
+		v <<= 1
+	case 5: // SRA
+		carry = v & 1
+		v = v>>1 | v&0x80
+	case 6: // SLL, undocumented
+		carry = v >> 7
+		v = v<<1 | 1
+	case 7: // SRL
+		carry = v & 1
+		v >>= 1
+	}
+	z.f = z80SZ53P[v] | carry
+	return v
+}
+
+func (z *z80) add16(a uint16, b uint16) uint16 {
+	sum := uint32(a) + uint32(b)
+	result := uint16(sum)
+	z.f = z.f&(z80FlagS|z80FlagZ|z80FlagPV) | uint8(result>>8)&z80Flags35
+	if (a^b^result)&0x1000 != 0 {
+		z.f |= z80FlagH
+	}
+	if sum > 0xffff {
+		z.f |= z80FlagC
+	}
+	return result
+}
+
+func (z *z80) adc16(a uint16, b uint16) uint16 {
+	sum := uint32(a) + uint32(b) + uint32(z.f&z80FlagC)
+	result := uint16(sum)
+	z.f = uint8(result>>8) & (z80FlagS | z80Flags35)
+	if result == 0 {
+		z.f |= z80FlagZ
+	}
+	if (a^b^result)&0x1000 != 0 {
+		z.f |= z80FlagH
+	}
+	if (a^b)&0x8000 == 0 && (a^result)&0x8000 != 0 {
+		z.f |= z80FlagPV
+	}
+	if sum > 0xffff {
+		z.f |= z80FlagC
+	}
+	return result
+}
+
+func (z *z80) sbc16(a uint16, b uint16) uint16 {
+	diff := uint32(a) - uint32(b) - uint32(z.f&z80FlagC)
+	result := uint16(diff)
+	z.f = uint8(result>>8)&(z80FlagS|z80Flags35) | z80FlagN
+	if result == 0 {
+		z.f |= z80FlagZ
+	}
+	if (a^b^result)&0x1000 != 0 {
+		z.f |= z80FlagH
+	}
+	if (a^b)&0x8000 != 0 && (a^result)&0x8000 != 0 {
+		z.f |= z80FlagPV
+	}
+	if diff > 0xffff {
+		z.f |= z80FlagC
+	}
+	return result
+}
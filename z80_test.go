@@ -0,0 +1,219 @@
+package main
+
+import (
+	"testing"
+)
+
+// Flat 64K of RAM with the ports and the INT line for the tests
+type z80TestBus struct {
+	mem   [0x10000]uint8
+	ports [0x100]uint8
+	irq   bool
+}
+
+func (b *z80TestBus) fetch(address uint16) uint8        { return b.mem[address] }
+func (b *z80TestBus) read(address uint16) uint8         { return b.mem[address] }
+func (b *z80TestBus) write(address uint16, value uint8) { b.mem[address] = value }
+func (b *z80TestBus) in(port uint16) uint8              { return b.ports[port&0xff] }
+func (b *z80TestBus) out(port uint16, value uint8)      { b.ports[port&0xff] = value }
+func (b *z80TestBus) interrupt() bool                   { return b.irq }
+
+// Runs the program loaded at 0 until HALT
+func runZ80(t *testing.T, program []uint8) (*z80, *z80TestBus) {
+	var bus z80TestBus
+	copy(bus.mem[:], program)
+	z := newZ80(&bus)
+	for i := 0; !z.halted; i++ {
+		if i > 10000 {
+			t.Fatal("The program does not halt")
+		}
+		z.step()
+	}
+	return z, &bus
+}
+
+func TestZ80Add(t *testing.T) {
+	z, _ := runZ80(t, []uint8{
+		0x3e, 0x7f, // LD A,&7F
+		0xc6, 0x01, // ADD A,1
+		0x76, // HALT
+	})
+
+	if z.a != 0x80 {
+		t.Errorf("A is 0x%02x and should be 0x80", z.a)
+	}
+	expected := z80FlagS | z80FlagH | z80FlagPV
+	if z.f != expected {
+		t.Errorf("F is 0x%02x and should be 0x%02x", z.f, expected)
+	}
+}
+
+func TestZ80Compare(t *testing.T) {
+	z, _ := runZ80(t, []uint8{
+		0x3e, 0x10, // LD A,&10
+		0xfe, 0x20, // CP &20
+		0x76, // HALT
+	})
+
+	if z.a != 0x10 {
+		t.Errorf("CP should not change A, it is 0x%02x", z.a)
+	}
+	if z.f&z80FlagC == 0 || z.f&z80FlagN == 0 || z.f&z80FlagZ != 0 {
+		t.Errorf("F is 0x%02x, CP should set the carry and N", z.f)
+	}
+}
+
+func TestZ80Daa(t *testing.T) {
+	z, _ := runZ80(t, []uint8{
+		0x3e, 0x15, // LD A,&15
+		0xc6, 0x27, // ADD A,&27
+		0x27,       // DAA
+		0x47,       // LD B,A
+		0xd6, 0x43, // SUB &43
+		0x27, // DAA
+		0x76, // HALT
+	})
+
+	if z.b != 0x42 {
+		t.Errorf("15+27 is 0x%02x and should be 0x42 in BCD", z.b)
+	}
+	if z.a != 0x99 || z.f&z80FlagC == 0 {
+		t.Errorf("42-43 is 0x%02x with F 0x%02x and should be 0x99 with carry", z.a, z.f)
+	}
+}
+
+func TestZ80Loop(t *testing.T) {
+	z, _ := runZ80(t, []uint8{
+		0x06, 0x0a, // LD B,10
+		0xaf,       // XOR A
+		0x80,       // loop: ADD A,B
+		0x10, 0xfd, // DJNZ loop
+		0x76, // HALT
+	})
+
+	if z.a != 55 {
+		t.Errorf("The sum is %v and should be 55", z.a)
+	}
+}
+
+func TestZ80Ldir(t *testing.T) {
+	z, bus := runZ80(t, []uint8{
+		0x21, 0x0c, 0x00, // LD HL,data
+		0x11, 0x00, 0x20, // LD DE,&2000
+		0x01, 0x04, 0x00, // LD BC,4
+		0xed, 0xb0, // LDIR
+		0x76,               // HALT
+		'B', 'B', 'Z', '!', // data
+	})
+
+	if string(bus.mem[0x2000:0x2004]) != "BBZ!" {
+		t.Errorf("LDIR copied %q", bus.mem[0x2000:0x2004])
+	}
+	if z.bc() != 0 || z.hl() != 0x0010 || z.de() != 0x2004 {
+		t.Errorf("BC, HL and DE are 0x%04x, 0x%04x and 0x%04x after LDIR", z.bc(), z.hl(), z.de())
+	}
+	if z.f&z80FlagPV != 0 {
+		t.Error("LDIR should reset P/V when BC reaches 0")
+	}
+}
+
+func TestZ80Sbc16(t *testing.T) {
+	z, _ := runZ80(t, []uint8{
+		0x21, 0x00, 0x10, // LD HL,&1000
+		0x11, 0x01, 0x00, // LD DE,1
+		0x37,       // SCF
+		0xed, 0x52, // SBC HL,DE
+		0x76, // HALT
+	})
+
+	if z.hl() != 0x0ffe {
+		t.Errorf("HL is 0x%04x and should be 0x0ffe", z.hl())
+	}
+	if z.f&z80FlagN == 0 || z.f&z80FlagC != 0 || z.f&z80FlagH == 0 {
+		t.Errorf("F is 0x%02x, SBC should set N and H without carry", z.f)
+	}
+}
+
+func TestZ80CallAndStack(t *testing.T) {
+	z, _ := runZ80(t, []uint8{
+		0x31, 0x00, 0x80, // LD SP,&8000
+		0x01, 0x34, 0x12, // LD BC,&1234
+		0xc5,             // PUSH BC
+		0xcd, 0x0e, 0x00, // CALL sub
+		0xe1, // POP HL
+		0x76, // HALT
+		0x00, 0x00,
+		0x3e, 0x55, // sub: LD A,&55
+		0xc9, // RET
+	})
+
+	if z.a != 0x55 || z.hl() != 0x1234 || z.sp != 0x8000 {
+		t.Errorf("A, HL and SP are 0x%02x, 0x%04x and 0x%04x after the call", z.a, z.hl(), z.sp)
+	}
+}
+
+func TestZ80Index(t *testing.T) {
+	z, bus := runZ80(t, []uint8{
+		0xdd, 0x21, 0x00, 0x30, // LD IX,&3000
+		0xdd, 0x36, 0xfe, 0xaa, // LD (IX-2),&AA
+		0xdd, 0xcb, 0xfe, 0x06, // RLC (IX-2)
+		0xfd, 0x21, 0xfe, 0x2f, // LD IY,&2FFE
+		0xfd, 0x7e, 0x00, // LD A,(IY+0)
+		0x76, // HALT
+	})
+
+	if bus.mem[0x2ffe] != 0x55 || z.a != 0x55 {
+		t.Errorf("The memory is 0x%02x and A 0x%02x, they should be 0x55", bus.mem[0x2ffe], z.a)
+	}
+	if z.f&z80FlagC == 0 {
+		t.Error("RLC should set the carry with the bit 7")
+	}
+}
+
+func TestZ80Ports(t *testing.T) {
+	var bus z80TestBus
+	copy(bus.mem[:], []uint8{
+		0xdb, 0x02, // IN A,(2)
+		0x3c,       // INC A
+		0xd3, 0x03, // OUT (3),A
+		0x76, // HALT
+	})
+	bus.ports[2] = 0x41
+	z := newZ80(&bus)
+	for !z.halted {
+		z.step()
+	}
+
+	if bus.ports[3] != 0x42 {
+		t.Errorf("The port has 0x%02x and should have 0x42", bus.ports[3])
+	}
+}
+
+func TestZ80Interrupt(t *testing.T) {
+	var bus z80TestBus
+	copy(bus.mem[:], []uint8{
+		0x31, 0x00, 0x80, // LD SP,&8000
+		0xed, 0x56, // IM 1
+		0xfb, // EI
+		0x76, // HALT
+	})
+	bus.mem[0x38] = 0x76 // HALT
+	z := newZ80(&bus)
+	for !z.halted {
+		z.step()
+	}
+	if z.pc != 0x0007 {
+		t.Fatalf("The CPU is halted on 0x%04x", z.pc)
+	}
+
+	bus.irq = true
+	if cycles := z.step(); cycles != 13 {
+		t.Errorf("The interrupt took %v T-states and should take 13", cycles)
+	}
+	if z.pc != 0x0038 || z.halted || z.iff1 {
+		t.Errorf("The interrupt should jump to 0x0038 with the interrupts disabled, PC is 0x%04x", z.pc)
+	}
+	if z.readWord(z.sp) != 0x0007 {
+		t.Errorf("The return address is 0x%04x", z.readWord(z.sp))
+	}
+}